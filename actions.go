@@ -0,0 +1,138 @@
+package gorule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Action is the decision made by a script, the host application decides how to enact it
+type Action string
+
+const (
+	// ActionNone means the script made no decision
+	ActionNone Action = ""
+	// ActionDeny means the request should be rejected with Status and Reason
+	ActionDeny Action = "deny"
+	// ActionRedirect means the client should be redirected to Location with Status
+	ActionRedirect Action = "redirect"
+	// ActionRespond means the request should be answered with Status and Body
+	ActionRespond Action = "respond"
+)
+
+// Outcome contains the decision and tags collected while executing a script
+type Outcome struct {
+	Action   Action
+	Status   int
+	Reason   string
+	Location string
+	Body     string
+	Tags     []string
+	// Line is the line of the statement that made the decision
+	Line int
+}
+
+// errDecided is returned by the deny, redirect and respond statements to end the script
+var errDecided = errors.New("decided")
+
+// defaultStatus is used when the action statement has no status
+var defaultStatus = map[Action]int{
+	ActionDeny:     403,
+	ActionRedirect: 302,
+	ActionRespond:  200,
+}
+
+// actionStatement makes a decision and ends the script, like: deny 403 "reason"
+type actionStatement struct {
+	action Action
+	status *operand
+	value  *operand
+	line   int
+}
+
+// action parses a deny, redirect or respond statement, the status is optional
+func (p *parser) action(word string, line int) (statement, error) {
+	st := &actionStatement{action: Action(word), line: line}
+	first, err := p.operand("status or value as 1st parameter", word)
+	if err != nil {
+		return nil, err
+	}
+	if p.endOfStatement() {
+		// a single number is the status, anything else the value
+		if _, err := strconv.Atoi(first.text); err == nil && !first.quoted {
+			st.status = &first
+		} else {
+			st.value = &first
+		}
+		return st, nil
+	}
+	second, err := p.operand("value as 2nd parameter", word)
+	if err != nil {
+		return nil, err
+	}
+	st.status, st.value = &first, &second
+	return st, nil
+}
+
+func (st *actionStatement) pos() int {
+	return st.line
+}
+
+func (st *actionStatement) exec(s *state) error {
+	status := defaultStatus[st.action]
+	if st.status != nil {
+		text, err := s.text(*st.status)
+		if err != nil {
+			return fmt.Errorf("error parsing status as 1st parameter to '%s' at line:%d error:%s", st.action, st.line, err)
+		}
+		status, err = strconv.Atoi(text)
+		if err != nil || status < 100 || status > 599 {
+			return fmt.Errorf("invalid status '%s' to '%s' at line:%d", text, st.action, st.line)
+		}
+	}
+	var value string
+	if st.value != nil {
+		var err error
+		value, err = s.text(*st.value)
+		if err != nil {
+			return fmt.Errorf("error parsing value as parameter to '%s' at line:%d error:%s", st.action, st.line, err)
+		}
+	}
+
+	s.outcome.Action = st.action
+	s.outcome.Status = status
+	s.outcome.Line = st.line
+	switch st.action {
+	case ActionDeny:
+		s.outcome.Reason = value
+	case ActionRedirect:
+		s.outcome.Location = value
+	case ActionRespond:
+		s.outcome.Body = value
+	}
+	return errDecided
+}
+
+// tagStatement adds a tag to the outcome, and continues the script
+type tagStatement struct {
+	tag  operand
+	line int
+}
+
+func (st *tagStatement) pos() int {
+	return st.line
+}
+
+func (st *tagStatement) exec(s *state) error {
+	tag, err := s.text(st.tag)
+	if err != nil {
+		return fmt.Errorf("error parsing value as parameter to 'tag' at line:%d error:%s", st.line, err)
+	}
+	for _, t := range s.outcome.Tags {
+		if t == tag {
+			return nil
+		}
+	}
+	s.outcome.Tags = append(s.outcome.Tags, tag)
+	return nil
+}
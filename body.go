@@ -0,0 +1,397 @@
+package gorule
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// WithBodyLimit allows scripts to read and change the body of requests and responses up to limit bytes
+// bodies are only read when a script uses them, and are replaced with a fresh reader after the execution
+func WithBodyLimit(limit int64) Option {
+	return func(e *Engine) {
+		e.bodyLimit = limit
+	}
+}
+
+// bufferedBody replaces the body of a request or response during the execution of a script
+// the body is read when the script uses it for the first time
+type bufferedBody struct {
+	source io.ReadCloser
+	limit  int64
+	data   []byte
+	read   int
+	loaded bool
+	err    error
+}
+
+// Read reads the buffered body, so the body is still available to the script after it was read, like by request.form
+func (b *bufferedBody) Read(p []byte) (int, error) {
+	if err := b.load(); err != nil {
+		return 0, err
+	}
+	if b.read >= len(b.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data[b.read:])
+	b.read += n
+	return n, nil
+}
+
+// Close closes the original body
+func (b *bufferedBody) Close() error {
+	return b.source.Close()
+}
+
+// load reads the original body, up to the limit
+func (b *bufferedBody) load() error {
+	if b.loaded || b.err != nil {
+		return b.err
+	}
+	data, err := io.ReadAll(io.LimitReader(b.source, b.limit+1))
+	b.data = data
+	switch {
+	case err != nil:
+		b.err = fmt.Errorf("failed to read the body: %s", err)
+	case int64(len(data)) > b.limit:
+		b.err = fmt.Errorf("the body is larger than the limit of %d bytes", b.limit)
+	default:
+		b.loaded = true
+	}
+	return b.err
+}
+
+// reader returns the body to hand back to the caller after the execution
+func (b *bufferedBody) reader() io.ReadCloser {
+	if b.loaded {
+		b.source.Close()
+		return io.NopCloser(bytes.NewReader(b.data))
+	}
+	// the part read before an error still belongs to the body
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b.data), b.source), b.source}
+}
+
+// bodyOf returns the buffered body of a request or response
+func bodyOf(mod interface{}) (*bufferedBody, error) {
+	var body io.ReadCloser
+	switch r := mod.(type) {
+	case *http.Request:
+		body = r.Body
+	case *http.Response:
+		body = r.Body
+	}
+	b, ok := body.(*bufferedBody)
+	if !ok {
+		return nil, fmt.Errorf("the body can only be used if it is enabled with WithBodyLimit")
+	}
+	return b, b.load()
+}
+
+// setBody replaces the buffered body of a request or response, and updates the content length
+func setBody(mod interface{}, data []byte) error {
+	b, err := bodyOf(mod)
+	if err != nil {
+		return err
+	}
+	b.data, b.read = data, 0
+	var header http.Header
+	switch r := mod.(type) {
+	case *http.Request:
+		r.ContentLength = int64(len(data))
+		header = r.Header
+	case *http.Response:
+		r.ContentLength = int64(len(data))
+		header = r.Header
+	}
+	if header.Get("Content-Length") != "" {
+		header.Set("Content-Length", strconv.Itoa(len(data)))
+	}
+	return nil
+}
+
+// bufferBodies replaces the bodies of the requests and responses in the resources with a buffered body
+func bufferBodies(resources map[string]interface{}, limit int64) {
+	for _, r := range resources {
+		switch r := r.(type) {
+		case *http.Request:
+			if r.Body == nil {
+				r.Body = http.NoBody
+			}
+			r.Body = &bufferedBody{source: r.Body, limit: limit}
+		case *http.Response:
+			if r.Body == nil {
+				r.Body = http.NoBody
+			}
+			r.Body = &bufferedBody{source: r.Body, limit: limit}
+		}
+	}
+}
+
+// restoreBodies replaces the buffered bodies with a fresh reader of the (changed) body
+func restoreBodies(resources map[string]interface{}) {
+	for _, r := range resources {
+		switch r := r.(type) {
+		case *http.Request:
+			if b, ok := r.Body.(*bufferedBody); ok {
+				if !b.loaded && b.data == nil {
+					r.Body = b.source
+					continue
+				}
+				r.Body = b.reader()
+				if b.loaded {
+					data := b.data
+					r.GetBody = func() (io.ReadCloser, error) {
+						return io.NopCloser(bytes.NewReader(data)), nil
+					}
+				}
+			}
+		case *http.Response:
+			if b, ok := r.Body.(*bufferedBody); ok {
+				if !b.loaded && b.data == nil {
+					r.Body = b.source
+					continue
+				}
+				r.Body = b.reader()
+			}
+		}
+	}
+}
+
+// getBody returns the body as string
+func getBody(mod interface{}) (interface{}, error) {
+	b, err := bodyOf(mod)
+	if err != nil {
+		return nil, err
+	}
+	body := string(b.data)
+	return &body, nil
+}
+
+// setBodyString replaces the body with the string changed by the script
+func setBodyString(mod interface{}, value interface{}) error {
+	return setBody(mod, []byte(*value.(*string)))
+}
+
+// formBody returns if the form of a request is read from its body, like ParseForm does
+func formBody(r *http.Request) bool {
+	if r.Method != "POST" && r.Method != "PUT" && r.Method != "PATCH" {
+		return false
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return contentType == "application/x-www-form-urlencoded"
+}
+
+// getForm returns the form of the body of a request, it is parsed from the buffered body so the body can still be forwarded
+func getForm(mod interface{}) (interface{}, error) {
+	r := mod.(*http.Request)
+	form := url.Values{}
+	switch {
+	case r.PostForm != nil:
+		// the form has already been parsed by the caller
+		for k, v := range r.PostForm {
+			form[k] = append([]string{}, v...)
+		}
+	case formBody(r):
+		b, err := bodyOf(r)
+		if err != nil {
+			return nil, fmt.Errorf("the form can only be used if the body is enabled with WithBodyLimit")
+		}
+		if form, err = url.ParseQuery(string(b.data)); err != nil {
+			return nil, fmt.Errorf("the body is not a valid form: %s", err)
+		}
+	}
+	return form, nil
+}
+
+// setForm encodes the form changed by the script in to the body of the request
+func setForm(mod interface{}, value interface{}) error {
+	r := mod.(*http.Request)
+	if _, err := bodyOf(r); err != nil {
+		return fmt.Errorf("the form can only be changed if the body is enabled with WithBodyLimit")
+	}
+	form := value.(url.Values)
+	if err := setBody(r, []byte(form.Encode())); err != nil {
+		return err
+	}
+	if r.Header == nil {
+		r.Header = http.Header{}
+	}
+	if r.Header.Get("Content-Type") == "" {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	r.PostForm = form
+	// the form contains the post form too, so it needs to be parsed again
+	r.Form = nil
+	return nil
+}
+
+// getJSON returns the body parsed as json, an empty body is an empty object
+func getJSON(mod interface{}) (interface{}, error) {
+	b, err := bodyOf(mod)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(b.data)) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	var doc interface{}
+	d := json.NewDecoder(bytes.NewReader(b.data))
+	d.UseNumber()
+	if err := d.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("the body is not valid json: %s", err)
+	}
+	return doc, nil
+}
+
+// modifyJSON changes a value in the json body based on tree, missing objects are created
+func modifyJSON(mod interface{}, tree []string, value string) error {
+	doc, err := getJSON(mod)
+	if err != nil {
+		return err
+	}
+	doc, err = changeJSON(doc, tree[1:], &value)
+	if err != nil {
+		return err
+	}
+	return writeJSON(mod, doc)
+}
+
+// deleteJSON removes a value from the json body based on tree
+func deleteJSON(mod interface{}, tree []string) error {
+	doc, err := getJSON(mod)
+	if err != nil {
+		return err
+	}
+	// removing the whole json empties the body
+	if len(tree) == 1 {
+		return setBody(mod, nil)
+	}
+	doc, err = changeJSON(doc, tree[1:], nil)
+	if err != nil {
+		return err
+	}
+	return writeJSON(mod, doc)
+}
+
+// writeJSON replaces the body with the json document
+func writeJSON(mod interface{}, doc interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return setBody(mod, data)
+}
+
+// changeJSON sets the value in a json document based on tree, or removes it if value is nil, and returns the changed document
+func changeJSON(doc interface{}, tree []string, value *string) (interface{}, error) {
+	if len(tree) == 0 {
+		if value == nil {
+			return nil, nil
+		}
+		return jsonValue(doc, *value), nil
+	}
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		key, ok := jsonKey(d, tree[0])
+		if len(tree) == 1 && value == nil {
+			delete(d, key)
+			return d, nil
+		}
+		child := d[key]
+		if !ok && value == nil {
+			return d, nil
+		}
+		// objects that do not exist yet are created
+		if !ok && len(tree) > 1 {
+			child = map[string]interface{}{}
+		}
+		child, err := changeJSON(child, tree[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		d[key] = child
+		return d, nil
+	case []interface{}:
+		i, err := strconv.Atoi(tree[0])
+		if err != nil || i < 0 || i >= len(d) {
+			return nil, fmt.Errorf("changeJSON index '%s' has not been found in the array", tree[0])
+		}
+		if len(tree) == 1 && value == nil {
+			return append(d[:i:i], d[i+1:]...), nil
+		}
+		d[i], err = changeJSON(d[i], tree[1:], value)
+		return d, err
+	}
+	return nil, fmt.Errorf("changeJSON '%s' can not be found in a json %s", strings.Join(tree, "."), jsonType(doc))
+}
+
+// jsonKey returns the key of the object that matches name without case, like reads do, an exact match is used first
+// the name itself is returned if there is no match, so a new key keeps the case of the script
+func jsonKey(d map[string]interface{}, name string) (string, bool) {
+	if _, ok := d[name]; ok {
+		return name, true
+	}
+	for k := range d {
+		if strings.EqualFold(k, name) {
+			return k, true
+		}
+	}
+	return name, false
+}
+
+// jsonValue converts the value of the script to the json type of the current value
+// new values are a number, true or false if they look like one, and a string otherwise
+func jsonValue(current interface{}, value string) interface{} {
+	switch current.(type) {
+	case string:
+		return value
+	case json.Number:
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return json.Number(value)
+		}
+		return value
+	case bool:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+		return value
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return json.Number(value)
+	}
+	if value == "true" || value == "false" {
+		return value == "true"
+	}
+	return value
+}
+
+// jsonType returns the name of the json type of a value
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,107 @@
+package gorule
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// WithTrustedProxies sets the networks of the proxies in front of the service, as CIDR or single ip
+// request.clientip only uses the X-Forwarded-For and Forwarded headers when they are set by a trusted proxy
+func WithTrustedProxies(networks ...string) Option {
+	return func(e *Engine) {
+		for _, n := range networks {
+			cidr := n
+			if !strings.Contains(cidr, "/") {
+				cidr = addSubnet(cidr)
+			}
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				e.err = fmt.Errorf("invalid trusted proxy '%s': %s", n, err)
+				return
+			}
+			e.trustedProxies = append(e.trustedProxies, ipnet)
+		}
+	}
+}
+
+// trusted returns true if ip is the address of a trusted proxy
+func (e *Engine) trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range e.trustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// getClientIP returns the address of the client, walking the forwarded addresses from the last to the first
+// until an address is found that is not a trusted proxy
+func getClientIP(e *Engine, mod interface{}) (interface{}, error) {
+	r := mod.(*http.Request)
+	ip := hostIP(r.RemoteAddr)
+	if !e.trusted(ip) {
+		return ip, nil
+	}
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := hostIP(hops[i])
+		// an address that can not be parsed can not be trusted either, the last valid address is used
+		if hop == "" {
+			break
+		}
+		ip = hop
+		if !e.trusted(ip) {
+			break
+		}
+	}
+	return ip, nil
+}
+
+// forwardedFor returns the addresses of the Forwarded header, or of the X-Forwarded-For header if there is none
+func forwardedFor(header http.Header) []string {
+	hops := []string{}
+	for _, value := range header.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					hops = append(hops, strings.Trim(v, `"`))
+				}
+			}
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// hostIP returns the ip of an address without port or brackets, like: 10.0.0.1:443 or [::1]:443
+// an empty string is returned if the address is not an ip
+func hostIP(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	// the zone of an ipv6 address is not part of the ip, like: fe80::1%eth0
+	if i := strings.Index(addr, "%"); i >= 0 {
+		addr = addr[:i]
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
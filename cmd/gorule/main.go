@@ -0,0 +1,100 @@
+// gorule is the command line tool of gorule
+//
+// gen compiles a script to a Go function that accesses the fields of the resources directly, like:
+//
+//	gorule gen -package rules -func Rewrite -o rewrite_gen.go rewrite.rule request=*net/http.Request
+//
+// the types of the bindings are named by the full import path of their package
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/rdoorn/gorule/internal/gen"
+)
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "gen" {
+		fmt.Fprintln(os.Stderr, "usage: gorule gen [flags] script name=type...")
+		os.Exit(2)
+	}
+	if err := generate(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "gorule gen:", err)
+		os.Exit(1)
+	}
+}
+
+// generate generates the Go function of a script
+func generate(args []string) error {
+	flags := flag.NewFlagSet("gen", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: gorule gen [flags] script name=type...")
+		flags.PrintDefaults()
+	}
+	pkg := flags.String("package", os.Getenv("GOPACKAGE"), "package of the generated file, the package of go generate by default")
+	name := flags.String("name", "", "name of the rule used in violations and errors, the name of the script without extension by default")
+	fn := flags.String("func", "", "name of the generated function, the name of the rule by default")
+	output := flags.String("o", "", "file to write the generated code to, stdout by default")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	script, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *pkg == "" {
+		*pkg = "main"
+	}
+	if *name == "" {
+		*name = strings.TrimSuffix(filepath.Base(flags.Arg(0)), filepath.Ext(flags.Arg(0)))
+	}
+	if *fn == "" {
+		*fn = identifier(*name)
+	}
+	code, err := gen.Generate(script, gen.Options{
+		Package:  *pkg,
+		Func:     *fn,
+		Name:     *name,
+		Bindings: flags.Args()[1:],
+	})
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(code)
+		return err
+	}
+	return os.WriteFile(*output, code, 0644)
+}
+
+// identifier converts the name of a rule to a Go identifier, like: rewrite-hosts to rewriteHosts
+func identifier(name string) string {
+	b := strings.Builder{}
+	upper := false
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = b.Len() > 0
+			continue
+		}
+		if b.Len() == 0 && unicode.IsDigit(r) {
+			b.WriteString("rule")
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	if b.Len() == 0 {
+		return "rule"
+	}
+	return b.String()
+}
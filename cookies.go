@@ -0,0 +1,232 @@
+package gorule
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// setCookie is a cookie of a Set-Cookie header as seen by the script, like: response.setcookie.session.secure
+type setCookie struct {
+	Value    string
+	Path     string
+	Domain   string
+	Expires  string // in the format of http.TimeFormat
+	MaxAge   int    // a negative value removes the cookie in the browser
+	Secure   bool
+	HttpOnly bool
+	SameSite string // lax, strict or none
+
+	// line is the index of the Set-Cookie header the cookie was read from, and read the cookie as it was read
+	// so only the cookies that were changed are written again, read is nil for new cookies
+	line int
+	read *setCookie
+}
+
+// changed returns if the script changed a field of the cookie
+func (sc *setCookie) changed() bool {
+	r := sc.read
+	return r == nil || sc.Value != r.Value || sc.Path != r.Path || sc.Domain != r.Domain || sc.Expires != r.Expires ||
+		sc.MaxAge != r.MaxAge || sc.Secure != r.Secure || sc.HttpOnly != r.HttpOnly || sc.SameSite != r.SameSite
+}
+
+// setCookieAttributes are the attributes of a Set-Cookie header that are fields of setCookie
+var setCookieAttributes = map[string]bool{
+	"path": true, "domain": true, "expires": true, "max-age": true, "secure": true, "httponly": true, "samesite": true,
+}
+
+// parseSetCookie parses a single Set-Cookie header, it returns nil if the header is not a valid cookie
+func parseSetCookie(line string) *http.Cookie {
+	cookies := (&http.Response{Header: http.Header{"Set-Cookie": {line}}}).Cookies()
+	if len(cookies) == 0 {
+		return nil
+	}
+	return cookies[0]
+}
+
+// sameSiteModes are the names of the SameSite attribute of a cookie
+var sameSiteModes = map[http.SameSite]string{
+	http.SameSiteDefaultMode: "default",
+	http.SameSiteLaxMode:     "lax",
+	http.SameSiteStrictMode:  "strict",
+	http.SameSiteNoneMode:    "none",
+}
+
+// getRequestCookies returns the cookies of the Cookie header by name
+func getRequestCookies(mod interface{}) (interface{}, error) {
+	cookies := map[string][]string{}
+	for _, c := range mod.(*http.Request).Cookies() {
+		cookies[c.Name] = append(cookies[c.Name], c.Value)
+	}
+	return cookies, nil
+}
+
+// setRequestCookies replaces the Cookie header with the cookies, in the order they were in, new cookies are added sorted by name
+func setRequestCookies(mod interface{}, value interface{}) error {
+	r := mod.(*http.Request)
+	cookies := value.(map[string][]string)
+	names := []string{}
+	seen := map[string]bool{}
+	for _, c := range r.Cookies() {
+		if _, ok := cookies[c.Name]; ok && !seen[c.Name] {
+			names = append(names, c.Name)
+			seen[c.Name] = true
+		}
+	}
+	added := []string{}
+	for name := range cookies {
+		if !seen[name] {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	names = append(names, added...)
+
+	pairs := []string{}
+	for _, name := range names {
+		for _, v := range cookies[name] {
+			c := (&http.Cookie{Name: name, Value: v}).String()
+			if c == "" {
+				return fmt.Errorf("invalid cookie '%s'", name)
+			}
+			pairs = append(pairs, c)
+		}
+	}
+	if r.Header == nil {
+		r.Header = http.Header{}
+	}
+	r.Header.Del("Cookie")
+	if len(pairs) > 0 {
+		r.Header.Set("Cookie", strings.Join(pairs, "; "))
+	}
+	return nil
+}
+
+// getSetCookies returns the cookies of the Set-Cookie headers by name, a cookie that is set more than once is read from its last header
+func getSetCookies(mod interface{}) (interface{}, error) {
+	cookies := map[string]*setCookie{}
+	for i, line := range mod.(*http.Response).Header["Set-Cookie"] {
+		c := parseSetCookie(line)
+		if c == nil {
+			continue
+		}
+		sc := &setCookie{
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			MaxAge:   c.MaxAge,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+			SameSite: sameSiteModes[c.SameSite],
+			line:     i,
+		}
+		if !c.Expires.IsZero() {
+			sc.Expires = c.Expires.UTC().Format(http.TimeFormat)
+		}
+		if sc.SameSite == "default" {
+			sc.SameSite = ""
+		}
+		read := *sc
+		sc.read = &read
+		cookies[c.Name] = sc
+	}
+	return cookies, nil
+}
+
+// setSetCookies writes the changed cookies back in to their Set-Cookie header, the other headers are kept as they are
+// removed cookies remove all their headers, and new cookies are added sorted by name
+func setSetCookies(mod interface{}, value interface{}) error {
+	r := mod.(*http.Response)
+	cookies := value.(map[string]*setCookie)
+	if r.Header == nil {
+		r.Header = http.Header{}
+	}
+
+	headers := []string{}
+	for i, line := range r.Header["Set-Cookie"] {
+		c := parseSetCookie(line)
+		if c == nil {
+			headers = append(headers, line)
+			continue
+		}
+		sc, ok := cookies[c.Name]
+		switch {
+		case !ok:
+			// the cookie has been removed
+		case sc.read == nil || sc.line != i || !sc.changed():
+			headers = append(headers, line)
+		default:
+			header, err := sc.header(c.Name, line)
+			if err != nil {
+				return err
+			}
+			headers = append(headers, header)
+		}
+	}
+
+	names := []string{}
+	for name, sc := range cookies {
+		if sc.read == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		header, err := cookies[name].header(name, "")
+		if err != nil {
+			return err
+		}
+		headers = append(headers, header)
+	}
+
+	r.Header.Del("Set-Cookie")
+	for _, h := range headers {
+		r.Header.Add("Set-Cookie", h)
+	}
+	return nil
+}
+
+// header returns the Set-Cookie header of the cookie, the attributes of the original header that are not fields of setCookie are kept
+func (sc *setCookie) header(name, original string) (string, error) {
+	c := &http.Cookie{
+		Name:     name,
+		Value:    sc.Value,
+		Path:     sc.Path,
+		Domain:   sc.Domain,
+		MaxAge:   sc.MaxAge,
+		Secure:   sc.Secure,
+		HttpOnly: sc.HttpOnly,
+	}
+	if sc.Expires != "" {
+		t, err := http.ParseTime(sc.Expires)
+		if err != nil {
+			return "", fmt.Errorf("invalid expires '%s' of cookie '%s'", sc.Expires, name)
+		}
+		c.Expires = t
+	}
+	if sc.SameSite != "" {
+		found := false
+		for mode, n := range sameSiteModes {
+			if strings.EqualFold(n, sc.SameSite) {
+				c.SameSite, found = mode, true
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("invalid samesite '%s' of cookie '%s'", sc.SameSite, name)
+		}
+	}
+	header := c.String()
+	if header == "" {
+		return "", fmt.Errorf("invalid cookie '%s'", name)
+	}
+	parts := strings.Split(original, ";")
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		attribute, _, _ := strings.Cut(part, "=")
+		if part != "" && !setCookieAttributes[strings.ToLower(strings.TrimSpace(attribute))] {
+			header += "; " + part
+		}
+	}
+	return header, nil
+}
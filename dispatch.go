@@ -0,0 +1,252 @@
+package gorule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// dispatchMin is the minimum number of tests on the same subject before they are dispatched instead of evaluated one by one
+const dispatchMin = 4
+
+// dispatchTest is a test of a subject against a constant, index is the branch or case it belongs to
+type dispatchTest struct {
+	validator string
+	value     string
+	index     int
+}
+
+// dispatchValidators are the validators that can be dispatched
+var dispatchValidators = map[string]bool{
+	"==":         true,
+	"has_prefix": true,
+	"contains":   true,
+}
+
+// dispatch finds the first of many tests on the same subject that matches
+// equality uses a map, prefixes a trie and substrings an Aho-Corasick automaton
+// so the cost depends on the length of the subject and not on the number of tests
+type dispatch struct {
+	subject  operand
+	first    int // the first and last branch or case of the tests
+	last     int
+	equal    map[string]int
+	prefix   *trieNode
+	contains *trieNode
+}
+
+// trieNode is a node of a trie, or of an Aho-Corasick automaton when the fail links are set
+type trieNode struct {
+	next  map[byte]*trieNode
+	fail  *trieNode
+	index int // the first index of the values ending at this node, -1 if none
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{next: map[byte]*trieNode{}, index: -1}
+}
+
+// insert adds a value to the trie, keeping the first index of equal values
+func (n *trieNode) insert(value string, index int) {
+	for i := 0; i < len(value); i++ {
+		child, ok := n.next[value[i]]
+		if !ok {
+			child = newTrieNode()
+			n.next[value[i]] = child
+		}
+		n = child
+	}
+	n.index = firstIndex(n.index, index)
+}
+
+// link sets the fail links of the trie, turning it in to an Aho-Corasick automaton
+// the index of a node includes the values that are a suffix of it
+func (root *trieNode) link() {
+	root.fail = root
+	queue := []*trieNode{root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for c, child := range n.next {
+			f := n.fail
+			for f != root && f.next[c] == nil {
+				f = f.fail
+			}
+			child.fail = root
+			if next, ok := f.next[c]; ok && next != child {
+				child.fail = next
+			}
+			child.index = firstIndex(child.index, child.fail.index)
+			queue = append(queue, child)
+		}
+	}
+}
+
+// firstIndex returns the lowest index, ignoring -1
+func firstIndex(a, b int) int {
+	if a < 0 || (b >= 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// find returns the first index of the tests that match the subject, or -1 if none
+// ok is false if the subject is a number, as numbers are compared by value by ==, like 01 == 1
+func (d *dispatch) find(subject string) (index int, ok bool) {
+	index = -1
+	if d.equal != nil {
+		if _, err := strconv.Atoi(subject); err == nil {
+			return -1, false
+		}
+		if i, found := d.equal[subject]; found {
+			index = i
+		}
+	}
+	if n := d.prefix; n != nil {
+		index = firstIndex(index, n.index)
+		for i := 0; i < len(subject) && n != nil; i++ {
+			if n = n.next[subject[i]]; n != nil {
+				index = firstIndex(index, n.index)
+			}
+		}
+	}
+	if root := d.contains; root != nil {
+		index = firstIndex(index, root.index)
+		n := root
+		for i := 0; i < len(subject); i++ {
+			c := subject[i]
+			for n != root && n.next[c] == nil {
+				n = n.fail
+			}
+			if next, found := n.next[c]; found {
+				n = next
+			}
+			index = firstIndex(index, n.index)
+		}
+	}
+	return index, true
+}
+
+// newDispatch builds the dispatch of the tests
+func newDispatch(subject operand, tests []dispatchTest) *dispatch {
+	d := &dispatch{subject: subject, first: tests[0].index, last: tests[len(tests)-1].index}
+	for _, t := range tests {
+		switch t.validator {
+		case "==":
+			if d.equal == nil {
+				d.equal = map[string]int{}
+			}
+			if _, ok := d.equal[t.value]; !ok {
+				d.equal[t.value] = t.index
+			}
+		case "has_prefix":
+			if d.prefix == nil {
+				d.prefix = newTrieNode()
+			}
+			d.prefix.insert(t.value, t.index)
+		case "contains":
+			if d.contains == nil {
+				d.contains = newTrieNode()
+			}
+			d.contains.insert(t.value, t.index)
+		}
+	}
+	if d.contains != nil {
+		d.contains.link()
+	}
+	return d
+}
+
+// dispatchable returns true if the value can be dispatched, a constant or an interpolated variable without expressions
+func dispatchable(o operand, constant bool) bool {
+	if o.call != nil || strings.Contains(o.text, "${") {
+		return false
+	}
+	return constant != strings.Contains(o.text, "$")
+}
+
+// dispatchTests returns the test of a branch, if it compares subject to a constant
+func dispatchTests(p predicate, index int) (operand, []dispatchTest, bool) {
+	c, ok := p.(*condition)
+	if !ok || !dispatchValidators[c.validator] {
+		return operand{}, nil, false
+	}
+	left, ok := c.left.(operand)
+	if !ok || !dispatchable(left, false) {
+		return operand{}, nil, false
+	}
+	right, ok := constantValue(c.right)
+	if !ok {
+		return operand{}, nil, false
+	}
+	return left, []dispatchTest{{validator: c.validator, value: toString(right), index: index}}, true
+}
+
+// optimize replaces chains of elseif branches that test the same subject against constants with a dispatch
+func (st *ifStatement) optimize() {
+	st.dispatch = nil
+	var subject operand
+	var tests []dispatchTest
+	flush := func() {
+		if len(tests) >= dispatchMin {
+			if st.dispatch == nil {
+				st.dispatch = map[int]*dispatch{}
+			}
+			d := newDispatch(subject, tests)
+			st.dispatch[d.first] = d
+		}
+		tests = nil
+	}
+	for i, b := range st.branches {
+		s, t, ok := dispatchTests(b.condition, i)
+		if !ok || (len(tests) > 0 && s.text != subject.text) {
+			flush()
+		}
+		if ok {
+			subject = s
+			tests = append(tests, t...)
+		}
+	}
+	flush()
+}
+
+// optimize replaces runs of cases that compare the subject to constants with a dispatch
+func (st *switchStatement) optimize() {
+	st.dispatch = nil
+	var tests []dispatchTest
+	flush := func() {
+		if len(tests) >= dispatchMin {
+			if st.dispatch == nil {
+				st.dispatch = map[int]*dispatch{}
+			}
+			d := newDispatch(st.subject, tests)
+			st.dispatch[d.first] = d
+		}
+		tests = nil
+	}
+	for i, c := range st.cases {
+		ok := dispatchValidators[c.validator]
+		for _, v := range c.values {
+			ok = ok && dispatchable(v, true)
+		}
+		if !ok {
+			flush()
+			continue
+		}
+		for _, v := range c.values {
+			tests = append(tests, dispatchTest{validator: c.validator, value: v.text, index: i})
+		}
+	}
+	flush()
+}
+
+// branch returns the branch of the dispatch that matches, or -1 if none does
+// ok is false if the branches need to be evaluated one by one
+func (st *ifStatement) branch(s *state, d *dispatch) (int, bool, error) {
+	subject, err := d.subject.value(s)
+	if err != nil {
+		return -1, false, fmt.Errorf("error parsing value as 1st parameter to 'if' at line:%d error:%s", st.branches[d.first].condition.(*condition).line, err)
+	}
+	index, ok := d.find(toString(subject))
+	return index, ok, nil
+}
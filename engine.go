@@ -0,0 +1,127 @@
+package gorule
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"sync"
+)
+
+// Engine holds the configuration shared by all scripts compiled with it
+type Engine struct {
+	sink          LogSink
+	maxIterations int
+	maxCallDepth  int
+	fs            fs.FS
+	bodyLimit     int64
+	// trustedProxies are the networks of proxies allowed to set the forwarded headers
+	trustedProxies []*net.IPNet
+	// ipsets are the ip sets by name, used by in_ipset
+	ipsets sync.Map
+	// tables are the lookup tables by name, used by lookup and in_table
+	tables sync.Map
+	// noOptimization disables folding constants when compiling
+	noOptimization bool
+	// err is an invalid option, it is returned when compiling a script
+	err error
+}
+
+// Option configures an Engine
+type Option func(*Engine)
+
+// defaultEngine is used by the package level Parse function
+var defaultEngine = NewEngine()
+
+// NewEngine creates a new engine with the options provided
+func NewEngine(opts ...Option) *Engine {
+	e := &Engine{
+		maxIterations: defaultMaxIterations,
+		maxCallDepth:  defaultMaxCallDepth,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if e.sink == nil {
+		e.sink = &slogSink{}
+	}
+	return e
+}
+
+// Rule is a named and compiled script ready to be executed against resources
+type Rule struct {
+	engine  *Engine
+	name    string
+	program *program
+}
+
+// Result is the result of executing a rule
+type Result struct {
+	// Outputs contains the variables declared with export by the script
+	Outputs map[string]interface{}
+	// Stopped is true if the script ended early with stop, return or a decision
+	Stopped bool
+	// Value is the value handed back by return
+	Value interface{}
+	// Outcome contains the decision and tags of the script
+	Outcome Outcome
+	// Violations contains the failed require and violation statements
+	Violations []Violation
+}
+
+// Compile parses a script so it can be executed, the name is used to identify the script in logs
+func (e *Engine) Compile(name string, script []byte) (*Rule, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	program, err := compile(script, e.fs)
+	if err != nil {
+		return nil, err
+	}
+	if !e.noOptimization {
+		program.optimize()
+	}
+	return &Rule{
+		engine:  e,
+		name:    name,
+		program: program,
+	}, nil
+}
+
+// Name returns the name the rule was compiled with
+func (r *Rule) Name() string {
+	return r.name
+}
+
+// Execute runs the rule, and changes the interfaces defined as input based on that
+// the resources themselves are read-only, only their fields can be changed by the script
+func (r *Rule) Execute(i map[string]interface{}, opts ...ExecuteOption) (*Result, error) {
+	e := &execution{params: map[string]interface{}{}}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if r.engine.bodyLimit > 0 {
+		bufferBodies(i, r.engine.bodyLimit)
+		defer restoreBodies(i)
+	}
+	s := newState(r, i)
+	if err := r.program.declare(s, e.params); err != nil {
+		return nil, err
+	}
+	result := &Result{}
+	if err := r.program.body.run(s); err != nil {
+		var ret *returnValue
+		switch {
+		case errors.Is(err, errStop), errors.Is(err, errDecided):
+			result.Stopped = true
+		case errors.As(err, &ret):
+			result.Stopped = true
+			result.Value = ret.value
+		default:
+			return nil, err
+		}
+	}
+	result.Outputs = s.outputs()
+	result.Outcome = s.outcome
+	result.Violations = s.violations
+	return result, nil
+}
@@ -0,0 +1,32 @@
+package gorule
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errStop is returned by the stop statement to end the script successfully
+var errStop = errors.New("stop")
+
+// ErrMultipleValues is returned when a field with more than one value is used as a single value, a fallback does not replace it
+var ErrMultipleValues = errors.New("pick one with an index or a filter like first or join")
+
+// returnValue is returned by the return statement to end the script with a value
+type returnValue struct {
+	value interface{}
+}
+
+func (r *returnValue) Error() string {
+	return "return"
+}
+
+// FailError is returned when a script ends with the fail statement
+type FailError struct {
+	Script string
+	Reason string
+	Line   int
+}
+
+func (e *FailError) Error() string {
+	return fmt.Sprintf("script '%s' failed at line:%d: %s", e.Script, e.Line, e.Reason)
+}
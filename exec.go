@@ -0,0 +1,539 @@
+package gorule
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// statement is a single executable item of a script
+type statement interface {
+	exec(s *state) error
+	pos() int // line of the statement
+}
+
+// block is a list of statements with its own variable scope
+type block []statement
+
+// operand is a word, string or function call used as value in a statement
+type operand struct {
+	text   string
+	quoted bool
+	call   *call
+	line   int
+}
+
+// text returns the value of an operand as string, with the $(variables) replaced
+func (s *state) text(o operand) (string, error) {
+	if o.call != nil {
+		v, err := o.call.invoke(s)
+		if err != nil {
+			return "", err
+		}
+		return toString(v), nil
+	}
+	return s.parseVariableStrings(o.text)
+}
+
+// variable is a value declared by the script
+type variable struct {
+	value    interface{}
+	constant bool
+	exported bool
+	declared *declareStatement // the statement that declared the variable
+}
+
+// scope holds the variables declared in a block, and a link to the outer block
+type scope struct {
+	parent *scope
+	vars   map[string]*variable
+}
+
+// newScope creates a new scope within parent
+func newScope(parent *scope) *scope {
+	return &scope{
+		parent: parent,
+		vars:   map[string]*variable{},
+	}
+}
+
+// lookup finds a variable in this scope or any of the outer scopes
+func (sc *scope) lookup(name string) (*variable, *scope) {
+	for c := sc; c != nil; c = c.parent {
+		if v, ok := c.vars[name]; ok {
+			return v, c
+		}
+	}
+	return nil, nil
+}
+
+// state is the execution state of a rule
+type state struct {
+	rule       *Rule
+	resources  map[string]interface{}
+	root       *scope
+	frame      *scope // scope of the script or function, where var is declared
+	scope      *scope
+	outcome    Outcome
+	violations []Violation
+	iterations int
+	depth      int           // depth of function calls
+	exceeded   bool          // the maximum call depth was exceeded, which ends the script like fail
+	onError    onErrorPolicy // policy of the current block
+}
+
+// newState creates the execution state for the resources
+func newState(r *Rule, resources map[string]interface{}) *state {
+	root := newScope(nil)
+	return &state{
+		rule:      r,
+		resources: resources,
+		root:      root,
+		frame:     root,
+		scope:     root,
+	}
+}
+
+// lookup finds a variable or resource by its name
+func (s *state) lookup(name string) (interface{}, bool) {
+	if v, _ := s.scope.lookup(name); v != nil {
+		return v.value, true
+	}
+	r, ok := s.resources[name]
+	return r, ok
+}
+
+// outputs returns the exported variables
+func (s *state) outputs() map[string]interface{} {
+	out := map[string]interface{}{}
+	for name, v := range s.root.vars {
+		if v.exported {
+			out[name] = v.value
+		}
+	}
+	return out
+}
+
+// exec runs the statements in a new scope
+func (b block) exec(s *state) error {
+	outer, onError := s.scope, s.onError
+	s.scope = newScope(outer)
+	defer func() { s.scope, s.onError = outer, onError }()
+	return b.run(s)
+}
+
+// run runs the statements in the current scope, errors are handled based on the on_error policy
+func (b block) run(s *state) error {
+	for _, st := range b {
+		err := st.exec(s)
+		if err == nil || isControl(err) || isFail(err) || s.exceeded {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = withLine(st, err)
+
+		switch s.policy(st) {
+		case onErrorContinue:
+			s.ignored(st, err)
+		case onErrorSkipBlock:
+			s.ignored(st, err)
+			return nil
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// predicate is the condition of an if, elseif or require statement
+type predicate interface {
+	eval(s *state) (bool, error)
+}
+
+// ifBranch is a condition with the block to execute if it matches
+type ifBranch struct {
+	condition predicate
+	block     block
+}
+
+// ifStatement executes the first branch that matches, or the else block if none did
+type ifStatement struct {
+	branches  []ifBranch
+	otherwise block
+	dispatch  map[int]*dispatch // dispatches of chains of branches, by their first branch
+	line      int
+}
+
+func (st *ifStatement) pos() int {
+	return st.line
+}
+
+func (st *ifStatement) exec(s *state) error {
+	for i := 0; i < len(st.branches); i++ {
+		if d, ok := st.dispatch[i]; ok {
+			index, ok, err := st.branch(s, d)
+			if err != nil {
+				return err
+			}
+			if ok && index >= 0 {
+				return st.branches[index].block.exec(s)
+			}
+			if ok {
+				i = d.last
+				continue
+			}
+		}
+		b := st.branches[i]
+		result, err := b.condition.eval(s)
+		if err != nil {
+			return err
+		}
+		if result {
+			return b.block.exec(s)
+		}
+	}
+	if st.otherwise != nil {
+		return st.otherwise.exec(s)
+	}
+	return nil
+}
+
+// condition validates 2 values
+type condition struct {
+	left      expression
+	validator string
+	right     expression
+	line      int
+}
+
+func (c *condition) eval(s *state) (bool, error) {
+	param1, err := c.left.value(s)
+	if err != nil {
+		return false, fmt.Errorf("error parsing value as 1st parameter to 'if' at line:%d error:%s", c.line, err)
+	}
+	param2, err := c.right.value(s)
+	if err != nil {
+		return false, fmt.Errorf("error parsing value as 3rd parameter to 'if' at line:%d error:%s", c.line, err)
+	}
+	result, err := s.eval(toString(param1), c.validator, toString(param2))
+	if err != nil {
+		return false, fmt.Errorf("failed to validate 'if' at line:%d error:%s", c.line, err)
+	}
+	return result, nil
+}
+
+// logField is a key=value pair of a log statement
+type logField struct {
+	key   string
+	value operand
+}
+
+// logStatement sends a message to the log sink of the engine
+type logStatement struct {
+	level   slog.Level
+	message operand
+	fields  []logField
+	line    int
+}
+
+func (st *logStatement) pos() int {
+	return st.line
+}
+
+func (st *logStatement) exec(s *state) error {
+	message, err := s.text(st.message)
+	if err != nil {
+		return fmt.Errorf("error parsing value as parameter to 'log' at line:%d error:%s", st.line, err)
+	}
+	fields := make([]LogField, 0, len(st.fields))
+	for _, f := range st.fields {
+		value, err := s.text(f.value)
+		if err != nil {
+			return fmt.Errorf("error parsing value of field '%s' to 'log' at line:%d error:%s", f.key, st.line, err)
+		}
+		fields = append(fields, LogField{Key: f.key, Value: value})
+	}
+	s.rule.engine.sink.Log(LogEntry{
+		Level:   st.level,
+		Message: message,
+		Script:  s.rule.name,
+		Line:    st.line,
+		Fields:  fields,
+	})
+	return nil
+}
+
+// declareStatement declares a variable, var is declared for the whole script or function, let and const for the current block
+type declareStatement struct {
+	kind     string
+	name     string
+	value    expression
+	exported bool
+	line     int
+}
+
+func (st *declareStatement) pos() int {
+	return st.line
+}
+
+func (st *declareStatement) exec(s *state) error {
+	if _, ok := s.resources[st.name]; ok {
+		return fmt.Errorf("variable resource with the name '%s' already exists at line:%d", st.name, st.line)
+	}
+	sc := s.scope
+	switch {
+	case st.exported:
+		sc = s.root
+	case st.kind == "var":
+		sc = s.frame
+	}
+	// a declaration that runs again, like in the body of a loop, replaces its own variable
+	if v, ok := sc.vars[st.name]; ok && v.declared != st {
+		return fmt.Errorf("variable with the name '%s' already exists at line:%d", st.name, st.line)
+	}
+	value, err := st.value.value(s)
+	if err != nil {
+		return err
+	}
+	sc.vars[st.name] = &variable{
+		value:    value,
+		constant: st.kind == "const",
+		exported: st.exported,
+		declared: st,
+	}
+	return nil
+}
+
+// unsetStatement removes a variable, or clears a value of a resource
+type unsetStatement struct {
+	path string
+	line int
+}
+
+func (st *unsetStatement) pos() int {
+	return st.line
+}
+
+func (st *unsetStatement) exec(s *state) error {
+	path, err := s.parseVariableStrings(st.path)
+	if err != nil {
+		return fmt.Errorf("error parsing '%s' at line:%d error:%s", st.path, st.line, err)
+	}
+	// split and check if it IS a variable or resource
+	resource := strings.Split(path, ".")
+	if v, sc := s.scope.lookup(resource[0]); v != nil {
+		if len(resource) > 1 || v.constant {
+			return fmt.Errorf("error deleting '%s' at line:%d error:variable cannot be modified", path, st.line)
+		}
+		delete(sc.vars, resource[0])
+		return nil
+	}
+	if r, ok := s.resources[resource[0]]; ok {
+		if len(resource) == 1 {
+			return fmt.Errorf("error deleting '%s' at line:%d error:resource is read-only", path, st.line)
+		}
+		err := deleteInterface(r, resource[1:])
+		if err != nil {
+			return fmt.Errorf("error deleting '%s' at line:%d error:%s", path, st.line, err)
+		}
+	}
+	return nil
+}
+
+// assignStatement sets a variable, or a value of a resource, += and -= change the current value
+type assignStatement struct {
+	path     string
+	operator string
+	value    expression
+	line     int
+}
+
+func (st *assignStatement) pos() int {
+	return st.line
+}
+
+func (st *assignStatement) exec(s *state) error {
+	path, err := s.parseVariableStrings(st.path)
+	if err != nil {
+		return fmt.Errorf("error parsing '%s' at line:%d error:%s", st.path, st.line, err)
+	}
+	value, err := st.value.value(s)
+	if err != nil {
+		return err
+	}
+	if st.operator != "=" {
+		current, err := s.get(path)
+		if err != nil {
+			return fmt.Errorf("error reading '%s' for '%s' at line:%d error:%s", path, st.operator, st.line, err)
+		}
+		value, err = calculate(st.operator[:1], current, value)
+		if err != nil {
+			return fmt.Errorf("failed to calculate '%s' at line:%d error:%s", st.operator, st.line, err)
+		}
+	}
+	err = s.set(path, value)
+	if err != nil {
+		return fmt.Errorf("error modifing '%s' to '%s' at line:%d error:%s", path, toString(value), st.line, err)
+	}
+	return nil
+}
+
+// replaceRegexStatement does a regex replace on a variable, or a value of a resource
+type replaceRegexStatement struct {
+	path    string
+	match   operand
+	replace operand
+	line    int
+}
+
+func (st *replaceRegexStatement) pos() int {
+	return st.line
+}
+
+func (st *replaceRegexStatement) exec(s *state) error {
+	path, err := s.parseVariableStrings(st.path)
+	if err != nil {
+		return fmt.Errorf("error parsing '%s' at line:%d error:%s", st.path, st.line, err)
+	}
+	resource := strings.Split(path, ".")
+	r, ok := s.lookup(resource[0])
+	if !ok {
+		return fmt.Errorf("unknown resource '%s' at line:%d", path, st.line)
+	}
+	match, err := st.match.value(s)
+	if err != nil {
+		return fmt.Errorf("error parsing regex as 2nd parameter to 'replace_regex' at line:%d error:%s", st.line, err)
+	}
+	replace, err := st.replace.value(s)
+	if err != nil {
+		return fmt.Errorf("error parsing replacement as 3rd parameter to 'replace_regex' at line:%d error:%s", st.line, err)
+	}
+	re, err := regexp.Compile(toString(match))
+	if err != nil {
+		return fmt.Errorf("replace_regex replace failed '%s' at line:%d error:%s", toString(match), st.line, err)
+	}
+
+	// every value of a field with multiple values is replaced, like the values of a header
+	current, err := resolveInterface(s.rule.engine, r, resource[1:])
+	if err != nil {
+		return fmt.Errorf("replace_regex get failed '%s' at line:%d error:%s", path, st.line, err)
+	}
+	if v := reflect.ValueOf(current); v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String && len(resource) > 1 {
+		if _, ok := s.resources[resource[0]]; !ok {
+			return fmt.Errorf("replace_regex get failed '%s' at line:%d error:values of type '%T' can not be replaced", path, st.line, current)
+		}
+		for i := 0; i < v.Len(); i++ {
+			new := re.ReplaceAllString(v.Index(i).String(), toString(replace))
+			if err := modifyInterfaceValues(s.rule.engine, r, resource[1:], new, i > 0); err != nil {
+				return fmt.Errorf("replace_regex modify failed '%s' to '%s' at line:%d error:%s", path, new, st.line, err)
+			}
+		}
+		return nil
+	}
+
+	original, err := getInterface(s.rule.engine, r, resource[1:])
+	if err != nil {
+		return fmt.Errorf("replace_regex get failed '%s' at line:%d error:%s", path, st.line, err)
+	}
+	text, ok := original.(string)
+	if !ok {
+		return fmt.Errorf("replace_regex get failed '%s' at line:%d error:values of type '%T' can not be replaced", path, st.line, original)
+	}
+	new := re.ReplaceAllString(text, toString(replace))
+	if err := s.set(path, new); err != nil {
+		return fmt.Errorf("replace_regex modify failed '%s' to '%s' at line:%d error:%s", path, new, st.line, err)
+	}
+	return nil
+}
+
+// get returns the current value of a variable, or a value of a resource
+func (s *state) get(path string) (interface{}, error) {
+	resource := strings.Split(path, ".")
+	r, ok := s.lookup(resource[0])
+	if !ok {
+		return nil, fmt.Errorf("unknown resource '%s'", resource[0])
+	}
+	return getInterface(s.rule.engine, r, resource[1:])
+}
+
+// set changes a variable, or a value of a resource
+// variables keep the value as is, resources are changed with the value as string
+func (s *state) set(path string, value interface{}) error {
+	// split and check if it IS a variable or resource
+	resource := strings.Split(path, ".")
+	if v, _ := s.scope.lookup(resource[0]); v != nil {
+		if len(resource) > 1 {
+			return fmt.Errorf("variable '%s' has no fields", resource[0])
+		}
+		if v.constant {
+			return fmt.Errorf("variable '%s' is a constant", resource[0])
+		}
+		v.value = value
+		return nil
+	}
+	r, ok := s.resources[resource[0]]
+	if !ok {
+		// maybe it was not a resource at all???
+		return fmt.Errorf("unknown resource '%s'", resource[0])
+	}
+	if len(resource) == 1 {
+		return fmt.Errorf("resource '%s' is read-only", resource[0])
+	}
+	return modifyInterface(r, resource[1:], toString(value))
+}
+
+// stopStatement ends the script successfully
+type stopStatement struct {
+	line int
+}
+
+func (st *stopStatement) pos() int {
+	return st.line
+}
+
+func (st *stopStatement) exec(s *state) error {
+	return errStop
+}
+
+// returnStatement ends the script and hands a value back to the caller
+type returnStatement struct {
+	value expression
+	line  int
+}
+
+func (st *returnStatement) pos() int {
+	return st.line
+}
+
+func (st *returnStatement) exec(s *state) error {
+	if st.value == nil {
+		return &returnValue{}
+	}
+	value, err := st.value.value(s)
+	if err != nil {
+		return fmt.Errorf("error parsing value as parameter to 'return' at line:%d error:%s", st.line, err)
+	}
+	return &returnValue{value: value}
+}
+
+// failStatement ends the script with a FailError
+type failStatement struct {
+	reason operand
+	line   int
+}
+
+func (st *failStatement) pos() int {
+	return st.line
+}
+
+func (st *failStatement) exec(s *state) error {
+	reason, err := s.text(st.reason)
+	if err != nil {
+		return fmt.Errorf("error parsing value as parameter to 'fail' at line:%d error:%s", st.line, err)
+	}
+	return &FailError{Script: s.rule.name, Reason: reason, Line: st.line}
+}
@@ -0,0 +1,278 @@
+package gorule
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// expression is a value computed when the script runs, like: $(counter) + 1
+type expression interface {
+	value(s *state) (interface{}, error)
+}
+
+// value returns the value of a word, string or function call with the $(variables) replaced
+func (o operand) value(s *state) (interface{}, error) {
+	if o.call != nil {
+		return o.call.invoke(s)
+	}
+	return s.parseVariableStrings(o.text)
+}
+
+// binaryExpression is a calculation or concatenation of 2 values, like: $(a) + $(b)
+type binaryExpression struct {
+	operator string
+	left     expression
+	right    expression
+	text     bool // + joins text, as a side is a quoted string or a word that is not a number
+	line     int
+}
+
+func (e *binaryExpression) value(s *state) (interface{}, error) {
+	left, err := e.left.value(s)
+	if err != nil {
+		return nil, err
+	}
+	right, err := e.right.value(s)
+	if err != nil {
+		return nil, err
+	}
+	result, err := e.calculate(left, right)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate '%s' at line:%d error:%s", e.operator, e.line, err)
+	}
+	return result, nil
+}
+
+// calculate applies the operator to the values, a quoted string is text even if it looks like a number, so "10" + 5 is 105
+func (e *binaryExpression) calculate(left, right interface{}) (interface{}, error) {
+	if e.text {
+		return toString(left) + toString(right), nil
+	}
+	return calculate(e.operator, left, right)
+}
+
+// quoted returns true if the expression is a quoted string, or text joined with +
+func quoted(e expression) bool {
+	switch e := e.(type) {
+	case operand:
+		return e.quoted && e.call == nil
+	case *constant:
+		return e.quoted
+	case *binaryExpression:
+		return e.text
+	}
+	return false
+}
+
+// isWord returns true if the expression is a word that is not a number, like: abc
+func isWord(e expression) bool {
+	o, ok := e.(operand)
+	if !ok || o.quoted || o.call != nil || strings.Contains(o.text, "$") {
+		return false
+	}
+	_, number := toNumber(o.text)
+	return !number
+}
+
+// ternaryExpression picks a value based on a condition, like: $(a) == 1 ? "one" : "other"
+type ternaryExpression struct {
+	condition expression
+	yes       expression
+	no        expression
+	line      int
+}
+
+func (e *ternaryExpression) value(s *state) (interface{}, error) {
+	c, err := e.condition.value(s)
+	if err != nil {
+		return nil, err
+	}
+	result, err := strconv.ParseBool(toString(c))
+	if err != nil {
+		return nil, fmt.Errorf("condition of '?' at line:%d is not true or false but '%s'", e.line, toString(c))
+	}
+	if result {
+		return e.yes.value(s)
+	}
+	return e.no.value(s)
+}
+
+// value returns the result of the condition as bool
+func (c *condition) value(s *state) (interface{}, error) {
+	return c.eval(s)
+}
+
+// toNumber converts a value to an int or float64, strings are numbers if they can be parsed as one
+func toNumber(v interface{}) (interface{}, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int64:
+		return int(n), true
+	case float64:
+		return n, true
+	case string:
+		if i, err := strconv.Atoi(n); err == nil {
+			return i, true
+		}
+		if f, err := strconv.ParseFloat(n, 64); err == nil {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// calculate applies the operator to 2 values, + concatenates the values if they are not both numbers
+func calculate(operator string, left, right interface{}) (interface{}, error) {
+	l, lok := toNumber(left)
+	r, rok := toNumber(right)
+	if !lok || !rok {
+		if operator == "+" {
+			return toString(left) + toString(right), nil
+		}
+		return nil, fmt.Errorf("cannot use '%s' on '%s' and '%s', they are not both numbers", operator, toString(left), toString(right))
+	}
+
+	li, lint := l.(int)
+	ri, rint := r.(int)
+	if lint && rint {
+		switch operator {
+		case "+":
+			return li + ri, nil
+		case "-":
+			return li - ri, nil
+		case "*":
+			return li * ri, nil
+		case "/":
+			if ri == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			// only stay an int if the division has no remainder
+			if li%ri == 0 {
+				return li / ri, nil
+			}
+			return float64(li) / float64(ri), nil
+		case "%":
+			if ri == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return li % ri, nil
+		}
+	}
+
+	lf, rf := toFloat(l), toFloat(r)
+	switch operator {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return lf / rf, nil
+	case "%":
+		if rf == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return math.Mod(lf, rf), nil
+	}
+	return nil, fmt.Errorf("unknown operator: %s", operator)
+}
+
+// toFloat converts an int or float64 to float64
+func toFloat(n interface{}) float64 {
+	if i, ok := n.(int); ok {
+		return float64(i)
+	}
+	return n.(float64)
+}
+
+// operators are the operators of expressions, by order of precedence
+var operators = []map[string]bool{
+	{"+": true, "-": true},
+	{"*": true, "/": true, "%": true},
+}
+
+// expression parses a value with optional calculations, validator and ternary, like: $(a) == 1 ? $(b) + 1 : 0
+func (p *parser) expression(description, word string) (expression, error) {
+	line := p.peek().line
+	e, err := p.binary(0, description, word)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == tokenWord && validators[t.text] {
+		p.next()
+		right, err := p.binary(0, "value after validator", t.text)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.matcher(t.text, right, line); err != nil {
+			return nil, err
+		}
+		e = &condition{left: e, validator: t.text, right: right, line: line}
+	}
+	if t := p.peek(); t.kind == tokenWord && t.text == "?" {
+		p.next()
+		yes, err := p.expression("value after '?'", word)
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tokenWord || c.text != ":" {
+			return nil, fmt.Errorf("expected ':' after '?' at line:%d", c.line)
+		}
+		no, err := p.expression("value after ':'", word)
+		if err != nil {
+			return nil, err
+		}
+		e = &ternaryExpression{condition: e, yes: yes, no: no, line: line}
+	}
+	return e, nil
+}
+
+// binary parses calculations with the operators of the given precedence level or higher
+func (p *parser) binary(level int, description, word string) (expression, error) {
+	if level == len(operators) {
+		return p.primary(description, word)
+	}
+	left, err := p.binary(level+1, description, word)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokenWord || !operators[level][t.text] {
+			return left, nil
+		}
+		p.next()
+		right, err := p.binary(level+1, "value after operator", t.text)
+		if err != nil {
+			return nil, err
+		}
+		if t.text != "+" && (quoted(left) || quoted(right)) {
+			return nil, fmt.Errorf("'%s' at line:%d error:quoted strings can only be joined with '+'", t.text, t.line)
+		}
+		text := t.text == "+" && (quoted(left) || quoted(right) || isWord(left) || isWord(right))
+		left = &binaryExpression{operator: t.text, left: left, right: right, text: text, line: t.line}
+	}
+}
+
+// primary parses a single value, or an expression between ( )
+func (p *parser) primary(description, word string) (expression, error) {
+	if t := p.peek(); t.kind == tokenLParen {
+		p.next()
+		e, err := p.expression(description, word)
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokenRParen {
+			return nil, fmt.Errorf("expected ')' to '%s' at line:%d", word, t.line)
+		}
+		return e, nil
+	}
+	return p.operand(description, word)
+}
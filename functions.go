@@ -0,0 +1,235 @@
+package gorule
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// defaultMaxCallDepth is the maximum depth of function calls, to stop endless recursion
+const defaultMaxCallDepth = 100
+
+// WithMaxCallDepth sets the maximum depth of function calls in a script
+func WithMaxCallDepth(n int) Option {
+	return func(e *Engine) {
+		e.maxCallDepth = n
+	}
+}
+
+// functionName is the format of the name of a function
+var functionName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// builtin is a function provided by the engine, args is the number of arguments it expects
+type builtin struct {
+	args int
+	call func(s *state, c *call) (interface{}, error)
+}
+
+// builtins are the functions provided by the engine, they can not be defined by the script
+var builtins = map[string]builtin{
+	// count returns the number of values of a resource field, like: count(request.header.x-forwarded-for)
+	"count": {args: 1, call: func(s *state, c *call) (interface{}, error) {
+		o, ok := c.args[0].(operand)
+		if !ok || o.call != nil {
+			return nil, fmt.Errorf("argument to 'count' at line:%d must be a resource", c.line)
+		}
+		path, err := s.parseVariableStrings(pathOf(o.text))
+		if err != nil {
+			return nil, err
+		}
+		v, err := s.resolve(path)
+		if err != nil {
+			return nil, fmt.Errorf("error getting '%s' for 'count' at line:%d error:%s", path, c.line, err)
+		}
+		return len(values(v)), nil
+	}},
+	// lookup returns the value of a key in a lookup table of the engine, or the default
+	"lookup": {args: 3, call: lookupTable},
+}
+
+// function is a function defined in the script, like: func name(a, b) { }
+type function struct {
+	name   string
+	params []string
+	body   block
+	file   string
+	line   int
+}
+
+// call is a call to a function, like: name($(a), "b")
+type call struct {
+	name string
+	args []expression
+	file string
+	line int
+}
+
+// function parses a function definition
+func (p *parser) function(line int) error {
+	if p.depth > 0 {
+		return fmt.Errorf("'func' is only allowed outside of blocks at line:%d", line)
+	}
+	name, err := p.name("function name", "func")
+	if err != nil {
+		return err
+	}
+	if !functionName.MatchString(name) {
+		return fmt.Errorf("invalid function name '%s' at line:%d", name, line)
+	}
+	if _, ok := builtins[name]; ok {
+		return fmt.Errorf("function '%s' at line:%d is already defined by the engine", name, line)
+	}
+	// a file that is included more than once defines its functions once
+	existing, ok := p.funcs[name]
+	again := ok && p.file != "" && existing.file == p.file && existing.line == line
+	if ok && !again {
+		return fmt.Errorf("function '%s' at line:%d is already defined at line:%d", name, line, existing.line)
+	}
+	f := &function{name: name, file: p.file, line: line}
+	if t := p.next(); t.kind != tokenLParen {
+		return fmt.Errorf("expected '(' after function name '%s' at line:%d", name, t.line)
+	}
+	for p.peek().kind != tokenRParen {
+		param, err := p.name("parameter name", name)
+		if err != nil {
+			return err
+		}
+		for _, existing := range f.params {
+			if existing == param {
+				return fmt.Errorf("duplicate parameter '%s' of function '%s' at line:%d", param, name, line)
+			}
+		}
+		f.params = append(f.params, param)
+		switch p.peek().kind {
+		case tokenComma:
+			p.next()
+		case tokenRParen:
+		default:
+			return fmt.Errorf("expected ',' or ')' in parameters of '%s' at line:%d", name, p.peek().line)
+		}
+	}
+	p.next()
+
+	// break and continue can not reach the loops of the caller
+	loops := p.loops
+	p.loops = 0
+	f.body, err = p.block("func")
+	p.loops = loops
+	if err != nil {
+		return err
+	}
+	if !again {
+		p.funcs[name] = f
+	}
+	return nil
+}
+
+// call parses the arguments of a function call, the name has already been read
+func (p *parser) call(name string, line int) (*call, error) {
+	c := &call{name: name, file: p.file, line: line}
+	p.next() // (
+	for p.peek().kind != tokenRParen {
+		arg, err := p.expression("argument", name)
+		if err != nil {
+			return nil, err
+		}
+		c.args = append(c.args, arg)
+		switch p.peek().kind {
+		case tokenComma:
+			p.next()
+		case tokenRParen:
+		default:
+			return nil, fmt.Errorf("expected ',' or ')' in call to '%s' at line:%d", name, p.peek().line)
+		}
+	}
+	p.next()
+	p.calls = append(p.calls, c)
+	return c, nil
+}
+
+// validateCalls checks if all called functions are defined with the same number of arguments
+func (p *parser) validateCalls() error {
+	for _, c := range p.calls {
+		if b, ok := builtins[c.name]; ok {
+			if b.args != len(c.args) {
+				return inFile(c.file, fmt.Errorf("function '%s' expects %d arguments, got %d at line:%d", c.name, b.args, len(c.args), c.line))
+			}
+			continue
+		}
+		f, ok := p.funcs[c.name]
+		if !ok {
+			return inFile(c.file, fmt.Errorf("undefined function '%s' at line:%d", c.name, c.line))
+		}
+		if len(f.params) != len(c.args) {
+			return inFile(c.file, fmt.Errorf("function '%s' expects %d arguments, got %d at line:%d", c.name, len(f.params), len(c.args), c.line))
+		}
+	}
+	return nil
+}
+
+// invoke runs the function with its own scope, and returns the value handed back by return
+func (c *call) invoke(s *state) (interface{}, error) {
+	if b, ok := builtins[c.name]; ok {
+		return b.call(s, c)
+	}
+	f, ok := s.rule.program.funcs[c.name]
+	if !ok {
+		return nil, fmt.Errorf("undefined function '%s' at line:%d", c.name, c.line)
+	}
+	args := make([]interface{}, len(c.args))
+	for i, a := range c.args {
+		v, err := a.value(s)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing argument %d to '%s' at line:%d error:%s", i+1, c.name, c.line, err)
+		}
+		args[i] = v
+	}
+
+	if s.depth >= s.rule.engine.maxCallDepth {
+		s.exceeded = true
+		return nil, c.exceeded(s)
+	}
+	s.depth++
+	scope, frame, onError := s.scope, s.frame, s.onError
+	defer func() {
+		s.depth--
+		s.scope, s.frame, s.onError = scope, frame, onError
+	}()
+
+	// functions only see their own variables, the variables of the script and the resources
+	s.frame = newScope(s.root)
+	s.scope = s.frame
+	for i, param := range f.params {
+		s.frame.vars[param] = &variable{value: args[i]}
+	}
+
+	err := f.body.run(s)
+	if s.exceeded {
+		// every call replaces the error of the calls it made, so only the first call of the recursion is reported
+		return nil, c.exceeded(s)
+	}
+	var ret *returnValue
+	if errors.As(err, &ret) {
+		return ret.value, nil
+	}
+	return nil, inFile(f.file, err)
+}
+
+// exceeded returns the error of a call that exceeded the maximum call depth
+func (c *call) exceeded(s *state) error {
+	return fmt.Errorf("call to '%s' at line:%d exceeded the maximum call depth of %d", c.name, c.line, s.rule.engine.maxCallDepth)
+}
+
+// callStatement calls a function and ignores the value it returns
+type callStatement struct {
+	call *call
+}
+
+func (st *callStatement) pos() int {
+	return st.call.line
+}
+
+func (st *callStatement) exec(s *state) error {
+	_, err := st.call.invoke(s)
+	return err
+}
@@ -0,0 +1,375 @@
+package gorule
+
+import (
+	"fmt"
+	gotoken "go/token"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/rdoorn/gorule/internal/genapi"
+)
+
+func init() {
+	genapi.Generate = generate
+	genapi.Virtual = func(typeName, field string) bool {
+		_, ok := virtualFields[typeName][strings.ToLower(field)]
+		return ok
+	}
+}
+
+// generate compiles a script to the source of a Go function, that accesses the fields of the resources directly instead of with reflection
+// it is used by internal/gen, which resolves the Go types of the bindings, formats the code and type checks it
+func generate(script []byte, opts genapi.Options) ([]byte, error) {
+	prog, err := compile(script, nil)
+	if err != nil {
+		return nil, err
+	}
+	prog.optimize()
+	g := &generator{
+		prog:        prog,
+		opts:        opts,
+		prefix:      lowerFirst(opts.Func),
+		imports:     map[string]string{"github.com/rdoorn/gorule": "gorule"},
+		resources:   map[string]*binding{},
+		used:        map[string]bool{},
+		getters:     map[string]string{},
+		getterKinds: map[string]string{},
+		multiple:    map[string]bool{},
+		setters:     map[string]string{},
+		patterns:    map[string]string{},
+		scope:       &genScope{vars: map[string]*genVar{}},
+	}
+	for _, name := range []string{"result", "exports", "err", "errors", "fmt", "strconv", "strings", "regexp", "gorule", "genrt", "nil", "true", "false", "string", "int", "bool"} {
+		g.used[name] = true
+	}
+	if err := g.bind(); err != nil {
+		return nil, err
+	}
+	return g.generate()
+}
+
+// binding is a resource passed to the generated function
+type binding struct {
+	name  string
+	ident string
+	typ   genapi.Type
+}
+
+// genVar is a variable of the script as Go variable
+type genVar struct {
+	ident    string
+	constant bool
+	read     bool
+}
+
+// genScope holds the variables declared in a block of the script
+type genScope struct {
+	parent *genScope
+	vars   map[string]*genVar
+}
+
+func (sc *genScope) lookup(name string) *genVar {
+	for c := sc; c != nil; c = c.parent {
+		if v, ok := c.vars[name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// genValue is a Go expression of a value of the script, kind is the Go type: string, bool or interface{}
+type genValue struct {
+	code string
+	kind string
+}
+
+// generator writes the Go code of a program
+type generator struct {
+	prog      *program
+	opts      genapi.Options
+	prefix    string            // prefix of the helper functions and variables
+	imports   map[string]string // packages used by the generated code, by path
+	resources map[string]*binding
+	bindings  []*binding
+	used      map[string]bool // Go identifiers in use
+	getters   map[string]string
+	// getterKinds are the Go types of the values returned by the getters
+	getterKinds map[string]string
+	// multiple are the getters that return ErrMultipleValues, which is not replaced by a fallback
+	multiple map[string]bool
+	setters  map[string]string
+	patterns map[string]string // compiled matchers and regular expressions, by pattern
+	helpers  []string
+	scope    *genScope
+	hoisted  []*genVar // variables declared at the top of the script, declared at the start of the function
+	vars     []*genVar // all variables, to remove the markers of unused variables
+	exports  []string  // exported variables in the order they are declared
+	out      *strings.Builder
+	wraps    []string // prefixes of the errors of the expression being written, as Go expressions
+	declared bool     // the statement being written declared a Go variable
+	done     bool     // the function jumps to the end
+}
+
+// generateError is the error for a part of the script that can not be generated
+func generateError(word string, line int, format string, args ...interface{}) error {
+	return fmt.Errorf("'%s' at line:%d error:%s", word, line, fmt.Sprintf(format, args...))
+}
+
+// bind resolves the types of the bindings and checks them against the input declarations
+func (g *generator) bind() error {
+	for _, b := range g.opts.Bindings {
+		parts := strings.SplitN(b, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid binding '%s', expected name=type", b)
+		}
+		typ, err := g.opts.Resolve(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid binding '%s' error:%s", b, err)
+		}
+		if _, ok := g.resources[parts[0]]; ok {
+			return fmt.Errorf("binding '%s' is used more than once", parts[0])
+		}
+		r := &binding{name: parts[0], ident: g.ident(parts[0], false), typ: typ}
+		g.resources[r.name] = r
+		g.bindings = append(g.bindings, r)
+	}
+	for _, d := range g.prog.inputs {
+		r, ok := g.resources[d.name]
+		if !ok {
+			return fmt.Errorf("missing binding of input '%s' of type '%s' declared at line:%d", d.name, d.typeName, d.line)
+		}
+		if d.typeName != "any" && r.typ.Name() != d.typeName {
+			return fmt.Errorf("binding '%s' is of type '%s', expected '%s' declared at line:%d", d.name, r.typ.Name(), d.typeName, d.line)
+		}
+	}
+	for _, d := range g.prog.params {
+		if _, ok := g.resources[d.name]; ok {
+			return fmt.Errorf("param with the name '%s' already exists as binding declared at line:%d", d.name, d.line)
+		}
+	}
+	return nil
+}
+
+// getter returns the helper function that reads a field of a resource, like: $(request.url.path)
+// it returns the value like getInterface, the kind of the value is stored in getterKinds
+func (g *generator) getter(r *binding, tree []string, path string, line int) (string, error) {
+	key := r.name + "." + strings.Join(tree, ".")
+	if name, ok := g.getters[key]; ok {
+		return name, nil
+	}
+	get, err := r.typ.Getter(tree, g.imp)
+	if err != nil {
+		return "", generateError(path, line, "%s", err)
+	}
+	name := fmt.Sprintf("%sGet%d", g.prefix, len(g.getters)+1)
+	g.getters[key] = name
+	g.getterKinds[name] = get.Kind
+	g.multiple[name] = get.Multiple
+	g.helpers = append(g.helpers, fmt.Sprintf("// %s reads $(%s)\nfunc %s(r %s) (%s, error) {\n%sreturn %s, nil\n}\n", name, path, name, r.typ.Code(g.imp), get.Kind, get.Body, get.Value))
+	return name, nil
+}
+
+// setter returns the helper function that changes a field of a resource, like: request.url.path = "/"
+func (g *generator) setter(r *binding, tree []string, path string, line int) (string, error) {
+	key := r.name + "." + strings.Join(tree, ".")
+	if name, ok := g.setters[key]; ok {
+		return name, nil
+	}
+	body, err := r.typ.Setter(tree, g.imp)
+	if err != nil {
+		return "", generateError(path, line, "%s", err)
+	}
+	name := fmt.Sprintf("%sSet%d", g.prefix, len(g.setters)+1)
+	g.setters[key] = name
+	g.helpers = append(g.helpers, fmt.Sprintf("// %s changes %s\nfunc %s(r %s, value string) error {\n%s}\n", name, path, name, r.typ.Code(g.imp), body))
+	return name, nil
+}
+
+// lowerFirst returns the name with the first letter in lower case
+func lowerFirst(name string) string {
+	if name == "" {
+		return name
+	}
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+// pkg returns the name of a package used by the generated code
+func (g *generator) pkg(path string) string {
+	return g.imp(path, path[strings.LastIndex(path, "/")+1:])
+}
+
+// runtime returns a function of the genrt package, which the generated code uses to behave like the scripts
+func (g *generator) runtime(name string) string {
+	return g.pkg("github.com/rdoorn/gorule/genrt") + "." + name
+}
+
+// imp adds a package with its name to the imports of the generated code
+func (g *generator) imp(path, name string) string {
+	g.imports[path] = name
+	return name
+}
+
+// ident returns an unused Go identifier for a name of the script, variables start with v
+func (g *generator) ident(name string, variable bool) string {
+	b := strings.Builder{}
+	upper := variable
+	for _, r := range name {
+		switch {
+		case r == '_' || unicode.IsLetter(r) || (unicode.IsDigit(r) && b.Len() > 0):
+			if upper {
+				r = unicode.ToUpper(r)
+				upper = false
+			}
+			b.WriteRune(r)
+		default:
+			upper = b.Len() > 0 || variable
+		}
+	}
+	base := b.String()
+	if variable {
+		base = "v" + base
+	}
+	if base == "" || gotoken.IsKeyword(base) {
+		base = "r" + base
+	}
+	ident := base
+	for i := 2; g.used[ident]; i++ {
+		ident = fmt.Sprintf("%s%d", base, i)
+	}
+	g.used[ident] = true
+	return ident
+}
+
+// tmp returns a new temporary Go variable
+func (g *generator) tmp() string {
+	g.declared = true
+	for i := len(g.used); ; i++ {
+		name := fmt.Sprintf("t%d", i)
+		if !g.used[name] {
+			g.used[name] = true
+			return name
+		}
+	}
+}
+
+// line writes a line of Go code
+func (g *generator) line(format string, args ...interface{}) {
+	fmt.Fprintf(g.out, format, args...)
+	g.out.WriteString("\n")
+}
+
+// unused is replaced by _ = ident if the variable is never read, as Go does not allow unused variables
+func unused(v *genVar) string {
+	return "\x00" + v.ident + "\x00"
+}
+
+// returnError writes the return of an error, with the prefixes of the expression being written
+func (g *generator) returnError(err string) {
+	if len(g.wraps) == 0 {
+		g.line("return nil, %s", err)
+		return
+	}
+	g.line("return nil, %s(%s + %s.Error())", g.pkg("errors")+".New", strings.Join(g.wraps, " + "), err)
+}
+
+// returnMessage writes the return of an error with a message, message is a Go expression
+func (g *generator) returnMessage(message string) {
+	g.line("return nil, %s(%s)", g.pkg("errors")+".New", strings.Join(append(append([]string{}, g.wraps...), message), " + "))
+}
+
+// wrapped writes the code of f, errors returned by it get the prefix
+func (g *generator) wrapped(prefix string, f func() error) error {
+	g.wraps = append(g.wraps, strconv.Quote(prefix))
+	defer func() { g.wraps = g.wraps[:len(g.wraps)-1] }()
+	return f()
+}
+
+// generate writes the source of the generated file
+func (g *generator) generate() ([]byte, error) {
+	body := &strings.Builder{}
+	g.out = body
+	args := []string{}
+	for _, b := range g.bindings {
+		args = append(args, b.ident+" "+b.typ.Code(g.imp))
+	}
+	params := []string{}
+	for _, d := range g.prog.params {
+		kind, ok := map[string]string{"string": "string", "int": "int", "float": "float64", "bool": "bool"}[d.typeName]
+		if !ok {
+			return nil, generateError(d.name, d.line, "params of type '%s' are not supported by gen", d.typeName)
+		}
+		arg := g.ident(d.name, false)
+		args = append(args, arg+" "+kind)
+		v := &genVar{ident: g.ident(d.name, true), constant: true}
+		g.scope.vars[d.name] = v
+		g.vars = append(g.vars, v)
+		params = append(params, fmt.Sprintf("var %s interface{} = %s\n%s", v.ident, arg, unused(v)))
+	}
+	if _, err := g.block(g.prog.body, true); err != nil {
+		return nil, err
+	}
+
+	src := &strings.Builder{}
+	fmt.Fprintf(src, "// Code generated by gorule gen. DO NOT EDIT.\n\npackage %s\n\n", g.opts.Package)
+	paths := []string{}
+	for path := range g.imports {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if std(paths[i]) != std(paths[j]) {
+			return std(paths[i])
+		}
+		return paths[i] < paths[j]
+	})
+	src.WriteString("import (\n")
+	group := true
+	for _, path := range paths {
+		if std(path) != group {
+			src.WriteString("\n")
+			group = false
+		}
+		fmt.Fprintf(src, "%q\n", path)
+	}
+	src.WriteString(")\n\n")
+	fmt.Fprintf(src, "// %s runs the rule '%s', it accesses the fields of the resources directly instead of with reflection\n", g.opts.Func, g.opts.Name)
+	fmt.Fprintf(src, "func %s(%s) (*gorule.Result, error) {\n", g.opts.Func, strings.Join(args, ", "))
+	src.WriteString("result := &gorule.Result{}\n")
+	if len(g.exports) > 0 {
+		src.WriteString("exports := 0\n")
+	}
+	for _, p := range params {
+		src.WriteString(p + "\n")
+	}
+	for _, v := range g.hoisted {
+		fmt.Fprintf(src, "var %s interface{}\n%s\n", v.ident, unused(v))
+	}
+	src.WriteString(body.String())
+	if g.done {
+		src.WriteString("done:\n")
+	}
+	src.WriteString("result.Outputs = map[string]interface{}{}\n")
+	for i, name := range g.exports {
+		fmt.Fprintf(src, "if exports > %d {\nresult.Outputs[%q] = %s\n}\n", i, name, g.scope.vars[name].ident)
+	}
+	src.WriteString("return result, nil\n}\n")
+	for _, h := range g.helpers {
+		src.WriteString("\n" + h)
+	}
+
+	code := src.String()
+	for _, v := range g.vars {
+		replacement := ""
+		if !v.read {
+			replacement = "_ = " + v.ident + "\n"
+		}
+		code = strings.Replace(code, unused(v)+"\n", replacement, -1)
+	}
+	return []byte(code), nil
+}
+
+// std returns if an import path is in the standard library, the imports of it are grouped first like goimports does
+func std(path string) bool {
+	return !strings.Contains(strings.Split(path, "/")[0], ".")
+}
@@ -0,0 +1,781 @@
+package gorule
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// block writes the statements of a block, top is true for the statements of the script itself
+// it returns true if the block always ends the function, the statements after that never run and are not written
+func (g *generator) block(b block, top bool) (bool, error) {
+	if !top {
+		g.scope = &genScope{parent: g.scope, vars: map[string]*genVar{}}
+		defer func() { g.scope = g.scope.parent }()
+	}
+	for _, st := range b {
+		out := g.out
+		if top {
+			// the statements at the top are written in their own { block }, so goto done does not jump over declarations
+			g.out, g.declared = &strings.Builder{}, false
+		}
+		ends, err := g.statement(st, top)
+		if top {
+			code := g.out.String()
+			g.out = out
+			if g.declared {
+				code = "{\n" + code + "}\n"
+			}
+			g.out.WriteString(code)
+		}
+		if err != nil {
+			return false, err
+		}
+		if ends {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// statement writes a statement, it returns true if the statement always ends the function
+func (g *generator) statement(st statement, top bool) (bool, error) {
+	switch st := st.(type) {
+	case *declareStatement:
+		return false, g.declareStatement(st, top)
+	case *assignStatement:
+		return false, g.assignStatement(st)
+	case *replaceRegexStatement:
+		return false, g.replaceRegexStatement(st)
+	case *ifStatement:
+		return g.ifBranch(st, 0)
+	case *switchStatement:
+		return g.switchStatement(st)
+	case *stopStatement:
+		g.end()
+		return true, nil
+	case *returnStatement:
+		if st.value != nil {
+			err := g.wrapped(fmt.Sprintf("error parsing value as parameter to 'return' at line:%d error:", st.line), func() error {
+				v, err := g.expression(st.value)
+				if err != nil {
+					return err
+				}
+				g.line("result.Value = %s", v.code)
+				return nil
+			})
+			if err != nil {
+				return false, err
+			}
+		}
+		g.end()
+		return true, nil
+	case *failStatement:
+		reason, err := g.text(st.reason, fmt.Sprintf("error parsing value as parameter to 'fail' at line:%d error:", st.line))
+		if err != nil {
+			return false, err
+		}
+		g.line("return nil, &gorule.FailError{Script: %q, Reason: %s, Line: %d}", g.opts.Name, reason, st.line)
+		return true, nil
+	case *actionStatement:
+		return true, g.actionStatement(st)
+	case *tagStatement:
+		return false, g.tagStatement(st)
+	case *requireStatement:
+		result, err := g.predicate(st.condition)
+		if err != nil {
+			return false, err
+		}
+		g.line("if !%s {", result)
+		if err := g.violation(st.message, st.line); err != nil {
+			return false, err
+		}
+		g.line("}")
+		return false, nil
+	case *violationStatement:
+		return false, g.violation(st.message, st.line)
+	}
+	return false, generateError(statementWord(st), st.pos(), "it is not supported by gen")
+}
+
+// statementWord returns the word of statements that are not supported by gen, for the error
+func statementWord(st statement) string {
+	switch st := st.(type) {
+	case *logStatement:
+		return "log"
+	case *foreachStatement:
+		return "foreach"
+	case *tryStatement:
+		return "try"
+	case *includeStatement:
+		return "include"
+	case *callStatement:
+		return st.call.name
+	case *onErrorStatement:
+		return "on_error"
+	case *unsetStatement:
+		return "unset"
+	case *valuesStatement:
+		return st.path
+	case *loopControlStatement:
+		return "break"
+	}
+	return fmt.Sprintf("%T", st)
+}
+
+// end writes the end of the script, the outputs are collected after the done label
+func (g *generator) end() {
+	g.line("result.Stopped = true")
+	g.line("goto done")
+	g.done = true
+}
+
+// declareStatement writes the declaration of a variable, variables at the top are declared at the start of the function
+func (g *generator) declareStatement(st *declareStatement, top bool) error {
+	if _, ok := g.resources[st.name]; ok {
+		return generateError(st.name, st.line, "a variable can not have the name of a resource")
+	}
+	if !top && (st.exported || st.kind == "var") {
+		return generateError(st.name, st.line, "'%s' is only supported by gen at the top of the script, use let", st.kind)
+	}
+	if _, ok := g.scope.vars[st.name]; ok {
+		return generateError(st.name, st.line, "the variable is already declared")
+	}
+	value, err := g.expression(st.value)
+	if err != nil {
+		return err
+	}
+	v := &genVar{ident: g.ident(st.name, true), constant: st.kind == "const"}
+	g.scope.vars[st.name] = v
+	g.vars = append(g.vars, v)
+	if top {
+		g.hoisted = append(g.hoisted, v)
+		g.line("%s = %s", v.ident, value.code)
+	} else {
+		g.declared = true
+		g.line("var %s interface{} = %s", v.ident, value.code)
+		g.line("%s", unused(v))
+	}
+	if st.exported {
+		v.read = true
+		g.exports = append(g.exports, st.name)
+		g.line("exports = %d", len(g.exports))
+	}
+	return nil
+}
+
+// target returns the variable or resource of a path that is changed by a statement
+func (g *generator) target(path string, line int) (*genVar, *binding, []string, error) {
+	if strings.Contains(path, "$") {
+		return nil, nil, nil, generateError(path, line, "paths with variables are not supported by gen")
+	}
+	tree := strings.Split(path, ".")
+	if v := g.scope.lookup(tree[0]); v != nil {
+		if len(tree) > 1 {
+			return nil, nil, nil, generateError(path, line, "variable '%s' has no fields", tree[0])
+		}
+		if v.constant {
+			return nil, nil, nil, generateError(path, line, "variable '%s' is a constant", tree[0])
+		}
+		return v, nil, nil, nil
+	}
+	r, ok := g.resources[tree[0]]
+	if !ok {
+		return nil, nil, nil, generateError(path, line, "unknown resource '%s'", tree[0])
+	}
+	if len(tree) == 1 {
+		return nil, nil, nil, generateError(path, line, "resource '%s' is read-only", tree[0])
+	}
+	return nil, r, tree[1:], nil
+}
+
+// assignStatement writes the change of a variable or a field of a resource
+func (g *generator) assignStatement(st *assignStatement) error {
+	v, r, tree, err := g.target(st.path, st.line)
+	if err != nil {
+		return err
+	}
+	value, err := g.expression(st.value)
+	if err != nil {
+		return err
+	}
+	if st.operator != "=" {
+		var current string
+		if v != nil {
+			v.read = true
+			current = v.ident
+		} else {
+			get, err := g.getter(r, tree, st.path, st.line)
+			if err != nil {
+				return err
+			}
+			current = g.tmp()
+			g.line("%s, err := %s(%s)", current, get, r.ident)
+			g.line("if err != nil {")
+			g.wraps = append(g.wraps, strconv.Quote(fmt.Sprintf("error reading '%s' for '%s' at line:%d error:", st.path, st.operator, st.line)))
+			g.returnError("err")
+			g.wraps = g.wraps[:len(g.wraps)-1]
+			g.line("}")
+		}
+		result := g.tmp()
+		g.line("%s, err := %s(%q, %s, %s)", result, g.runtime("Calculate"), st.operator[:1], current, value.code)
+		g.line("if err != nil {")
+		g.returnMessage(fmt.Sprintf("%q + err.Error()", fmt.Sprintf("failed to calculate '%s' at line:%d error:", st.operator, st.line)))
+		g.line("}")
+		value = genValue{code: result, kind: "interface{}"}
+	}
+	if v != nil {
+		g.line("%s = %s", v.ident, value.code)
+		return nil
+	}
+	set, err := g.setter(r, tree, st.path, st.line)
+	if err != nil {
+		return err
+	}
+	text := g.toString(value)
+	if value.kind != "string" || !isIdent(text) {
+		t := g.tmp()
+		g.line("%s := %s", t, text)
+		text = t
+	}
+	g.line("if err := %s(%s, %s); err != nil {", set, r.ident, text)
+	g.returnMessage(fmt.Sprintf("%q + %s + %q + err.Error()", fmt.Sprintf("error modifing '%s' to '", st.path), text, fmt.Sprintf("' at line:%d error:", st.line)))
+	g.line("}")
+	return nil
+}
+
+// replaceRegexStatement writes a regex replace of a variable or a text field of a resource
+func (g *generator) replaceRegexStatement(st *replaceRegexStatement) error {
+	v, r, tree, err := g.target(st.path, st.line)
+	if err != nil {
+		return err
+	}
+	match, err := g.text(st.match, fmt.Sprintf("error parsing regex as 2nd parameter to 'replace_regex' at line:%d error:", st.line))
+	if err != nil {
+		return err
+	}
+	replace, err := g.text(st.replace, fmt.Sprintf("error parsing replacement as 3rd parameter to 'replace_regex' at line:%d error:", st.line))
+	if err != nil {
+		return err
+	}
+	var re string
+	if pattern, err := strconv.Unquote(match); err == nil {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return generateError(st.path, st.line, "invalid regex '%s' to 'replace_regex' error:%s", pattern, err)
+		}
+		re = g.pattern("Regexp", fmt.Sprintf("%s.MustCompile(%s)", g.pkg("regexp"), match))
+	} else {
+		re = g.tmp()
+		g.line("%s, err := %s.Compile(%s)", re, g.pkg("regexp"), match)
+		g.line("if err != nil {")
+		g.returnMessage(fmt.Sprintf("%q + %s + %q + err.Error()", "replace_regex replace failed '", match, fmt.Sprintf("' at line:%d error:", st.line)))
+		g.line("}")
+	}
+	if v != nil {
+		v.read = true
+		t := g.tmp()
+		g.line("%s, ok := %s.(string)", t, v.ident)
+		g.line("if !ok {")
+		g.returnMessage(fmt.Sprintf("%q + %s.Sprintf(\"%%T\", %s) + %q", fmt.Sprintf("replace_regex get failed '%s' at line:%d error:values of type '", st.path, st.line), g.pkg("fmt"), v.ident, "' can not be replaced"))
+		g.line("}")
+		g.line("%s = %s.ReplaceAllString(%s, %s)", v.ident, re, t, replace)
+		return nil
+	}
+	get, err := g.getter(r, tree, st.path, st.line)
+	if err != nil {
+		return err
+	}
+	if g.multiple[get] {
+		return generateError(st.path, st.line, "replace_regex on fields with multiple values is not supported by gen")
+	}
+	if kind := g.getterKinds[get]; kind != "string" {
+		return generateError(st.path, st.line, "replace_regex on values of type '%s' is not supported by gen", kind)
+	}
+	original := g.tmp()
+	g.line("%s, err := %s(%s)", original, get, r.ident)
+	g.line("if err != nil {")
+	g.returnMessage(fmt.Sprintf("%q + err.Error()", fmt.Sprintf("replace_regex get failed '%s' at line:%d error:", st.path, st.line)))
+	g.line("}")
+	set, err := g.setter(r, tree, st.path, st.line)
+	if err != nil {
+		return err
+	}
+	replaced := g.tmp()
+	g.line("%s := %s.ReplaceAllString(%s, %s)", replaced, re, original, replace)
+	g.line("if err := %s(%s, %s); err != nil {", set, r.ident, replaced)
+	g.returnMessage(fmt.Sprintf("%q + %s + %q + err.Error()", fmt.Sprintf("replace_regex modify failed '%s' to '", st.path), replaced, fmt.Sprintf("' at line:%d error:", st.line)))
+	g.line("}")
+	return nil
+}
+
+// ifBranch writes a branch of an if statement, and the branches after it in the else
+func (g *generator) ifBranch(st *ifStatement, i int) (bool, error) {
+	if i == len(st.branches) {
+		return g.block(st.otherwise, false)
+	}
+	result, err := g.predicate(st.branches[i].condition)
+	if err != nil {
+		return false, err
+	}
+	g.line("if %s {", result)
+	ends, err := g.block(st.branches[i].block, false)
+	if err != nil {
+		return false, err
+	}
+	if i == len(st.branches)-1 && st.otherwise == nil {
+		g.line("}")
+		return false, nil
+	}
+	g.line("} else {")
+	otherEnds, err := g.ifBranch(st, i+1)
+	if err != nil {
+		return false, err
+	}
+	g.line("}")
+	return ends && otherEnds, nil
+}
+
+// switchStatement writes a switch as a chain of if statements, the subject is evaluated once
+func (g *generator) switchStatement(st *switchStatement) (bool, error) {
+	subject, err := g.text(st.subject, fmt.Sprintf("error parsing value as 1st parameter to 'switch' at line:%d error:", st.line))
+	if err != nil {
+		return false, err
+	}
+	if !isIdent(subject) {
+		t := g.tmp()
+		g.line("%s := %s", t, subject)
+		subject = t
+	}
+	return g.switchCase(st, subject, 0)
+}
+
+// switchCase writes a case of a switch statement, and the cases after it in the else
+func (g *generator) switchCase(st *switchStatement, subject string, i int) (bool, error) {
+	if i == len(st.cases) {
+		if st.otherwise == nil {
+			return false, nil
+		}
+		return g.block(st.otherwise, false)
+	}
+	c := st.cases[i]
+	matched := ""
+	if len(c.values) > 1 {
+		matched = g.tmp()
+		g.line("%s := false", matched)
+	}
+	for j, v := range c.values {
+		if j > 0 {
+			g.line("if !%s {", matched)
+		}
+		value, err := g.text(v, fmt.Sprintf("error parsing value to 'case' at line:%d error:", c.line))
+		if err != nil {
+			return false, err
+		}
+		result, err := g.compare(subject, c.validator, value, v, fmt.Sprintf("failed to validate 'case' at line:%d error:", c.line), c.line)
+		if err != nil {
+			return false, err
+		}
+		if matched == "" {
+			matched = result
+			break
+		}
+		g.line("%s = %s", matched, result)
+		if j > 0 {
+			g.line("}")
+		}
+	}
+	g.line("if %s {", matched)
+	ends, err := g.block(c.block, false)
+	if err != nil {
+		return false, err
+	}
+	if i == len(st.cases)-1 && st.otherwise == nil {
+		g.line("}")
+		return false, nil
+	}
+	g.line("} else {")
+	otherEnds, err := g.switchCase(st, subject, i+1)
+	if err != nil {
+		return false, err
+	}
+	g.line("}")
+	return ends && otherEnds, nil
+}
+
+// actionNames are the names of the actions in the gorule package
+var actionNames = map[Action]string{
+	ActionDeny:     "gorule.ActionDeny",
+	ActionRedirect: "gorule.ActionRedirect",
+	ActionRespond:  "gorule.ActionRespond",
+}
+
+// actionStatement writes a decision, it always ends the function
+func (g *generator) actionStatement(st *actionStatement) error {
+	status := strconv.Itoa(defaultStatus[st.action])
+	if st.status != nil {
+		text, err := g.text(*st.status, fmt.Sprintf("error parsing status as 1st parameter to '%s' at line:%d error:", st.action, st.line))
+		if err != nil {
+			return err
+		}
+		// a constant status is checked now, it only fails when the script runs
+		if constant, err := strconv.Unquote(text); err == nil {
+			if code, err := strconv.Atoi(constant); err == nil && code >= 100 && code <= 599 {
+				text = ""
+				status = strconv.Itoa(code)
+			}
+		}
+		if text != "" {
+			status = g.tmp()
+			g.line("%s, err := %s.Atoi(%s)", status, g.pkg("strconv"), text)
+			g.line("if err != nil || %s < 100 || %s > 599 {", status, status)
+			g.returnMessage(fmt.Sprintf("%q + %s + %q", "invalid status '", text, fmt.Sprintf("' to '%s' at line:%d", st.action, st.line)))
+			g.line("}")
+		}
+	}
+	value := `""`
+	if st.value != nil {
+		var err error
+		value, err = g.text(*st.value, fmt.Sprintf("error parsing value as parameter to '%s' at line:%d error:", st.action, st.line))
+		if err != nil {
+			return err
+		}
+	}
+	g.line("result.Outcome.Action = %s", actionNames[st.action])
+	g.line("result.Outcome.Status = %s", status)
+	g.line("result.Outcome.Line = %d", st.line)
+	switch st.action {
+	case ActionDeny:
+		g.line("result.Outcome.Reason = %s", value)
+	case ActionRedirect:
+		g.line("result.Outcome.Location = %s", value)
+	case ActionRespond:
+		g.line("result.Outcome.Body = %s", value)
+	}
+	g.end()
+	return nil
+}
+
+// tagStatement writes adding a tag to the outcome, tags are only added once
+func (g *generator) tagStatement(st *tagStatement) error {
+	tag, err := g.text(st.tag, fmt.Sprintf("error parsing value as parameter to 'tag' at line:%d error:", st.line))
+	if err != nil {
+		return err
+	}
+	if !isIdent(tag) {
+		t := g.tmp()
+		g.line("%s := %s", t, tag)
+		tag = t
+	}
+	found := g.tmp()
+	g.line("%s := false", found)
+	g.line("for _, t := range result.Outcome.Tags {")
+	g.line("%s = %s || t == %s", found, found, tag)
+	g.line("}")
+	g.line("if !%s {", found)
+	g.line("result.Outcome.Tags = append(result.Outcome.Tags, %s)", tag)
+	g.line("}")
+	return nil
+}
+
+// violation writes adding a violation to the result
+func (g *generator) violation(message operand, line int) error {
+	m, err := g.text(message, fmt.Sprintf("error parsing message of violation at line:%d error:", line))
+	if err != nil {
+		return err
+	}
+	g.line("result.Violations = append(result.Violations, gorule.Violation{Message: %s, Script: %q, Line: %d})", m, g.opts.Name, line)
+	return nil
+}
+
+// predicate writes the condition of an if or require statement, and returns the result as bool
+func (g *generator) predicate(p predicate) (string, error) {
+	c, ok := p.(*condition)
+	if !ok {
+		return "", generateError("any", p.(*quantifiedCondition).line, "it is not supported by gen")
+	}
+	return g.condition(c)
+}
+
+// condition writes the validation of 2 values
+func (g *generator) condition(c *condition) (string, error) {
+	var left, right genValue
+	err := g.wrapped(fmt.Sprintf("error parsing value as 1st parameter to 'if' at line:%d error:", c.line), func() (err error) {
+		left, err = g.expression(c.left)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	err = g.wrapped(fmt.Sprintf("error parsing value as 3rd parameter to 'if' at line:%d error:", c.line), func() (err error) {
+		right, err = g.expression(c.right)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return g.compare(g.toString(left), c.validator, g.toString(right), c.right, fmt.Sprintf("failed to validate 'if' at line:%d error:", c.line), c.line)
+}
+
+// compare writes the validation of 2 texts, the patterns of matchers are compiled once if they are a constant
+func (g *generator) compare(left, validator, right string, pattern expression, prefix string, line int) (string, error) {
+	switch validator {
+	case "contains":
+		return fmt.Sprintf("%s.Contains(%s, %s)", g.pkg("strings"), left, right), nil
+	case "has_prefix":
+		return fmt.Sprintf("%s.HasPrefix(%s, %s)", g.pkg("strings"), left, right), nil
+	case "in_ipset", "in_table":
+		return "", generateError(validator, line, "it is not supported by gen")
+	}
+	if compile, ok := matchers[validator]; ok {
+		if p, ok := constantValue(pattern); ok {
+			if _, err := compile(toString(p)); err != nil {
+				return "", generateError(validator, line, "invalid pattern '%s' error:%s", toString(p), err)
+			}
+			m := g.pattern("Match", fmt.Sprintf("%s(%q, %q)", g.runtime("MustMatcher"), validator, toString(p)))
+			return fmt.Sprintf("%s(%s)", m, left), nil
+		}
+	}
+	result := g.tmp()
+	g.line("%s, err := %s(%s, %q, %s)", result, g.runtime("Compare"), left, validator, right)
+	g.line("if err != nil {")
+	g.returnMessage(fmt.Sprintf("%q + err.Error()", prefix))
+	g.line("}")
+	return result, nil
+}
+
+// pattern returns the package variable of a compiled pattern, code is the Go code compiling it
+func (g *generator) pattern(kind, code string) string {
+	if name, ok := g.patterns[code]; ok {
+		return name
+	}
+	name := fmt.Sprintf("%s%s%d", g.prefix, kind, len(g.patterns)+1)
+	g.patterns[code] = name
+	g.helpers = append(g.helpers, fmt.Sprintf("var %s = %s\n", name, code))
+	return name
+}
+
+// expression writes the computation of a value
+func (g *generator) expression(e expression) (genValue, error) {
+	switch e := e.(type) {
+	case operand:
+		text, err := g.text(e, "")
+		return genValue{code: text, kind: "string"}, err
+	case *constant:
+		return constantCode(e.result), nil
+	case *condition:
+		result, err := g.condition(e)
+		return genValue{code: result, kind: "bool"}, err
+	case *binaryExpression:
+		left, err := g.expression(e.left)
+		if err != nil {
+			return genValue{}, err
+		}
+		right, err := g.expression(e.right)
+		if err != nil {
+			return genValue{}, err
+		}
+		if e.text {
+			// the parser only allows + on quoted strings, it joins them
+			return genValue{code: g.toString(left) + " + " + g.toString(right), kind: "string"}, nil
+		}
+		result := g.tmp()
+		g.line("%s, err := %s(%q, %s, %s)", result, g.runtime("Calculate"), e.operator, left.code, right.code)
+		g.line("if err != nil {")
+		g.returnMessage(fmt.Sprintf("%q + err.Error()", fmt.Sprintf("failed to calculate '%s' at line:%d error:", e.operator, e.line)))
+		g.line("}")
+		return genValue{code: result, kind: "interface{}"}, nil
+	case *ternaryExpression:
+		c, err := g.expression(e.condition)
+		if err != nil {
+			return genValue{}, err
+		}
+		condition := c.code
+		if c.kind != "bool" {
+			text := g.toString(c)
+			if !isIdent(text) {
+				t := g.tmp()
+				g.line("%s := %s", t, text)
+				text = t
+			}
+			condition = g.tmp()
+			g.line("%s, err := %s.ParseBool(%s)", condition, g.pkg("strconv"), text)
+			g.line("if err != nil {")
+			g.returnMessage(fmt.Sprintf("%q + %s + %q", fmt.Sprintf("condition of '?' at line:%d is not true or false but '", e.line), text, "'"))
+			g.line("}")
+		}
+		result := g.tmp()
+		g.line("var %s interface{}", result)
+		g.line("if %s {", condition)
+		yes, err := g.expression(e.yes)
+		if err != nil {
+			return genValue{}, err
+		}
+		g.line("%s = %s", result, yes.code)
+		g.line("} else {")
+		no, err := g.expression(e.no)
+		if err != nil {
+			return genValue{}, err
+		}
+		g.line("%s = %s", result, no.code)
+		g.line("}")
+		return genValue{code: result, kind: "interface{}"}, nil
+	}
+	return genValue{}, fmt.Errorf("expression '%T' is not supported by gen", e)
+}
+
+// constantCode returns the Go code of a value computed when compiling
+func constantCode(v interface{}) genValue {
+	switch v := v.(type) {
+	case string:
+		return genValue{code: strconv.Quote(v), kind: "string"}
+	case bool:
+		return genValue{code: strconv.FormatBool(v), kind: "bool"}
+	case int:
+		return genValue{code: strconv.Itoa(v), kind: "interface{}"}
+	case float64:
+		return genValue{code: "float64(" + strconv.FormatFloat(v, 'g', -1, 64) + ")", kind: "interface{}"}
+	}
+	return genValue{code: strconv.Quote(toString(v)), kind: "string"}
+}
+
+// toString returns the Go code of a value as text
+func (g *generator) toString(v genValue) string {
+	switch v.kind {
+	case "string":
+		return v.code
+	case "bool":
+		return g.pkg("strconv") + ".FormatBool(" + v.code + ")"
+	case "int":
+		return g.pkg("strconv") + ".Itoa(" + v.code + ")"
+	case "int64":
+		return g.pkg("strconv") + ".FormatInt(" + v.code + ", 10)"
+	case "float64":
+		return g.pkg("strconv") + ".FormatFloat(" + v.code + ", 'f', -1, 64)"
+	}
+	return g.runtime("ToString") + "(" + v.code + ")"
+}
+
+// text writes the interpolation of an operand, errors get the prefix
+func (g *generator) text(o operand, prefix string) (string, error) {
+	if o.call != nil {
+		return "", generateError(o.call.name, o.call.line, "function calls are not supported by gen")
+	}
+	if !strings.Contains(o.text, "$") {
+		return strconv.Quote(o.text), nil
+	}
+	if prefix != "" {
+		g.wraps = append(g.wraps, strconv.Quote(prefix))
+		defer func() { g.wraps = g.wraps[:len(g.wraps)-1] }()
+	}
+	t, ok := g.prog.templates[o.text]
+	if !ok {
+		var err error
+		t, err = (&parser{templates: map[string]template{}, matchers: map[string]matcher{}}).template(o.text, o.line)
+		if err != nil {
+			return "", generateError(o.text, o.line, "%s", err)
+		}
+	}
+	return g.template(t, o.line)
+}
+
+// template writes the interpolation of a template
+func (g *generator) template(t template, line int) (string, error) {
+	parts := []string{}
+	for _, part := range t {
+		switch {
+		case part.expression != nil:
+			v, err := g.expression(part.expression)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, g.toString(v))
+		case part.name != "":
+			v, err := g.variable(part, line)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, v)
+		default:
+			parts = append(parts, strconv.Quote(part.text))
+		}
+	}
+	if len(parts) == 0 {
+		return `""`, nil
+	}
+	return strings.Join(parts, " + "), nil
+}
+
+// variable writes the value of a $(variable) as text, with the fallback if the variable is missing or empty
+func (g *generator) variable(part templatePart, line int) (string, error) {
+	if len(part.filters) > 0 {
+		return "", generateError(part.name, line, "filters are not supported by gen")
+	}
+	tree := strings.Split(part.name, ".")
+	result := g.tmp()
+	if v := g.scope.lookup(tree[0]); v != nil {
+		if len(tree) > 1 {
+			return "", generateError(part.name, line, "variable '%s' has no fields", tree[0])
+		}
+		v.read = true
+		g.line("%s := %s(%s)", result, g.runtime("ToString"), v.ident)
+	} else if r, ok := g.resources[tree[0]]; ok {
+		get, err := g.getter(r, tree[1:], part.name, line)
+		if err != nil {
+			return "", err
+		}
+		value := g.tmp()
+		g.line("%s, err := %s(%s)", value, get, r.ident)
+		if part.hasFallback {
+			if g.multiple[get] {
+				// like the interpreter, multiple values are not replaced by the fallback
+				g.line("if %s.Is(err, gorule.ErrMultipleValues) {", g.pkg("errors"))
+				g.returnMessage(fmt.Sprintf("%q + err.Error()", fmt.Sprintf("error translating variable '%s of resource '%s': ", part.name, tree[0])))
+				g.line("}")
+			}
+			g.line("var %s string", result)
+			g.line("if err == nil {")
+			g.line("%s = %s", result, g.toString(genValue{code: value, kind: g.getterKinds[get]}))
+			g.line("}")
+			g.line("if err != nil || %s == \"\" {", result)
+			return result, g.fallback(part, result, line)
+		}
+		g.line("if err != nil {")
+		g.returnMessage(fmt.Sprintf("%q + err.Error()", fmt.Sprintf("error translating variable '%s of resource '%s': ", part.name, tree[0])))
+		g.line("}")
+		text := g.toString(genValue{code: value, kind: g.getterKinds[get]})
+		if text == value {
+			return value, nil
+		}
+		g.line("%s := %s", result, text)
+		return result, nil
+	} else {
+		return "", generateError(part.name, line, "unknown variable or resource '%s'", tree[0])
+	}
+	if part.hasFallback {
+		g.line("if %s == \"\" {", result)
+		return result, g.fallback(part, result, line)
+	}
+	return result, nil
+}
+
+// fallback writes the interpolation of the fallback in to result, and closes the if statement that checks if it is needed
+func (g *generator) fallback(part templatePart, result string, line int) error {
+	f, err := g.template(part.fallback, line)
+	if err != nil {
+		return err
+	}
+	g.line("%s = %s", result, f)
+	g.line("}")
+	return nil
+}
+
+// isIdent returns true if the code is a single Go identifier
+func isIdent(code string) bool {
+	for i, r := range code {
+		if !(r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+	return code != ""
+}
@@ -0,0 +1,41 @@
+package gorule
+
+import (
+	"fmt"
+
+	"github.com/rdoorn/gorule/internal/genapi"
+)
+
+// the functions in this file are used by the code generated by gorule gen through the genrt package, so it behaves like the scripts
+
+func init() {
+	genapi.ToString = toString
+	genapi.Calculate = calculate
+	genapi.Compare = compare
+	genapi.Matcher = compileMatcher
+}
+
+// compare validates 2 values like the scripts do, the validators that use an engine like in_ipset are not supported
+func compare(value, validator, pattern string) (bool, error) {
+	if compile, ok := matchers[validator]; ok {
+		m, err := compile(pattern)
+		if err != nil {
+			return false, err
+		}
+		return m(value), nil
+	}
+	return eval(value, validator, pattern)
+}
+
+// compileMatcher compiles the pattern of match_regex, match_glob or match_host
+func compileMatcher(validator, pattern string) (func(value string) bool, error) {
+	compile, ok := matchers[validator]
+	if !ok {
+		return nil, fmt.Errorf("unknown matcher '%s'", validator)
+	}
+	m, err := compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s' to '%s': %s", pattern, validator, err)
+	}
+	return m, nil
+}
@@ -0,0 +1,33 @@
+// Package genrt holds the functions used by the code generated by gorule gen, so it behaves like the scripts
+// it is support for generated code only, it is not meant to be used directly and is not covered by the compatibility guarantees of gorule
+package genrt
+
+import (
+	// gorule sets the functions of genapi when it is loaded
+	_ "github.com/rdoorn/gorule"
+	"github.com/rdoorn/gorule/internal/genapi"
+)
+
+// ToString converts a value to text like the scripts do
+func ToString(v interface{}) string {
+	return genapi.ToString(v)
+}
+
+// Calculate applies the operator to 2 values like the scripts do, + concatenates the values if they are not both numbers
+func Calculate(operator string, left, right interface{}) (interface{}, error) {
+	return genapi.Calculate(operator, left, right)
+}
+
+// Compare validates 2 values like the scripts do, the validators that use an engine like in_ipset are not supported
+func Compare(value, validator, pattern string) (bool, error) {
+	return genapi.Compare(value, validator, pattern)
+}
+
+// MustMatcher compiles the pattern of match_regex, match_glob or match_host, it panics if the pattern is invalid
+func MustMatcher(validator, pattern string) func(value string) bool {
+	m, err := genapi.Matcher(validator, pattern)
+	if err != nil {
+		panic("genrt: " + err.Error())
+	}
+	return m
+}
@@ -1,11 +1,19 @@
 package gorule
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -111,7 +119,7 @@ var scriptTests = []scriptTest{
 	scriptTest{
 		interfaces: map[string]interface{}{},
 		script: []byte(`
-					var testvalue 1
+					export var testvalue 1
 					if $(testvalue) == 1 {
 						testvalue = 10
 					} elseif $(testvalue) == 2 {
@@ -129,7 +137,7 @@ var scriptTests = []scriptTest{
 	scriptTest{
 		interfaces: map[string]interface{}{},
 		script: []byte(`
-					var testvalue 2
+					export var testvalue 2
 					if $(testvalue) == 1 {
 						testvalue = 10
 					} elseif $(testvalue) == 2 {
@@ -147,7 +155,7 @@ var scriptTests = []scriptTest{
 	scriptTest{
 		interfaces: map[string]interface{}{},
 		script: []byte(`
-					var testvalue 3
+					export var testvalue 3
 					if $(testvalue) == 1 {
 						testvalue = 10
 					} elseif $(testvalue) == 2 {
@@ -165,7 +173,7 @@ var scriptTests = []scriptTest{
 	scriptTest{
 		interfaces: map[string]interface{}{},
 		script: []byte(`
-					var testvalue 3
+					export var testvalue 3
 					// testvalue = 4
 					# testvalue = 5
 					/*
@@ -187,7 +195,7 @@ var scriptTests = []scriptTest{
 			},
 		},
 		script: []byte(`
-							var testvalue 1
+							export var testvalue 1
 							if $(request.header.referer) match_regex "e[x]+..ple" {
 								testvalue = 3
 							}
@@ -206,7 +214,7 @@ var scriptTests = []scriptTest{
 			"client": "1.2.3.4",
 		},
 		script: []byte(`
-							var testvalue 1
+							export var testvalue 1
 							if $(client) match_net "1.2.3.0/24" {
 								testvalue = 3
 							}
@@ -225,7 +233,7 @@ var scriptTests = []scriptTest{
 			"client": "10.2.3.4",
 		},
 		script: []byte(`
-							var testvalue 1
+							export var testvalue 1
 							if $(client) match_net "1.2.3.0/24" {
 								testvalue = 3
 							}
@@ -243,7 +251,7 @@ var scriptTests = []scriptTest{
 			},
 		},
 		script: []byte(`
-							var testvalue /user/test/site
+							export var testvalue /user/test/site
 							testvalue replace_regex "/user/(.*)/" "/client/$1/"
 				`),
 		result: map[string]interface{}{
@@ -309,6 +317,1632 @@ var scriptTests = []scriptTest{
 			"request.url.path": "",
 		},
 	},
+
+	// let is scoped to its block
+	scriptTest{
+		interfaces: map[string]interface{}{},
+		script: []byte(`
+					export var testvalue 1
+					if 1 == 1 {
+						let testvalue = 5
+						testvalue = 6
+						export var inner 7
+					}
+				`),
+		result: map[string]interface{}{
+			"testvalue": "1",
+			"inner":     "7",
+		},
+	},
+
+	// variables do not leak in to the resources
+	scriptTest{
+		interfaces: map[string]interface{}{
+			"request": &http.Request{},
+		},
+		script: []byte(`
+					var hidden 1
+					const value "HTTP/2"
+					if $(hidden) == 1 {
+						if $(value) == "HTTP/2" {
+							request.proto = "HTTP/2"
+						}
+					}
+				`),
+		result: map[string]interface{}{
+			"request.proto": "HTTP/2",
+			"hidden":        fmt.Errorf("getInterface resource does not exist"),
+		},
+	},
+
+	// foreach over headers, unsetting while looping
+	scriptTest{
+		interfaces: map[string]interface{}{
+			"request": &http.Request{
+				Header: map[string][]string{
+					"X-Internal-Id":   []string{"1"},
+					"X-Internal-User": []string{"admin"},
+					"Accept":          []string{"*/*"},
+				},
+			},
+		},
+		script: []byte(`
+					export var seen ""
+					foreach key, value in request.header {
+						if $(key) match_regex "^X-Internal-" {
+							unset request.header.$(key)
+							continue
+						}
+						seen = $(key)
+					}
+				`),
+		result: map[string]interface{}{
+			"request.header.x-internal-id":   fmt.Errorf("getInterfaceMap type 'x-internal-id' has not been found in the resource 'string'"),
+			"request.header.x-internal-user": fmt.Errorf("getInterfaceMap type 'x-internal-user' has not been found in the resource 'string'"),
+			"request.header.accept":          "*/*",
+		},
+	},
+
+	// foreach over a slice with break
+	scriptTest{
+		interfaces: map[string]interface{}{
+			"request": &http.Request{
+				TLS: &tls.ConnectionState{
+					PeerCertificates: []*x509.Certificate{
+						&x509.Certificate{Subject: pkix.Name{CommonName: "client"}},
+						&x509.Certificate{Subject: pkix.Name{CommonName: "intermediate"}},
+						&x509.Certificate{Subject: pkix.Name{CommonName: "root"}},
+					},
+				},
+			},
+		},
+		script: []byte(`
+					export var found "none"
+					foreach cert in request.tls.peercertificates {
+						if $(cert.subject.commonname) == "intermediate" {
+							found = "yes"
+							break
+						}
+					}
+				`),
+		result: map[string]interface{}{
+			"found": "yes",
+		},
+	},
+
+	// foreach with variables declared in the body
+	scriptTest{
+		interfaces: map[string]interface{}{
+			"request": &http.Request{
+				Header: map[string][]string{
+					"Accept": []string{"*/*"},
+					"X-Id":   []string{"1"},
+				},
+			},
+		},
+		script: []byte(`
+					export var names ""
+					foreach key, value in request.header {
+						var name = "$(key | lower)"
+						export var last = $(name)
+						const first = "$(value | first)"
+						names = "$(names)$(name)=$(first);"
+					}
+				`),
+		result: map[string]interface{}{
+			"names": "accept=*/*;x-id=1;",
+			"last":  "x-id",
+		},
+	},
+
+	// expressions in assignments
+	scriptTest{
+		interfaces: map[string]interface{}{
+			"request": &http.Request{Host: "www.example.com", URL: &url.URL{Path: "/status"}},
+		},
+		script: []byte(`
+					export var counter = 1
+					counter += 2 * 3
+					counter -= 1
+					export var half = $(counter) / 4
+					export var location = "https://" + $(request.host) + $(request.url.path)
+					export var size = $(counter) > 5 ? "large" : "small"
+					export var grouped = (1 + 2) * 3 % 5
+					request.header.x-counter = $(counter) + 1
+					export var joined = "10" + "5"
+					export var suffix = $(counter) + "0"
+					export var label = "$(counter)" + 1
+					export var sum = 10 + 5
+					export var chained = "10" + "5" + 1
+					export var added = 1 + 2 + "3" + 4
+					export var nested = 1 + ("2" + 3) + 4
+					export var words = abc + 1 + 2
+				`),
+		result: map[string]interface{}{
+			"chained":                  "1051",
+			"added":                    "334",
+			"nested":                   "1234",
+			"words":                    "abc12",
+			"joined":                   "105",
+			"suffix":                   "60",
+			"label":                    "61",
+			"sum":                      15,
+			"counter":                  6,
+			"half":                     1.5,
+			"location":                 "https://www.example.com/status",
+			"size":                     "large",
+			"grouped":                  4,
+			"request.header.x-counter": "7",
+		},
+	},
+}
+
+type scriptErrorTest struct {
+	interfaces map[string]interface{}
+	script     []byte
+	err        string
+}
+
+var scriptErrorTests = []scriptErrorTest{
+	// quoted strings are text, they can not be used in calculations
+	scriptErrorTest{
+		interfaces: map[string]interface{}{},
+		script: []byte(`
+					var total = "10" * 2
+				`),
+		err: "'*' at line:2 error:quoted strings can only be joined with '+'",
+	},
+
+	// a variable can only be declared once by the script
+	scriptErrorTest{
+		interfaces: map[string]interface{}{},
+		script: []byte(`
+					var name = "a"
+					if 1 == 1 {
+						var name = "b"
+					}
+				`),
+		err: "variable with the name 'name' already exists at line:4",
+	},
+
+	// text joined with + is still text
+	scriptErrorTest{
+		interfaces: map[string]interface{}{},
+		script: []byte(`
+					var total = "10" + 5 - 2
+				`),
+		err: "'-' at line:2 error:quoted strings can only be joined with '+'",
+	},
+
+	// const cannot be changed
+	scriptErrorTest{
+		interfaces: map[string]interface{}{},
+		script: []byte(`
+					const testvalue 1
+					testvalue = 2
+				`),
+		err: "error modifing 'testvalue' to '2' at line:3 error:variable 'testvalue' is a constant",
+	},
+
+	// let is not visible outside its block
+	scriptErrorTest{
+		interfaces: map[string]interface{}{},
+		script: []byte(`
+					if 1 == 1 {
+						let testvalue 1
+					}
+					testvalue = 2
+				`),
+		err: "error modifing 'testvalue' to '2' at line:5 error:unknown resource 'testvalue'",
+	},
+
+	// resources are read-only identifiers
+	scriptErrorTest{
+		interfaces: map[string]interface{}{
+			"client": "1.2.3.4",
+		},
+		script: []byte(`
+					client = "4.3.2.1"
+				`),
+		err: "error modifing 'client' to '4.3.2.1' at line:2 error:resource 'client' is read-only",
+	},
+
+	// variables cannot replace resources
+	scriptErrorTest{
+		interfaces: map[string]interface{}{
+			"client": "1.2.3.4",
+		},
+		script: []byte(`
+					var client "4.3.2.1"
+				`),
+		err: "variable resource with the name 'client' already exists at line:2",
+	},
+
+	// calculations need numbers
+	scriptErrorTest{
+		interfaces: map[string]interface{}{},
+		script: []byte(`
+					var testvalue "a"
+					testvalue -= 1
+				`),
+		err: "failed to calculate '-=' at line:3 error:cannot use '-' on 'a' and '1', they are not both numbers",
+	},
+
+	// division by zero
+	scriptErrorTest{
+		interfaces: map[string]interface{}{},
+		script: []byte(`
+					var testvalue = 1 / 0
+				`),
+		err: "failed to calculate '/' at line:2 error:division by zero",
+	},
+
+	// syntax errors are found before execution
+	scriptErrorTest{
+		interfaces: map[string]interface{}{},
+		script: []byte(`
+					if 1 == 1 {
+						var testvalue 1
+				`),
+		err: "expected '}' before the end of the script at line:4",
+	},
+}
+
+func TestSwitch(t *testing.T) {
+	rule, err := NewEngine().Compile("switch", []byte(`
+		export var backend ""
+		switch $(request.host) {
+			case "a.com", "b.com" {
+				backend = "ab"
+			}
+			case match_regex "^api\." {
+				backend = "api"
+			}
+			default {
+				backend = "default"
+			}
+		}
+	`))
+	assert.Nil(t, err)
+
+	backends := map[string]string{
+		"a.com":       "ab",
+		"b.com":       "ab",
+		"api.c.com":   "api",
+		"www.c.com":   "default",
+		"api.a.com.x": "api",
+	}
+	for host, backend := range backends {
+		result, err := rule.Execute(map[string]interface{}{"request": &http.Request{Host: host}})
+		assert.Nil(t, err)
+		if err == nil {
+			assert.Equal(t, backend, result.Outputs["backend"], host)
+		}
+	}
+
+	_, err = NewEngine().Compile("switch", []byte(`
+		switch $(request.host) {
+			if 1 == 1 {
+			}
+		}
+	`))
+	assert.EqualError(t, err, "expected 'case' or 'default' in 'switch' at line:3")
+}
+
+func TestFunctions(t *testing.T) {
+	rule, err := NewEngine().Compile("functions", []byte(`
+		export var greeting greet("world", $(request.host))
+
+		if $(request.host) == "example.com" {
+			secure()
+		}
+
+		func greet(name, host) {
+			return "hello $(name) from $(host)"
+		}
+
+		func secure() {
+			request.header.x-frame-options = "DENY"
+			strip("x-internal")
+		}
+
+		func strip(prefix) {
+			foreach key, value in request.header {
+				if $(key) match_regex "(?i)^$(prefix)" {
+					unset request.header.$(key)
+				}
+			}
+		}
+	`))
+	assert.Nil(t, err)
+
+	request := &http.Request{Host: "example.com", Header: http.Header{"X-Internal-Id": {"1"}}}
+	result, err := rule.Execute(map[string]interface{}{"request": request})
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, "hello world from example.com", result.Outputs["greeting"])
+		value, err := getInterface(defaultEngine, request, []string{"header", "x-frame-options"})
+		assert.Nil(t, err)
+		assert.Equal(t, "DENY", value)
+		assert.Len(t, request.Header, 1)
+	}
+
+	// recursion is limited
+	rule, err = NewEngine(WithMaxCallDepth(5)).Compile("recursion", []byte(`
+		func loop() {
+			loop()
+		}
+		loop()
+	`))
+	assert.Nil(t, err)
+	_, err = rule.Execute(map[string]interface{}{})
+	assert.EqualError(t, err, "call to 'loop' at line:5 exceeded the maximum call depth of 5")
+
+	// the error is reported once for the first call, and can not be caught
+	rule, err = NewEngine(WithMaxCallDepth(100)).Compile("recursion", []byte(`
+		func deeper(n) {
+			return deeper($(n) + 1)
+		}
+		try {
+			export var total = deeper(0)
+		} catch err {
+			log "caught $(err.message)"
+		}
+	`))
+	assert.Nil(t, err)
+	_, err = rule.Execute(map[string]interface{}{})
+	assert.EqualError(t, err, "call to 'deeper' at line:6 exceeded the maximum call depth of 100")
+
+	// undefined functions and wrong arity are found when compiling
+	_, err = NewEngine().Compile("undefined", []byte(`
+		missing(1)
+	`))
+	assert.EqualError(t, err, "undefined function 'missing' at line:2")
+
+	_, err = NewEngine().Compile("arity", []byte(`
+		func one(a) {
+		}
+		one(1, 2)
+	`))
+	assert.EqualError(t, err, "function 'one' expects 1 arguments, got 2 at line:4")
+}
+
+func TestInclude(t *testing.T) {
+	fsys := fstest.MapFS{
+		"common/security.rule": &fstest.MapFile{Data: []byte(`
+			import "lib/headers.rule"
+			set_header("x-frame-options", "DENY")
+		`)},
+		"lib/headers.rule": &fstest.MapFile{Data: []byte(`
+			// functions shared by all teams
+			func set_header(name, value) {
+				request.header.$(name) = $(value)
+			}
+		`)},
+		"broken.rule": &fstest.MapFile{Data: []byte(`
+			request.header.x-ok = "1"
+			request.nothing = "1"
+		`)},
+		"shared/a.rule": &fstest.MapFile{Data: []byte(`include "shared/mark.rule"`)},
+		"shared/b.rule": &fstest.MapFile{Data: []byte(`include "shared/mark.rule"`)},
+		"shared/mark.rule": &fstest.MapFile{Data: []byte(`
+			func mark(name) {
+				add request.header.x-mark $(name)
+			}
+			mark("shared")
+		`)},
+		"cycle/a.rule": &fstest.MapFile{Data: []byte(`include "cycle/b.rule"`)},
+		"cycle/b.rule": &fstest.MapFile{Data: []byte(`include "cycle/a.rule"`)},
+	}
+	engine := NewEngine(WithFS(fsys))
+
+	rule, err := engine.Compile("include", []byte(`
+		import "lib/headers.rule"
+		include "common/security.rule"
+		set_header("x-team", "blue")
+	`))
+	assert.Nil(t, err)
+	request := &http.Request{Header: http.Header{}}
+	_, err = rule.Execute(map[string]interface{}{"request": request})
+	assert.Nil(t, err)
+	assert.Len(t, request.Header, 2)
+
+	// a file included twice runs twice, but defines its functions once
+	rule, err = engine.Compile("include", []byte(`
+		include "shared/a.rule"
+		include "shared/b.rule"
+		mark("main")
+	`))
+	assert.Nil(t, err)
+	request = &http.Request{Header: http.Header{"X-Mark": {"start"}}}
+	_, err = rule.Execute(map[string]interface{}{"request": request})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"start", "shared", "shared", "main"}, request.Header["X-Mark"])
+
+	// errors report the line in the included file
+	rule, err = engine.Compile("include", []byte(`
+		include "broken.rule"
+	`))
+	assert.Nil(t, err)
+	_, err = rule.Execute(map[string]interface{}{"request": &http.Request{}})
+	assert.EqualError(t, err, "error in file 'broken.rule': error modifing 'request.nothing' to '1' at line:3 error:modifyInterfaceStruct type 'nothing' has not been found in the resource 'http.Request'")
+
+	// cycles are detected
+	_, err = engine.Compile("include", []byte(`
+		include "cycle/a.rule"
+	`))
+	assert.EqualError(t, err, "error in file 'cycle/a.rule': error in file 'cycle/b.rule': include cycle 'cycle/a.rule' -> 'cycle/b.rule' -> 'cycle/a.rule' at line:1")
+
+	// includes require a filesystem
+	_, err = NewEngine().Compile("include", []byte(`
+		include "common/security.rule"
+	`))
+	assert.EqualError(t, err, "'include' of 'common/security.rule' at line:2 requires a filesystem, see WithFS")
+}
+
+func TestTryCatch(t *testing.T) {
+	sink := &testSink{}
+	rule, err := NewEngine(WithLogSink(sink)).Compile("try", []byte(`
+		export var steps ""
+		try {
+			request.header.x-a = "1"
+			request.nothing = "1"
+			request.header.x-b = "1"
+		} catch err {
+			log.error "$(err.line): $(err.message)"
+		}
+
+		request.url.path replace_regex "(" "" on_error continue
+		steps = "after continue"
+
+		if 1 == 1 {
+			on_error skip_block
+			request.nothing = "1"
+			steps = "not reached"
+		}
+	`))
+	assert.Nil(t, err)
+	result, err := rule.Execute(map[string]interface{}{
+		"request": &http.Request{URL: &url.URL{Path: "/"}, Header: http.Header{}},
+	})
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, "after continue", result.Outputs["steps"])
+	}
+	assert.Len(t, sink.entries, 3)
+	if len(sink.entries) == 3 {
+		assert.Equal(t, "5: error modifing 'request.nothing' to '1' at line:5 error:modifyInterfaceStruct type 'nothing' has not been found in the resource 'http.Request'", sink.entries[0].Message)
+		assert.Equal(t, "error ignored by on_error", sink.entries[1].Message)
+		assert.Equal(t, 11, sink.entries[1].Line)
+	}
+
+	// fail can not be caught
+	rule, err = NewEngine().Compile("try", []byte(`
+		try {
+			fail "stop here"
+		} catch {
+		}
+	`))
+	assert.Nil(t, err)
+	_, err = rule.Execute(map[string]interface{}{})
+	assert.EqualError(t, err, "script 'try' failed at line:3: stop here")
+}
+
+func TestForeachLimit(t *testing.T) {
+	rule, err := NewEngine(WithMaxIterations(2)).Compile("limit", []byte(`
+		foreach key, value in request.header {
+			log.debug "$(key)"
+		}
+	`))
+	assert.Nil(t, err)
+	_, err = rule.Execute(map[string]interface{}{
+		"request": &http.Request{Header: http.Header{"A": {"1"}, "B": {"2"}, "C": {"3"}}},
+	})
+	assert.EqualError(t, err, "foreach at line:2 exceeded the maximum of 2 iterations")
+
+	_, err = NewEngine().Compile("limit", []byte(`
+		break
+	`))
+	assert.EqualError(t, err, "'break' outside of 'foreach' at line:2")
+}
+
+func TestStrings(t *testing.T) {
+	script := `
+		export var escaped "tab\there\nline \"quoted\" café \\ \x41 \d"
+		export var raw ` + "`^/api/(v\\d+)/\\n$`" + `
+		export var body <<END
+		  <h1>$(request.host)</h1>
+		    <p>back soon</p>
+		  END
+		request.nothing = 1
+	`
+	rule, err := NewEngine().Compile("strings", []byte(script))
+	assert.Nil(t, err)
+	result, err := rule.Execute(map[string]interface{}{
+		"request": &http.Request{Host: "www.example.com"},
+	})
+	assert.EqualError(t, err, "error modifing 'request.nothing' to '1' at line:8 error:modifyInterfaceStruct type 'nothing' has not been found in the resource 'http.Request'")
+
+	rule, err = NewEngine().Compile("strings", []byte(strings.Replace(script, "request.nothing = 1", "", 1)))
+	assert.Nil(t, err)
+	result, err = rule.Execute(map[string]interface{}{
+		"request": &http.Request{Host: "www.example.com"},
+	})
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, "tab\there\nline \"quoted\" café \\ A \\d", result.Outputs["escaped"])
+		assert.Equal(t, `^/api/(v\d+)/\n$`, result.Outputs["raw"])
+		assert.Equal(t, "<h1>www.example.com</h1>\n  <p>back soon</p>", result.Outputs["body"])
+	}
+
+	_, err = NewEngine().Compile("strings", []byte(`
+		var bad "\u00zz"
+	`))
+	assert.EqualError(t, err, `could not parse script at line:2 error:invalid escape '\u00zz' in string started at line:2`)
+
+	_, err = NewEngine().Compile("strings", []byte(`
+		var body <<END
+		  never closed
+	`))
+	assert.EqualError(t, err, "could not parse script at line:4 error:heredoc '<<END' started at line:2 is not closed")
+}
+
+func TestReplaceRegex(t *testing.T) {
+	rule, err := NewEngine().Compile("replace", []byte(`
+		var prefix = "a"
+		var to = "zz"
+		request.header.x-a replace_regex "^$(prefix)" "$(to)"
+		request.url.path replace_regex "^/(\\w+)/" "/$(to)-$1/"
+	`))
+	assert.Nil(t, err)
+	req := &http.Request{URL: &url.URL{Path: "/old/x"}, Header: http.Header{"X-A": {"aa", "ab", "b"}}}
+	_, err = rule.Execute(map[string]interface{}{"request": req})
+	assert.Nil(t, err)
+	// every value is replaced, and the arguments are interpolated
+	assert.Equal(t, []string{"zza", "zzb", "b"}, req.Header["X-A"])
+	assert.Equal(t, "/zz-old/x", req.URL.Path)
+
+	// values that are not text can not be replaced
+	rule, err = NewEngine().Compile("replace", []byte(`
+		request.contentlength replace_regex "1" "2"
+	`))
+	assert.Nil(t, err)
+	_, err = rule.Execute(map[string]interface{}{"request": &http.Request{ContentLength: 10}})
+	assert.EqualError(t, err, "replace_regex get failed 'request.contentlength' at line:2 error:values of type 'int64' can not be replaced")
+}
+
+func TestInterpolation(t *testing.T) {
+	sink := &testSink{}
+	rule, err := NewEngine(WithLogSink(sink)).Compile("interpolation", []byte(`
+		func double(n) {
+			return $(n) * 2
+		}
+		export var tenant = "$(request.header.x-tenant:-default)"
+		export var empty = "$(request.url.path:-/index.html)"
+		export var host = "$(request.host | trimsuffix ".example.com" | upper)"
+		export var query = "q=$(request.header.x-search | trim | urlencode)"
+		export var literal = "$$(request.host) costs $${ 1 + 1 }"
+		export var nested = "${ double(21) + 1 }"
+		export var fallback = "$(request.header.x-user:-$(request.host | lower))"
+		log "host" tenant=$(tenant:-none) size=$(request.host | length)
+	`))
+	assert.Nil(t, err)
+	result, err := rule.Execute(map[string]interface{}{
+		"request": &http.Request{
+			Host:   "WWW.example.com",
+			URL:    &url.URL{},
+			Header: http.Header{"X-Search": {" a&b "}},
+		},
+	})
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, "default", result.Outputs["tenant"])
+		assert.Equal(t, "/index.html", result.Outputs["empty"])
+		assert.Equal(t, "WWW", result.Outputs["host"])
+		assert.Equal(t, "q=a%26b", result.Outputs["query"])
+		assert.Equal(t, "$(request.host) costs ${ 1 + 1 }", result.Outputs["literal"])
+		assert.Equal(t, "43", result.Outputs["nested"])
+		assert.Equal(t, "www.example.com", result.Outputs["fallback"])
+	}
+	assert.Len(t, sink.entries, 1)
+	if len(sink.entries) == 1 {
+		assert.Equal(t, []LogField{{Key: "tenant", Value: "default"}, {Key: "size", Value: "15"}}, sink.entries[0].Fields)
+	}
+
+	_, err = NewEngine().Compile("interpolation", []byte(`
+		log "$(request.host | reverse)"
+	`))
+	assert.EqualError(t, err, "invalid template '$(request.host | reverse)' at line:2 error:unknown filter 'reverse' in '$(request.host | reverse)'")
+
+	_, err = NewEngine().Compile("interpolation", []byte(`
+		var total = "${ undefined(1) }"
+	`))
+	assert.EqualError(t, err, "undefined function 'undefined' at line:2")
+}
+
+func TestMultipleValues(t *testing.T) {
+	rule, err := NewEngine().Compile("values", []byte(`
+		export var internal = false
+		export var trusted = false
+		if any request.header.x-forwarded-for match_net "10.0.0.0/8" {
+			internal = true
+		}
+		if all $(request.header.x-forwarded-for) match_net "10.0.0.0/8" {
+			trusted = true
+		}
+		export var accept = "$(request.header.accept | lower | join ",")"
+		export var hops = count(request.header.x-forwarded-for)
+		export var missing = count(request.header.x-missing)
+		add request.header.x-forwarded-for "10.0.0.9"
+		set request.header.accept "*/*"
+		add request.header.via "proxy"
+	`))
+	assert.Nil(t, err)
+	req := &http.Request{Header: http.Header{
+		"X-Forwarded-For": {"192.168.1.1", "10.1.2.3"},
+		"Accept":          {"TEXT/HTML", "Application/JSON"},
+	}}
+	result, err := rule.Execute(map[string]interface{}{"request": req})
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, "true", result.Outputs["internal"])
+		assert.Equal(t, "false", result.Outputs["trusted"])
+		assert.Equal(t, "text/html,application/json", result.Outputs["accept"])
+		assert.Equal(t, 2, result.Outputs["hops"])
+		assert.Equal(t, 0, result.Outputs["missing"])
+	}
+	assert.Equal(t, []string{"192.168.1.1", "10.1.2.3", "10.0.0.9"}, req.Header["X-Forwarded-For"])
+	assert.Equal(t, []string{"*/*"}, req.Header["Accept"])
+	via, err := getInterface(defaultEngine, req.Header, []string{"via"})
+	assert.Nil(t, err)
+	assert.Equal(t, "proxy", via)
+
+	// a field with multiple values needs an index or a filter, with or without a fallback
+	req = &http.Request{Header: http.Header{"X-Forwarded-For": {"192.168.1.1", "10.1.2.3"}, "X-Single": {"one"}}}
+	for script, expected := range map[string]interface{}{
+		`$(request.header.x-single)`:                   "one",
+		`$(request.header.x-forwarded-for.1)`:          "10.1.2.3",
+		`$(request.header.x-forwarded-for | first)`:    "192.168.1.1",
+		`$(request.header.x-forwarded-for | join ",")`: "192.168.1.1,10.1.2.3",
+		`$(request.header.x-forwarded-for)`:            "error translating variable 'request.header.x-forwarded-for of resource 'request': getInterfaceSlice resource '[]string' has 2 values, pick one with an index or a filter like first or join",
+		`$(request.header.x-forwarded-for:-none)`:      "error translating variable 'request.header.x-forwarded-for of resource 'request': getInterfaceSlice resource '[]string' has 2 values, pick one with an index or a filter like first or join",
+		// filters that change each value do not pick one
+		`$(request.header.x-forwarded-for | trim)`:          "error translating variable 'request.header.x-forwarded-for': the filters leave 2 values, pick one with an index or a filter like first or join",
+		`$(request.header.x-forwarded-for | trim | last)`:   "10.1.2.3",
+		`$(request.header.x-forwarded-for | first | lower)`: "192.168.1.1",
+		`$(request.header.x-single | lower)`:                "one",
+		// a missing value is an error unless there is a fallback, with or without filters
+		`$(request.header.x-missing)`:               "error translating variable 'request.header.x-missing of resource 'request': getInterfaceMap type 'x-missing' has not been found in the resource 'string'",
+		`$(request.header.x-missing | lower)`:       "error translating variable 'request.header.x-missing of resource 'request': getInterfaceMap type 'x-missing' has not been found in the resource 'string'",
+		`$(request.header.x-missing:-none)`:         "none",
+		`$(request.header.x-missing:-NONE | lower)`: "none",
+	} {
+		rule, err = NewEngine().Compile("values", []byte(`export var value = "`+script+`"`))
+		assert.Nil(t, err, script)
+		result, err = rule.Execute(map[string]interface{}{"request": req})
+		if err != nil {
+			assert.Equal(t, expected, strings.TrimPrefix(err.Error(), "error parsing value to 'var' at line:1 error:"), script)
+			continue
+		}
+		assert.Equal(t, expected, result.Outputs["value"], script)
+	}
+
+	// add and set can still be used as variable names
+	rule, err = NewEngine().Compile("values", []byte(`
+		export var add = 1
+		add += 1
+	`))
+	assert.Nil(t, err)
+	result, err = rule.Execute(map[string]interface{}{})
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, 2, result.Outputs["add"])
+	}
+
+	_, err = NewEngine().Compile("values", []byte(`
+		func count(a) {
+		}
+	`))
+	assert.EqualError(t, err, "function 'count' at line:2 is already defined by the engine")
+}
+
+func TestQueryAndForm(t *testing.T) {
+	rule, err := NewEngine(WithBodyLimit(64)).Compile("query", []byte(`
+		export var page = $(request.query.page)
+		export var user = $(request.form.user)
+		request.query.page = $(page) + 1
+		add request.query.tag "new"
+		unset request.query.debug
+		request.query.lang = "en"
+		set request.form.user "admin"
+		add request.form.role "editor"
+	`))
+	assert.Nil(t, err)
+	req, _ := http.NewRequest("POST", "http://www.example.com/search?page=1&debug=true&tag=old", strings.NewReader("user=guest"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	result, err := rule.Execute(map[string]interface{}{"request": req})
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, "1", result.Outputs["page"])
+		assert.Equal(t, "guest", result.Outputs["user"])
+	}
+	assert.Equal(t, "lang=en&page=2&tag=old&tag=new", req.URL.RawQuery)
+	assert.Equal(t, url.Values{"user": {"admin"}, "role": {"editor"}}, req.PostForm)
+	assert.Equal(t, "admin", req.FormValue("user"))
+	assert.Equal(t, "2", req.FormValue("page"))
+
+	_, err = rule.Execute(map[string]interface{}{"request": &http.Request{Method: "POST"}})
+	assert.EqualError(t, err, "error translating variable 'request.query.page of resource 'request': getInterfaceMap type 'page' has not been found in the resource 'string'")
+
+	// the changed form is encoded in to the body that is forwarded
+	body, err := io.ReadAll(req.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "role=editor&user=admin", string(body))
+	assert.Equal(t, int64(len(body)), req.ContentLength)
+
+	// reading the form does not use up the body
+	rule, err = NewEngine(WithBodyLimit(64)).Compile("form", []byte(`
+		export var user = $(request.form.user)
+	`))
+	assert.Nil(t, err)
+	req, _ = http.NewRequest("POST", "http://www.example.com/login", strings.NewReader("user=bob&x=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	result, err = rule.Execute(map[string]interface{}{"request": req})
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, "bob", result.Outputs["user"])
+	}
+	body, err = io.ReadAll(req.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "user=bob&x=1", string(body))
+
+	// the form of a body can only be used if the body is buffered, so it is not used up or changed silently
+	rule, err = NewEngine().Compile("form", []byte(`
+		export var user = $(request.form.user)
+	`))
+	assert.Nil(t, err)
+	req, _ = http.NewRequest("POST", "http://www.example.com/login", strings.NewReader("user=bob&x=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = rule.Execute(map[string]interface{}{"request": req})
+	assert.EqualError(t, err, "error translating variable 'request.form.user of resource 'request': getInterfaceVirtual failed to get 'form': the form can only be used if the body is enabled with WithBodyLimit")
+	body, err = io.ReadAll(req.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "user=bob&x=1", string(body))
+
+	rule, err = NewEngine().Compile("form", []byte(`
+		request.form.user = "eve"
+	`))
+	assert.Nil(t, err)
+	req, _ = http.NewRequest("POST", "http://www.example.com/login", strings.NewReader("user=bob&x=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = rule.Execute(map[string]interface{}{"request": req})
+	assert.EqualError(t, err, "error modifing 'request.form.user' to 'eve' at line:2 error:modifyInterfaceVirtual failed to get 'form': the form can only be used if the body is enabled with WithBodyLimit")
+}
+
+func TestCookies(t *testing.T) {
+	rule, err := NewEngine().Compile("cookies", []byte(`
+		export var session = $(request.cookie.session)
+		export var secure = $(response.setcookie.session.secure)
+		unset request.cookie.tracking
+		request.cookie.lang = "nl"
+
+		response.setcookie.session.secure = true
+		response.setcookie.session.httponly = true
+		response.setcookie.session.samesite = "strict"
+		unset response.setcookie.tracking
+		response.setcookie.theme.value = "dark"
+		response.setcookie.theme.maxage = 3600
+	`))
+	assert.Nil(t, err)
+	req := &http.Request{Header: http.Header{"Cookie": {"session=abc; tracking=1"}}}
+	resp := &http.Response{Header: http.Header{"Set-Cookie": {
+		"session=abc; Path=/",
+		"tracking=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT",
+	}}}
+	result, err := rule.Execute(map[string]interface{}{"request": req, "response": resp})
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, "abc", result.Outputs["session"])
+		assert.Equal(t, "false", result.Outputs["secure"])
+	}
+	assert.Equal(t, []string{"session=abc; lang=nl"}, req.Header["Cookie"])
+	assert.Equal(t, []string{
+		"session=abc; Path=/; HttpOnly; Secure; SameSite=Strict",
+		"theme=dark; Max-Age=3600",
+	}, resp.Header["Set-Cookie"])
+
+	rule, err = NewEngine().Compile("cookies", []byte(`
+		response.setcookie.session.samesite = "sometimes"
+	`))
+	assert.Nil(t, err)
+	_, err = rule.Execute(map[string]interface{}{"response": &http.Response{}})
+	assert.EqualError(t, err, "error modifing 'response.setcookie.session.samesite' to 'sometimes' at line:2 error:invalid samesite 'sometimes' of cookie 'session'")
+
+	// only the changed cookie is written, the other headers and unknown attributes are kept as they are
+	rule, err = NewEngine().Compile("cookies", []byte(`
+		export var path = $(response.setcookie.a.path)
+		response.setcookie.b.secure = true
+		request.cookie.b = "4"
+	`))
+	assert.Nil(t, err)
+	req = &http.Request{Header: http.Header{"Cookie": {"c=1; b=2; a=3"}}}
+	resp = &http.Response{Header: http.Header{"Set-Cookie": {
+		"a=1; Path=/",
+		"a=2; Path=/admin",
+		"b=3; Partitioned; Priority=High",
+	}}}
+	result, err = rule.Execute(map[string]interface{}{"request": req, "response": resp})
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, "/admin", result.Outputs["path"])
+	}
+	assert.Equal(t, []string{"c=1; b=4; a=3"}, req.Header["Cookie"])
+	assert.Equal(t, []string{
+		"a=1; Path=/",
+		"a=2; Path=/admin",
+		"b=3; Secure; Partitioned; Priority=High",
+	}, resp.Header["Set-Cookie"])
+
+	// unset removes all the headers of a cookie
+	rule, err = NewEngine().Compile("cookies", []byte(`
+		unset response.setcookie.a
+	`))
+	assert.Nil(t, err)
+	_, err = rule.Execute(map[string]interface{}{"response": resp})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b=3; Secure; Partitioned; Priority=High"}, resp.Header["Set-Cookie"])
+}
+
+func TestBody(t *testing.T) {
+	engine := NewEngine(WithBodyLimit(64))
+	rule, err := engine.Compile("body", []byte(`
+		export var id = $(request.json.user.id)
+		if $(request.json.user.admin) == true {
+			request.json.user.role = "admin"
+		}
+		unset request.json.debug
+		request.json.trace.id = "abc"
+		response.body = "hello $(request.json.user.role)"
+	`))
+	assert.Nil(t, err)
+	req := &http.Request{
+		Header:        http.Header{"Content-Length": {"50"}},
+		Body:          io.NopCloser(strings.NewReader(`{"user":{"id":42,"admin":true},"debug":"yes"}`)),
+		ContentLength: 50,
+	}
+	resp := &http.Response{Header: http.Header{}}
+	result, err := rule.Execute(map[string]interface{}{"request": req, "response": resp})
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, "42", result.Outputs["id"])
+	}
+	body, _ := io.ReadAll(req.Body)
+	assert.Equal(t, `{"trace":{"id":"abc"},"user":{"admin":true,"id":42,"role":"admin"}}`, string(body))
+	assert.Equal(t, int64(len(body)), req.ContentLength)
+	assert.Equal(t, strconv.Itoa(len(body)), req.Header.Get("Content-Length"))
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, "hello admin", string(body))
+
+	// bodies larger than the limit are not read, and handed back unchanged
+	large := strings.Repeat("x", 100)
+	req = &http.Request{Body: io.NopCloser(strings.NewReader(large))}
+	_, err = rule.Execute(map[string]interface{}{"request": req, "response": &http.Response{}})
+	assert.EqualError(t, err, "error translating variable 'request.json.user.id of resource 'request': getInterfaceVirtual failed to get 'json': the body is larger than the limit of 64 bytes")
+	body, _ = io.ReadAll(req.Body)
+	assert.Equal(t, large, string(body))
+
+	// the body can only be used if it is enabled
+	rule, err = NewEngine().Compile("body", []byte(`
+		request.body = "hello"
+	`))
+	assert.Nil(t, err)
+	_, err = rule.Execute(map[string]interface{}{"request": &http.Request{}})
+	assert.EqualError(t, err, "error modifing 'request.body' to 'hello' at line:2 error:modifyInterfaceVirtual failed to get 'body': the body can only be used if it is enabled with WithBodyLimit")
+
+	// keys match without case for writes too, like they do for reads
+	rule, err = engine.Compile("body", []byte(`
+		export var id = $(request.json.user.id)
+		request.json.user.id = 2
+		unset request.json.debug
+		request.json.Trace = "abc"
+	`))
+	assert.Nil(t, err)
+	req = &http.Request{Body: io.NopCloser(strings.NewReader(`{"User":{"ID":1},"DEBUG":"yes"}`))}
+	result, err = rule.Execute(map[string]interface{}{"request": req})
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, "1", result.Outputs["id"])
+	}
+	body, _ = io.ReadAll(req.Body)
+	assert.Equal(t, `{"Trace":"abc","User":{"ID":2}}`, string(body))
+}
+
+func TestClientIP(t *testing.T) {
+	engine := NewEngine(WithTrustedProxies("10.0.0.0/8", "::1"))
+	rule, err := engine.Compile("clientip", []byte(`
+		export var ip = $(request.clientip)
+		export var internal = false
+		if $(request.clientip) match_net "192.168.0.0/16" {
+			internal = true
+		}
+	`))
+	assert.Nil(t, err)
+	for id, test := range []struct {
+		remote, forwarded, xff string
+		ip, internal           string
+	}{
+		{remote: "192.168.1.1:443", ip: "192.168.1.1", internal: "true"},
+		{remote: "[2001:db8::1]:443", ip: "2001:db8::1", internal: "false"},
+		// forwarded headers of an untrusted client are ignored
+		{remote: "1.2.3.4:443", xff: "192.168.1.1", ip: "1.2.3.4", internal: "false"},
+		{remote: "10.0.0.1:443", xff: "192.168.1.1, 1.2.3.4, 10.0.0.2", ip: "1.2.3.4", internal: "false"},
+		{remote: "[::1]:443", xff: "10.1.1.1, 10.0.0.2", ip: "10.1.1.1", internal: "false"},
+		{remote: "10.0.0.1:443", forwarded: `for="[2001:db8::2]:1234";proto=https, for=10.0.0.2`, xff: "1.2.3.4", ip: "2001:db8::2", internal: "false"},
+		{remote: "10.0.0.1:443", xff: "192.168.1.1, unknown", ip: "10.0.0.1", internal: "false"},
+	} {
+		req := &http.Request{RemoteAddr: test.remote, Header: http.Header{}}
+		if test.forwarded != "" {
+			req.Header.Set("Forwarded", test.forwarded)
+		}
+		if test.xff != "" {
+			req.Header.Set("X-Forwarded-For", test.xff)
+		}
+		result, err := rule.Execute(map[string]interface{}{"request": req})
+		assert.Nil(t, err, "test %d", id)
+		if err == nil {
+			assert.Equal(t, test.ip, result.Outputs["ip"], "test %d", id)
+			assert.Equal(t, test.internal, result.Outputs["internal"], "test %d", id)
+		}
+	}
+
+	// engines with other trusted proxies can run on the same request at the same time
+	untrusted, err := NewEngine().Compile("clientip", []byte(`
+		export var ip = $(request.clientip)
+	`))
+	assert.Nil(t, err)
+	req := &http.Request{RemoteAddr: "10.0.0.1:443", Header: http.Header{"X-Forwarded-For": {"1.2.3.4"}}}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			result, err := rule.Execute(map[string]interface{}{"request": req})
+			assert.Nil(t, err)
+			if err == nil {
+				assert.Equal(t, "1.2.3.4", result.Outputs["ip"])
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			result, err := untrusted.Execute(map[string]interface{}{"request": req})
+			assert.Nil(t, err)
+			if err == nil {
+				assert.Equal(t, "10.0.0.1", result.Outputs["ip"])
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the trusted proxies are also used for requests that are not a resource themselves
+	rule, err = engine.Compile("clientip", []byte(`
+		export var ip = $(response.request.clientip)
+	`))
+	assert.Nil(t, err)
+	result, err := rule.Execute(map[string]interface{}{"response": &http.Response{Request: req}})
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, "1.2.3.4", result.Outputs["ip"])
+	}
+
+	_, err = NewEngine(WithTrustedProxies("10.0.0.0/33")).Compile("clientip", []byte(``))
+	assert.EqualError(t, err, "invalid trusted proxy '10.0.0.0/33': invalid CIDR address: 10.0.0.0/33")
+}
+
+func TestIPSet(t *testing.T) {
+	engine := NewEngine()
+	err := engine.LoadIPSet("blocklist", strings.NewReader(`
+		# blocked networks
+		192.0.2.0/24
+		198.51.100.7
+		203.0.113.10 - 203.0.113.20
+		2001:db8:bad::/48
+	`))
+	assert.Nil(t, err)
+	rule, err := engine.Compile("ipset", []byte(`
+		export var blocked = false
+		if $(request.clientip) in_ipset "blocklist" {
+			blocked = true
+		}
+	`))
+	assert.Nil(t, err)
+	for ip, blocked := range map[string]string{
+		"192.0.2.55":         "true",
+		"192.0.3.1":          "false",
+		"198.51.100.7":       "true",
+		"198.51.100.8":       "false",
+		"203.0.113.9":        "false",
+		"203.0.113.10":       "true",
+		"203.0.113.16":       "true",
+		"203.0.113.20":       "true",
+		"203.0.113.21":       "false",
+		"[2001:db8:bad::1]":  "true",
+		"[2001:db8:bae::1]":  "false",
+		"[::ffff:192.0.2.1]": "true",
+	} {
+		result, err := rule.Execute(map[string]interface{}{"request": &http.Request{RemoteAddr: ip + ":1234"}})
+		assert.Nil(t, err, ip)
+		if err == nil {
+			assert.Equal(t, blocked, result.Outputs["blocked"], ip)
+		}
+	}
+
+	// reloading replaces the set
+	err = engine.LoadIPSet("blocklist", strings.NewReader("10.0.0.0/8"))
+	assert.Nil(t, err)
+	result, err := rule.Execute(map[string]interface{}{"request": &http.Request{RemoteAddr: "192.0.2.55:1234"}})
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, "false", result.Outputs["blocked"])
+	}
+
+	err = engine.LoadIPSet("blocklist", strings.NewReader("10.0.0.0/8\n10.0.0.20 - 10.0.0.1"))
+	assert.EqualError(t, err, "invalid entry '10.0.0.20 - 10.0.0.1' at line:2 of ipset 'blocklist' error:invalid range, the start is after the end")
+
+	rule, err = NewEngine().Compile("ipset", []byte(`
+		if "10.0.0.1" in_ipset "unknown" {
+			stop
+		}
+	`))
+	assert.Nil(t, err)
+	_, err = rule.Execute(map[string]interface{}{})
+	assert.EqualError(t, err, "failed to validate 'if' at line:2 error:unknown ipset 'unknown'")
+}
+
+func TestTables(t *testing.T) {
+	engine := NewEngine()
+	err := engine.LoadTableCSV("backends", TableWildcard, strings.NewReader(`# host, backend
+example.com, main
+*.example.com, web
+*.api.example.com, api
+`))
+	assert.Nil(t, err)
+	err = engine.LoadTableJSON("tenants", TablePrefix, strings.NewReader(`{"/acme/": "acme", "/acme/beta/": "acme-beta", "/": "public"}`))
+	assert.Nil(t, err)
+	engine.LoadTable("allowlist", TableExact, map[string]string{"GET": "", "HEAD": ""})
+
+	rule, err := engine.Compile("tables", []byte(`
+		export var backend = lookup("backends", $(request.host), "default")
+		export var tenant = lookup("tenants", $(request.url.path), "none")
+		export var allowed = false
+		if $(request.method) in_table "allowlist" {
+			allowed = true
+		}
+	`))
+	assert.Nil(t, err)
+	for id, test := range []struct {
+		host, path, method       string
+		backend, tenant, allowed string
+	}{
+		{host: "example.com", path: "/acme/x", method: "GET", backend: "main", tenant: "acme", allowed: "true"},
+		{host: "www.example.com", path: "/acme/beta/x", method: "POST", backend: "web", tenant: "acme-beta", allowed: "false"},
+		{host: "v1.api.example.com", path: "/other", method: "HEAD", backend: "api", tenant: "public", allowed: "true"},
+		{host: "example.org", path: "", method: "get", backend: "default", tenant: "none", allowed: "false"},
+	} {
+		req := &http.Request{Host: test.host, Method: test.method, URL: &url.URL{Path: test.path}}
+		result, err := rule.Execute(map[string]interface{}{"request": req})
+		assert.Nil(t, err, "test %d", id)
+		if err == nil {
+			assert.Equal(t, test.backend, result.Outputs["backend"], "test %d", id)
+			assert.Equal(t, test.tenant, result.Outputs["tenant"], "test %d", id)
+			assert.Equal(t, test.allowed, result.Outputs["allowed"], "test %d", id)
+		}
+	}
+
+	// loading a table again replaces it
+	engine.LoadTable("backends", TableExact, map[string]string{"www.example.com": "new"})
+	result, err := rule.Execute(map[string]interface{}{"request": &http.Request{Host: "www.example.com", URL: &url.URL{}}})
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, "new", result.Outputs["backend"])
+	}
+
+	err = engine.LoadTableCSV("broken", TableExact, strings.NewReader("a,b\nc,d,e\n"))
+	assert.EqualError(t, err, "invalid record at line:2 of table 'broken', expected a key and a value but got 3 fields")
+	err = engine.LoadTableJSON("broken", TableExact, strings.NewReader(`{"a": {"b": "c"}}`))
+	assert.EqualError(t, err, "invalid value of key 'a' of table 'broken', expected a string, number or boolean but got a json object")
+
+	rule, err = NewEngine().Compile("tables", []byte(`
+		export var x = lookup("unknown", "a", "b")
+	`))
+	assert.Nil(t, err)
+	_, err = rule.Execute(map[string]interface{}{})
+	assert.EqualError(t, err, "error calling 'lookup' at line:2 error:unknown table 'unknown'")
+}
+
+func TestMatchers(t *testing.T) {
+	for _, test := range []struct {
+		validator, pattern, value string
+		match                     bool
+	}{
+		{"match_glob", "/static/*.js", "/static/app.js", true},
+		{"match_glob", "/static/*.js", "/static/js/app.js", false},
+		{"match_glob", "/static/**/*.js", "/static/app.js", true},
+		{"match_glob", "/static/**/*.js", "/static/js/vendor/app.js", true},
+		{"match_glob", "/static/**", "/static/js/app.css", true},
+		{"match_glob", "/v?/users", "/v2/users", true},
+		{"match_glob", "/v?/users", "/v10/users", false},
+		{"match_glob", "/v[12]/users", "/v2/users", true},
+		{"match_glob", "/v[!12]/users", "/v2/users", false},
+		{"match_glob", "/v[a-z]/users", "/vb/users", true},
+		{"match_glob", "/file.(1)", "/file.(1)", true},
+		{"match_host", "*.example.com", "www.example.com", true},
+		{"match_host", "*.example.com", "WWW.Example.com.", true},
+		{"match_host", "*.example.com", "www.example.com:8080", true},
+		{"match_host", "*.example.com", "example.com", false},
+		{"match_host", "*.example.com", "a.b.example.com", false},
+		{"match_host", "**.example.com", "a.b.example.com", true},
+		{"match_host", "api-*.example.com", "api-eu.example.com", true},
+		{"match_host", "api-*.example.com", "web.example.com", false},
+		{"match_host", "example.com", "exampleXcom", false},
+		{"contains", "/admin", "/api/admin/users", true},
+		{"contains", "/admin", "/api/Admin/users", false},
+		{"contains", "", "/api", true},
+		{"contains", "34", "12345", true},
+		{"has_prefix", "static.", "static.example.com", true},
+		{"has_prefix", "static.", "www.static.example.com", false},
+		{"has_prefix", "static.", "Static.example.com", false},
+		{"has_prefix", "12", "12345", true},
+		{"has_prefix", "12345", "12", false},
+	} {
+		rule, err := NewEngine().Compile("matchers", []byte(fmt.Sprintf(`
+			param value string
+			export var matched = false
+			if $(value) %s "%s" {
+				matched = true
+			}
+		`, test.validator, test.pattern)))
+		assert.Nil(t, err)
+		result, err := rule.Execute(map[string]interface{}{}, WithParams(map[string]interface{}{"value": test.value}))
+		assert.Nil(t, err)
+		if err == nil {
+			assert.Equal(t, fmt.Sprint(test.match), result.Outputs["matched"], "%s %s %s", test.value, test.validator, test.pattern)
+		}
+	}
+
+	// constant patterns are compiled with the script
+	_, err := NewEngine().Compile("matchers", []byte(`
+		if $(request.host) match_regex "(" {
+			stop
+		}
+	`))
+	assert.EqualError(t, err, "invalid pattern '(' to 'match_regex' at line:2 error:error parsing regexp: missing closing ): `(`")
+	_, err = NewEngine().Compile("matchers", []byte(`
+		switch $(request.url.path) {
+		case match_glob "/static/[a-z" {
+			stop
+		}
+		}
+	`))
+	assert.EqualError(t, err, "invalid pattern '/static/[a-z' to 'match_glob' at line:3 error:'[' at position 8 is not closed")
+}
+
+func TestDispatch(t *testing.T) {
+	rule, err := NewEngine().Compile("dispatch", []byte(`
+		param host string
+		export var backend = "none"
+		if $(host) == "a.example.com" {
+			backend = "a"
+		} elseif $(host) contains "admin" {
+			backend = "admin"
+		} elseif $(host) has_prefix "api." {
+			backend = "api"
+		} elseif $(host) == "api.example.com" {
+			backend = "never"
+		} elseif $(host) has_prefix "api.v2." {
+			backend = "never"
+		} elseif $(host) contains "example" {
+			backend = "example"
+		} elseif $(host) == "10" {
+			backend = "ten"
+		} else {
+			backend = "other"
+		}
+
+		export var kind = "none"
+		switch $(host) {
+		case "a.example.com", "b.example.com" {
+			kind = "ab"
+		}
+		case has_prefix "api." {
+			kind = "api"
+		}
+		case contains "example", "test" {
+			kind = "example"
+		}
+		case match_regex "^[0-9]+$" {
+			kind = "number"
+		}
+		}
+	`))
+	assert.Nil(t, err)
+	if err != nil {
+		return
+	}
+	// the chain and the first 3 cases are dispatched, the regex is not
+	st := rule.program.body[len(rule.program.body)-3].(*ifStatement)
+	assert.Equal(t, 1, len(st.dispatch))
+	sw := rule.program.body[len(rule.program.body)-1].(*switchStatement)
+	assert.Equal(t, 1, len(sw.dispatch))
+
+	for host, expected := range map[string][2]string{
+		"a.example.com":     {"a", "ab"},
+		"b.example.com":     {"example", "ab"},
+		"admin.example.com": {"admin", "example"},
+		"api.example.com":   {"api", "api"},
+		"api.v2.admin.com":  {"admin", "api"},
+		"www.test.com":      {"other", "example"},
+		"":                  {"other", "none"},
+	} {
+		result, err := rule.Execute(map[string]interface{}{}, WithParams(map[string]interface{}{"host": host}))
+		assert.Nil(t, err, host)
+		if err == nil {
+			assert.Equal(t, expected[0], result.Outputs["backend"], host)
+			assert.Equal(t, expected[1], result.Outputs["kind"], host)
+		}
+	}
+
+	// numbers are compared by value, so they are tested one by one like without a dispatch
+	_, err = rule.Execute(map[string]interface{}{}, WithParams(map[string]interface{}{"host": "010"}))
+	assert.EqualError(t, err, "failed to validate 'if' at line:4 error:cannot compare string with number")
+}
+
+func TestOptimize(t *testing.T) {
+	script := []byte(`
+		param host string
+		const env = "prod"
+		var limit = 10
+		export var backend = "none"
+		export var mode = "none"
+		export var total = "${ 1 + 2 }"
+		if $(env) == "test" {
+			backend = "test"
+		} elseif $(env) == "prod" {
+			backend = "prod"
+		} else {
+			backend = "other"
+		}
+		if $(host) == "a.example.com" {
+			mode = "a"
+			stop
+			mode = "never"
+			backend = "never"
+		}
+		require $(limit) > 5 "limit too low"
+		switch $(env) {
+		case "test" {
+			mode = "test"
+		}
+		case "prod" {
+			mode = $(limit) > 5 ? "large" : "small"
+		}
+		}
+	`)
+	rule, err := NewEngine().Compile("optimize", script)
+	assert.Nil(t, err)
+	if err != nil {
+		return
+	}
+	assert.Equal(t, strings.Join([]string{
+		"line:7 interpolated '${ 1 + 2 }' to '3'",
+		"line:8 interpolated '$(env)' to 'prod'",
+		"line:8 removed 'if', the condition is never true",
+		"line:10 interpolated '$(env)' to 'prod'",
+		"line:10 removed the branches after 'elseif', the condition is always true",
+		"line:18 removed 2 statements that never run after line:17",
+		"line:21 interpolated '$(limit)' to '10'",
+		"line:21 removed 'require', the condition is always true",
+		"line:22 interpolated '$(env)' to 'prod'",
+		"line:22 removed 'switch', the case at line:26 always runs",
+		"line:27 interpolated '$(limit)' to '10'",
+		"line:27 removed a value of '?', the condition is always true",
+	}, "\n"), rule.Dump())
+
+	// the optimized script behaves like the script without optimization
+	plain, err := NewEngine(WithoutOptimization()).Compile("optimize", script)
+	assert.Nil(t, err)
+	assert.Equal(t, "", plain.Dump())
+	for _, host := range []string{"a.example.com", "b.example.com"} {
+		expected, err := plain.Execute(map[string]interface{}{}, WithParams(map[string]interface{}{"host": host}))
+		assert.Nil(t, err, host)
+		result, err := rule.Execute(map[string]interface{}{}, WithParams(map[string]interface{}{"host": host}))
+		assert.Nil(t, err, host)
+		if err == nil {
+			assert.Equal(t, expected.Outputs, result.Outputs, host)
+		}
+	}
+
+	// code that is removed is not optimized, so only its removal is reported
+	rule, err = NewEngine().Compile("optimize", []byte(`
+		const env = "prod"
+		export var backend = "none"
+		if $(env) == "test" {
+			backend = "$(env)-${ 1 + 2 }"
+		}
+		switch $(env) {
+		case "test" {
+			backend = "$(env)"
+		}
+		case "prod" {
+			backend = "$(env)"
+		}
+		}
+	`))
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, strings.Join([]string{
+			"line:4 interpolated '$(env)' to 'prod'",
+			"line:4 removed 'if', the condition is never true",
+			"line:7 interpolated '$(env)' to 'prod'",
+			"line:7 removed 'switch', the case at line:11 always runs",
+			"line:12 interpolated '$(env)' to 'prod'",
+		}, "\n"), rule.Dump())
+	}
+
+	// variables that change are not constants
+	rule, err = NewEngine().Compile("optimize", []byte(`
+		param host string
+		var env = "prod"
+		export var backend = "none"
+		if $(host) == "test.example.com" {
+			env = "test"
+		}
+		if $(env) == "test" {
+			backend = "test"
+		}
+	`))
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, "", rule.Dump())
+		result, err := rule.Execute(map[string]interface{}{}, WithParams(map[string]interface{}{"host": "test.example.com"}))
+		assert.Nil(t, err)
+		assert.Equal(t, "test", result.Outputs["backend"])
+	}
+
+	// quoted strings stay text when they are folded
+	for _, engine := range []*Engine{NewEngine(), NewEngine(WithoutOptimization())} {
+		rule, err = engine.Compile("optimize", []byte(`
+			const count = "10"
+			export var joined = "$(count)" + "5"
+			export var sum = $(count) + 5
+			export var chained = "$(count)" + "5" + 1 + 2
+		`))
+		assert.Nil(t, err)
+		if err == nil {
+			result, err := rule.Execute(map[string]interface{}{})
+			assert.Nil(t, err)
+			assert.Equal(t, "105", result.Outputs["joined"])
+			assert.Equal(t, 15, result.Outputs["sum"])
+			assert.Equal(t, "10512", result.Outputs["chained"])
+		}
+	}
+}
+
+// BenchmarkDispatch shows the cost of a chain of tests on the same subject, which is the same for 10 or 1000 tests
+func BenchmarkDispatch(b *testing.B) {
+	for _, validator := range []string{"==", "has_prefix", "contains"} {
+		for _, n := range []int{10, 100, 1000} {
+			script := strings.Builder{}
+			script.WriteString("param host string\nexport var backend = \"none\"\n")
+			for i := 0; i < n; i++ {
+				if i > 0 {
+					script.WriteString(" else")
+				}
+				fmt.Fprintf(&script, "if $(host) %s \"host%d.example.com\" {\n  backend = \"%d\"\n}", validator, i, i)
+			}
+			rule, err := NewEngine().Compile("dispatch", []byte(script.String()))
+			if err != nil {
+				b.Fatal(err)
+			}
+			// the last test matches, the worst case when the tests are evaluated one by one
+			params := WithParams(map[string]interface{}{"host": fmt.Sprintf("host%d.example.com", n-1)})
+			b.Run(fmt.Sprintf("%s/%d", validator, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := rule.Execute(map[string]interface{}{}, params); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestScriptErrors(t *testing.T) {
+	for id, script := range scriptErrorTests {
+		t.Run(fmt.Sprintf("scriptErrorTests/%d", id), func(t *testing.T) {
+			rule, err := NewEngine().Compile("test", script.script)
+			if err == nil {
+				_, err = rule.Execute(script.interfaces)
+			}
+			assert.EqualError(t, err, script.err)
+		})
+	}
+}
+
+func TestParams(t *testing.T) {
+	rule, err := NewEngine().Compile("params", []byte(`
+		input request *http.Request; param tenant string = "default"
+		param limit int
+
+		export var testvalue "none"
+		if $(tenant) == "acme" {
+			if $(limit) >= 10 {
+				testvalue = "big"
+			}
+		}
+	`))
+	assert.Nil(t, err)
+
+	// parameters are passed by the caller
+	result, err := rule.Execute(map[string]interface{}{"request": &http.Request{}}, WithParams(map[string]interface{}{
+		"tenant": "acme",
+		"limit":  int64(12),
+	}))
+	assert.Nil(t, err)
+	if err == nil {
+		assert.Equal(t, "big", result.Outputs["testvalue"])
+	}
+
+	// missing input
+	_, err = rule.Execute(map[string]interface{}{"response": &http.Response{}}, WithParams(map[string]interface{}{"limit": 1}))
+	assert.EqualError(t, err, "missing input 'request' of type '*http.Request' declared at line:2")
+
+	// mistyped input
+	_, err = rule.Execute(map[string]interface{}{"request": http.Request{}}, WithParams(map[string]interface{}{"limit": 1}))
+	assert.EqualError(t, err, "input 'request' is of type 'http.Request', expected '*http.Request' declared at line:2")
+
+	// missing param without default
+	_, err = rule.Execute(map[string]interface{}{"request": &http.Request{}})
+	assert.EqualError(t, err, "missing param 'limit' of type 'int' declared at line:3")
+
+	// mistyped param
+	_, err = rule.Execute(map[string]interface{}{"request": &http.Request{}}, WithParams(map[string]interface{}{"limit": "10"}))
+	assert.EqualError(t, err, "param 'limit' is of type 'string', expected 'int' declared at line:3")
+
+	// unknown param
+	_, err = rule.Execute(map[string]interface{}{"request": &http.Request{}}, WithParams(map[string]interface{}{"limit": 1, "other": 1}))
+	assert.EqualError(t, err, "unknown param 'other', it is not declared by the script")
+
+	// declarations after statements
+	_, err = NewEngine().Compile("params", []byte(`
+		var x 1
+		param tenant string
+	`))
+	assert.EqualError(t, err, "'param' must be declared before any other statement at line:3")
+}
+
+func TestEarlyExit(t *testing.T) {
+	engine := NewEngine()
+	resources := func() map[string]interface{} {
+		return map[string]interface{}{
+			"request": &http.Request{Host: "blocked.com", Header: http.Header{}},
+		}
+	}
+
+	// stop ends the script successfully at any depth
+	rule, err := engine.Compile("stop", []byte(`
+		if $(request.host) == "blocked.com" {
+			if 1 == 1 {
+				request.header.x-blocked = "yes"
+				stop
+			}
+		}
+		request.header.x-passed = "yes"
+	`))
+	assert.Nil(t, err)
+	i := resources()
+	result, err := rule.Execute(i)
+	assert.Nil(t, err)
+	assert.True(t, result.Stopped)
+	blocked, err := getInterface(defaultEngine, i["request"], []string{"header", "x-blocked"})
+	assert.Nil(t, err)
+	assert.Equal(t, "yes", blocked)
+	assert.Len(t, i["request"].(*http.Request).Header, 1)
+
+	// return hands a value back to the caller
+	rule, err = engine.Compile("return", []byte(`
+		if $(request.host) == "blocked.com" {
+			return "deny $(request.host)"
+		}
+		return "allow"
+	`))
+	assert.Nil(t, err)
+	result, err = rule.Execute(resources())
+	assert.Nil(t, err)
+	assert.Equal(t, "deny blocked.com", result.Value)
+
+	// fail ends the script with an error the caller can detect
+	rule, err = engine.Compile("fail", []byte(`
+		if $(request.host) == "blocked.com" {
+			fail "host $(request.host) is blocked"
+		}
+	`))
+	assert.Nil(t, err)
+	_, err = rule.Execute(resources())
+	var failErr *FailError
+	assert.ErrorAs(t, err, &failErr)
+	assert.EqualError(t, err, "script 'fail' failed at line:3: host blocked.com is blocked")
+}
+
+func TestOutcome(t *testing.T) {
+	rule, err := NewEngine().Compile("outcome", []byte(`
+		tag "seen"
+		if $(request.url.path) == "/admin" {
+			tag "admin"
+			deny 403 "admin is not allowed from $(request.host)"
+		}
+		if $(request.url.path) == "/account" {
+			redirect "/login?next=$(request.url.path)"
+		}
+		if $(request.url.path) == "/health" {
+			respond 200 "OK"
+		}
+		tag "passed"
+	`))
+	assert.Nil(t, err)
+
+	outcomes := map[string]Outcome{
+		"/admin":   Outcome{Action: ActionDeny, Status: 403, Reason: "admin is not allowed from example.com", Tags: []string{"seen", "admin"}, Line: 5},
+		"/account": Outcome{Action: ActionRedirect, Status: 302, Location: "/login?next=/account", Tags: []string{"seen"}, Line: 8},
+		"/health":  Outcome{Action: ActionRespond, Status: 200, Body: "OK", Tags: []string{"seen"}, Line: 11},
+		"/":        Outcome{Action: ActionNone, Tags: []string{"seen", "passed"}},
+	}
+	for path, expected := range outcomes {
+		result, err := rule.Execute(map[string]interface{}{
+			"request": &http.Request{Host: "example.com", URL: &url.URL{Path: path}},
+		})
+		assert.Nil(t, err)
+		if err == nil {
+			assert.Equal(t, expected, result.Outcome, path)
+		}
+	}
+
+	// status must be a valid http status
+	rule, err = NewEngine().Compile("outcome", []byte(`
+		deny 42 "nope"
+	`))
+	assert.Nil(t, err)
+	_, err = rule.Execute(map[string]interface{}{})
+	assert.EqualError(t, err, "invalid status '42' to 'deny' at line:2")
+}
+
+func TestEvaluate(t *testing.T) {
+	rule, err := NewEngine().Compile("policy", []byte(`
+		input config *url.URL
+		require $(config.scheme) == "https" "scheme must be https, got $(config.scheme)"
+		require $(config.host) match_regex "\.example\.com$" "host must be in example.com"
+		if $(config.path) != "" {
+			violation "path is not allowed"
+		}
+	`))
+	assert.Nil(t, err)
+
+	decision, err := rule.Evaluate(map[string]interface{}{
+		"config": &url.URL{Scheme: "https", Host: "www.example.com"},
+	})
+	assert.Nil(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Len(t, decision.Violations, 0)
+
+	decision, err = rule.Evaluate(map[string]interface{}{
+		"config": &url.URL{Scheme: "http", Host: "www.example.org", Path: "/x"},
+	})
+	assert.Nil(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, []Violation{
+		Violation{Message: "scheme must be https, got http", Script: "policy", Line: 3},
+		Violation{Message: "host must be in example.com", Script: "policy", Line: 4},
+		Violation{Message: "path is not allowed", Script: "policy", Line: 6},
+	}, decision.Violations)
 }
 
 func TestScript(t *testing.T) {
@@ -329,7 +1963,7 @@ func TestScript(t *testing.T) {
 	if err == nil {
 		for testVariable, expected := range result {
 			testTree := strings.Split(testVariable, ".")
-			returned, err := getInterface(i[testTree[0]], testTree[1:])
+			returned, err := getInterface(defaultEngine, i[testTree[0]], testTree[1:])
 			assert.Nil(t, err, fmt.Sprintf("script:%s getInterface of:%s returned error", script, testVariable))
 			assert.Equal(t, expected, returned, fmt.Sprintf("script:%s get result of:%s returned incorrect result, got: %+v", script, expected, returned))
 		}
@@ -338,11 +1972,23 @@ func TestScript(t *testing.T) {
 
 func runTestScript(t *testing.T, i map[string]interface{}, script []byte, result map[string]interface{}) {
 	//log.Printf("....... new test .......")
-	err := Parse(i, script)
+	rule, err := NewEngine().Compile("test", script)
+	assert.Nil(t, err, fmt.Sprintf("script:%s compile returned error", script))
+	if err != nil {
+		return
+	}
+	res, err := rule.Execute(i)
 	assert.Nil(t, err, fmt.Sprintf("script:%s execution returned error", script))
+	if err != nil {
+		return
+	}
 	for testVariable, expected := range result {
 		testTree := strings.Split(testVariable, ".")
-		returned, err := getInterface(i[testTree[0]], testTree[1:])
+		resource, ok := i[testTree[0]]
+		if !ok {
+			resource = res.Outputs[testTree[0]]
+		}
+		returned, err := getInterface(defaultEngine, resource, testTree[1:])
 		switch expected.(type) {
 		case error:
 			if err != nil {
@@ -357,3 +2003,36 @@ func runTestScript(t *testing.T, i map[string]interface{}, script []byte, result
 	}
 
 }
+
+type testSink struct {
+	entries []LogEntry
+}
+
+func (s *testSink) Log(entry LogEntry) {
+	s.entries = append(s.entries, entry)
+}
+
+func TestLog(t *testing.T) {
+	sink := &testSink{}
+	engine := NewEngine(WithLogSink(sink))
+	rule, err := engine.Compile("logtest", []byte(`
+		log "plain entry"
+		log.warn "host is $(request.host)" method=$(request.method) note="two words"
+		if $(request.method) == POST {
+			log.debug "not logged"
+		}
+	`))
+	assert.Nil(t, err)
+
+	_, err = rule.Execute(map[string]interface{}{
+		"request": &http.Request{Host: "example.com", Method: "GET"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []LogEntry{
+		LogEntry{Level: slog.LevelInfo, Message: "plain entry", Script: "logtest", Line: 2, Fields: []LogField{}},
+		LogEntry{Level: slog.LevelWarn, Message: "host is example.com", Script: "logtest", Line: 3, Fields: []LogField{
+			LogField{Key: "method", Value: "GET"},
+			LogField{Key: "note", Value: "two words"},
+		}},
+	}, sink.entries)
+}
@@ -0,0 +1,111 @@
+package gorule
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// WithFS sets the filesystem used to resolve include and import statements, like an embed.FS or os.DirFS
+func WithFS(fsys fs.FS) Option {
+	return func(e *Engine) {
+		e.fs = fsys
+	}
+}
+
+// includeStatement runs the statements of another file in place, like: include "common/security.rule"
+type includeStatement struct {
+	file string
+	body block
+	line int
+}
+
+func (st *includeStatement) pos() int {
+	return st.line
+}
+
+func (st *includeStatement) exec(s *state) error {
+	return inFile(st.file, st.body.run(s))
+}
+
+// include parses an include or import statement
+// include adds the statements of the file in place, import only loads the functions of a file once
+func (p *parser) include(word string, line int) (statement, error) {
+	t := p.next()
+	if t.kind != tokenString && t.kind != tokenWord {
+		return nil, fmt.Errorf("expected file name after '%s' at line:%d", word, t.line)
+	}
+	if p.fs == nil {
+		return nil, fmt.Errorf("'%s' of '%s' at line:%d requires a filesystem, see WithFS", word, t.text, line)
+	}
+	file := path.Clean(strings.TrimPrefix(t.text, "/"))
+
+	if word == "import" {
+		if p.depth > 0 {
+			return nil, fmt.Errorf("'import' is only allowed outside of blocks at line:%d", line)
+		}
+		if p.imported[file] {
+			return nil, nil
+		}
+	}
+	for i, f := range p.stack {
+		if f == file {
+			cycle := append(append([]string{}, p.stack[i:]...), file)
+			return nil, fmt.Errorf("%s cycle '%s' at line:%d", word, strings.Join(cycle, "' -> '"), line)
+		}
+	}
+
+	script, err := fs.ReadFile(p.fs, file)
+	if err != nil {
+		return nil, fmt.Errorf("could not %s '%s' at line:%d error:%s", word, file, line, err)
+	}
+	tokens, err := newLexer(script).tokens()
+	if err != nil {
+		return nil, fmt.Errorf("error in file '%s': %s", file, err)
+	}
+
+	// the file is parsed with the same functions, but its own tokens and line numbers
+	sub := &parser{
+		tokens:    tokens,
+		loops:     p.loops,
+		depth:     p.depth,
+		funcs:     p.funcs,
+		templates: p.templates,
+		matchers:  p.matchers,
+		fs:        p.fs,
+		file:      file,
+		stack:     append(append([]string{}, p.stack...), file),
+		imported:  p.imported,
+	}
+	body, err := sub.statements(tokenEOF)
+	if err != nil {
+		return nil, fmt.Errorf("error in file '%s': %s", file, err)
+	}
+	p.calls = append(p.calls, sub.calls...)
+
+	if word == "import" {
+		if len(body) > 0 {
+			return nil, fmt.Errorf("error in file '%s': imported files may only define functions", file)
+		}
+		p.imported[file] = true
+		return nil, nil
+	}
+	return &includeStatement{file: file, body: body, line: line}, nil
+}
+
+// isControl returns true if the error is used to end a script, loop or function
+func isControl(err error) bool {
+	var ret *returnValue
+	return errors.Is(err, errStop) || errors.Is(err, errDecided) ||
+		errors.Is(err, errBreak) || errors.Is(err, errContinue) || errors.As(err, &ret)
+}
+
+// inFile adds the file name to errors of statements in included files
+func inFile(file string, err error) error {
+	if err == nil || file == "" || isControl(err) {
+		return err
+	}
+	return fmt.Errorf("error in file '%s': %w", file, err)
+}
@@ -79,6 +79,14 @@ func deleteValue(v reflect.Value, tree []string) error {
 func deleteInterfaceStruct(mod interface{}, tree []string) error {
 	v, _, _, t2 := getReflection(mod)
 	//log.Printf("deleteInterfaceStruct mod:%T type:%+v tree:%v ", v2.Interface(), v2.Kind(), tree)
+	if len(tree) == 0 {
+		return fmt.Errorf("deleteInterfaceStruct resource '%s' needs a field to delete a value", t2.String())
+	}
+	if f, ok := getVirtualField(mod, tree[0]); ok && f.delete != nil {
+		return f.delete(mod, tree)
+	} else if ok {
+		return modifyInterfaceVirtual(mod, f, tree, deleteInterface)
+	}
 	// Loop through all field of the structure
 	for i := 0; i < t2.NumField(); i++ {
 		field := t2.Field(i)
@@ -112,8 +120,11 @@ func deleteInterfaceStruct(mod interface{}, tree []string) error {
 
 // deleteInterfaceMap gets the value of an interface based on tree of a Map
 func deleteInterfaceMap(mod interface{}, tree []string) error {
-	_, _, v2, _ := getReflection(mod)
+	_, _, v2, t2 := getReflection(mod)
 	//log.Printf("deleteInterfaceMap mod:%T type:%+v tree:%v ", v2.Interface(), v2.Kind(), tree)
+	if len(tree) == 0 {
+		return fmt.Errorf("deleteInterfaceMap resource '%s' needs a key to delete a value", t2.String())
+	}
 
 	// Loop through all field of the structure
 	for _, i := range v2.MapKeys() {
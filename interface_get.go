@@ -7,8 +7,8 @@ import (
 	"strings"
 )
 
-// getInterface gets the value of an interface based on tree
-func getInterface(mod interface{}, tree []string) (interface{}, error) {
+// getInterface gets the value of an interface based on tree, e is the engine running the script
+func getInterface(e *Engine, mod interface{}, tree []string) (interface{}, error) {
 	if mod == nil {
 		return "", fmt.Errorf("getInterface resource does not exist")
 	}
@@ -24,17 +24,19 @@ func getInterface(mod interface{}, tree []string) (interface{}, error) {
 		return v2.Int(), nil
 	case reflect.Bool:
 		return v2.Bool(), nil
+	case reflect.Float64:
+		return v2.Float(), nil
 	case reflect.Struct:
-		return getInterfaceStruct(mod, tree)
+		return getInterfaceStruct(e, mod, tree)
 	case reflect.Map:
-		return getInterfaceMap(mod, tree)
+		return getInterfaceMap(e, mod, tree)
 	case reflect.Slice:
 		switch fmt.Sprintf("%T", mod) {
 		case uint8slice: // []byte
 			x := mod.([]byte)
 			return string(x), nil
 		default:
-			return getInterfaceSlice(mod, tree)
+			return getInterfaceSlice(e, mod, tree)
 		}
 	default:
 		return "", fmt.Errorf("getInterface type '%s' has not been found in the resource '%T'", tree[0:], v2.Interface())
@@ -42,41 +44,53 @@ func getInterface(mod interface{}, tree []string) (interface{}, error) {
 }
 
 // getInterfaceStruct gets the value of an interface based on tree of a Structure
-func getInterfaceStruct(mod interface{}, tree []string) (interface{}, error) {
-	v, _, _, t2 := getReflection(mod)
+func getInterfaceStruct(e *Engine, mod interface{}, tree []string) (interface{}, error) {
+	_, _, v2, t2 := getReflection(mod)
 	//log.Printf("getInterfaceStruct mod:%T type:%+v tree:%v", v2.Interface(), v2.Kind(), tree)
+	if len(tree) == 0 {
+		return "", fmt.Errorf("getInterfaceStruct resource '%s' needs a field to get a value", t2.String())
+	}
+	if f, ok := getVirtualField(mod, tree[0]); ok {
+		return getInterfaceVirtual(e, mod, f, tree)
+	}
 	// Loop through all field of the structure
 	for i := 0; i < t2.NumField(); i++ {
 		field := t2.Field(i)
-		if strings.EqualFold(field.Name, tree[0]) {
-			return getInterface(v.Elem().Field(i).Interface(), tree[1:])
+		if strings.EqualFold(field.Name, tree[0]) && v2.Field(i).CanInterface() {
+			return getInterface(e, v2.Field(i).Interface(), tree[1:])
 		}
 	}
 	return "", fmt.Errorf("getInterfaceStruct type '%s' has not been found in the resource '%T'", tree[0], t2.String())
 }
 
 // getInterfaceMap gets the value of an interface based on tree of a Map
-func getInterfaceMap(mod interface{}, tree []string) (interface{}, error) {
+func getInterfaceMap(e *Engine, mod interface{}, tree []string) (interface{}, error) {
 	_, _, v2, t2 := getReflection(mod)
 	//log.Printf("getInterfaceMap mod:%T type:%+v tree:%v", v2.Interface(), v2.Kind(), tree)
+	if len(tree) == 0 {
+		return "", fmt.Errorf("getInterfaceMap resource '%s' needs a key to get a value", t2.String())
+	}
 
 	// Loop through all field of the structure
 	for _, i := range v2.MapKeys() {
 		//log.Printf("map match %s, %s", v2.MapIndex(i).Interface(), tree[0])
 		if strings.EqualFold(i.String(), tree[0]) {
-			return getInterface(v2.MapIndex(i).Interface(), tree[1:])
+			return getInterface(e, v2.MapIndex(i).Interface(), tree[1:])
 		}
 	}
 	return "", fmt.Errorf("getInterfaceMap type '%s' has not been found in the resource '%T'", tree[0], t2.String())
 }
 
 // getInterfaceSlice gets the value of an interface based on tree of a Slice
-func getInterfaceSlice(mod interface{}, tree []string) (interface{}, error) {
+func getInterfaceSlice(e *Engine, mod interface{}, tree []string) (interface{}, error) {
 	_, _, v2, t2 := getReflection(mod)
 	//log.Printf("getInterfaceSlice mod:%T type:%+v tree:%v", v2.Interface(), v2.Kind(), tree)
 
-	// Loop through all field of the structure
+	// a single value is used without an index, multiple values need an index or a filter to pick them
 	if len(tree) == 0 {
+		if v2.Len() > 1 {
+			return "", fmt.Errorf("getInterfaceSlice resource '%s' has %d values, %w", t2.String(), v2.Len(), ErrMultipleValues)
+		}
 		tree = append(tree, "0")
 	}
 	treeInt, err := strconv.Atoi(tree[0])
@@ -86,8 +100,55 @@ func getInterfaceSlice(mod interface{}, tree []string) (interface{}, error) {
 
 	for i := 0; i < v2.Len(); i++ {
 		if i == treeInt {
-			return getInterface(v2.Index(i).Interface(), tree[1:])
+			return getInterface(e, v2.Index(i).Interface(), tree[1:])
 		}
 	}
 	return "", fmt.Errorf("getInterfaceSlice slice '%s' has not been found in the resource '%T'", tree[0], t2.String())
 }
+
+// resolveInterface gets the value of an interface based on tree, without picking the first item of slices and maps
+func resolveInterface(e *Engine, mod interface{}, tree []string) (interface{}, error) {
+	if len(tree) == 0 || mod == nil {
+		return mod, nil
+	}
+	if v := reflect.ValueOf(mod); v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil, nil
+	}
+	_, _, v2, t2 := getReflection(mod)
+
+	switch v2.Kind() {
+	case reflect.Struct:
+		if f, ok := getVirtualField(mod, tree[0]); ok {
+			v, err := f.load(e, mod)
+			if err != nil {
+				return nil, fmt.Errorf("resolveInterface failed to get '%s': %s", tree[0], err)
+			}
+			return resolveInterface(e, v, tree[1:])
+		}
+		for i := 0; i < t2.NumField(); i++ {
+			if strings.EqualFold(t2.Field(i).Name, tree[0]) {
+				if !v2.Field(i).CanInterface() {
+					break
+				}
+				return resolveInterface(e, v2.Field(i).Interface(), tree[1:])
+			}
+		}
+	case reflect.Map:
+		for _, i := range v2.MapKeys() {
+			if strings.EqualFold(i.String(), tree[0]) {
+				return resolveInterface(e, v2.MapIndex(i).Interface(), tree[1:])
+			}
+		}
+		return nil, nil
+	case reflect.Slice, reflect.Array:
+		treeInt, err := strconv.Atoi(tree[0])
+		if err != nil {
+			return nil, fmt.Errorf("resolveInterface failed to convert '%s' in to a number: %s", tree[0], err)
+		}
+		if treeInt >= 0 && treeInt < v2.Len() {
+			return resolveInterface(e, v2.Index(treeInt).Interface(), tree[1:])
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("resolveInterface type '%s' has not been found in the resource '%s'", tree[0], t2.String())
+}
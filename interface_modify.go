@@ -89,6 +89,16 @@ func modifyValue(v reflect.Value, tree []string, value string) error {
 func modifyInterfaceStruct(mod interface{}, tree []string, value string) error {
 	v, _, v2, t2 := getReflection(mod)
 	//log.Printf("modifyInterfaceStruct mod:%T type:%+v tree:%v value:%s", v2.Interface(), v2.Kind(), tree, value)
+	if len(tree) == 0 {
+		return fmt.Errorf("modifyInterfaceStruct resource '%s' needs a field to change a value", t2.String())
+	}
+	if f, ok := getVirtualField(mod, tree[0]); ok && f.modify != nil {
+		return f.modify(mod, tree, value)
+	} else if ok {
+		return modifyInterfaceVirtual(mod, f, tree, func(v interface{}, tree []string) error {
+			return modifyInterface(v, tree, value)
+		})
+	}
 	// Loop through all field of the structure
 	for i := 0; i < t2.NumField(); i++ {
 		field := t2.Field(i)
@@ -117,8 +127,11 @@ func modifyInterfaceStruct(mod interface{}, tree []string, value string) error {
 
 // modifyInterfaceMap gets the value of an interface based on tree of a Map
 func modifyInterfaceMap(mod interface{}, tree []string, value string) error {
-	v, t, v2, _ := getReflection(mod)
+	v, t, v2, t2 := getReflection(mod)
 	//log.Printf("modifyInterfaceMap mod:%T type:%+v tree:%v value:%s", v2.Interface(), v2.Kind(), tree, value)
+	if len(tree) == 0 {
+		return fmt.Errorf("modifyInterfaceMap resource '%s' needs a key to change a value", t2.String())
+	}
 
 	// Loop through all field of the structure
 	for _, i := range v2.MapKeys() {
@@ -150,6 +163,14 @@ func modifyInterfaceMap(mod interface{}, tree []string, value string) error {
 			v.SetMapIndex(reflect.ValueOf(tree[0]), reflect.ValueOf(e))
 			return nil
 
+		case reflect.Ptr:
+			// adding a new structure to the map, and modify its field
+			if t.Elem().Elem().Kind() != reflect.Struct || len(tree) < 2 {
+				break
+			}
+			e := reflect.New(t.Elem().Elem())
+			v.SetMapIndex(reflect.ValueOf(tree[0]), e)
+			return modifyInterface(e.Interface(), tree[1:], value)
 		}
 	}
 
@@ -0,0 +1,103 @@
+package gorule
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// virtualField is a field that does not exist in a resource, but is derived from other fields
+// get returns a copy of the value, set writes the changed copy back in to the resource
+// fields that can not be changed as a copy use modify and delete to change the resource directly
+// read-only fields that depend on the configuration of the engine use value instead of get
+type virtualField struct {
+	get    func(mod interface{}) (interface{}, error)
+	value  func(e *Engine, mod interface{}) (interface{}, error)
+	set    func(mod interface{}, value interface{}) error
+	modify func(mod interface{}, tree []string, value string) error
+	delete func(mod interface{}, tree []string) error
+}
+
+// virtualFields are the virtual fields by type of resource and field name
+var virtualFields = map[string]map[string]virtualField{
+	"*http.Request": {
+		// query is the parsed url.RawQuery, changes are encoded back in to the url.RawQuery
+		"query": {
+			get: func(mod interface{}) (interface{}, error) {
+				r := mod.(*http.Request)
+				if r.URL == nil {
+					return url.Values{}, nil
+				}
+				return r.URL.Query(), nil
+			},
+			set: func(mod interface{}, value interface{}) error {
+				r := mod.(*http.Request)
+				if r.URL == nil {
+					r.URL = &url.URL{}
+				}
+				r.URL.RawQuery = value.(url.Values).Encode()
+				// the form contains the query too, so it needs to be parsed again
+				r.Form = nil
+				return nil
+			},
+		},
+		// form is the parsed form of the body of a post, put or patch request, changes are encoded back in to the body
+		"form": {get: getForm, set: setForm},
+		// cookie are the cookies of the Cookie header
+		"cookie": {get: getRequestCookies, set: setRequestCookies},
+		// clientip is the address of the client, behind the trusted proxies
+		"clientip": {value: getClientIP},
+		// body is the body as string, and json the body parsed as json
+		"body": {get: getBody, set: setBodyString},
+		"json": {get: getJSON, modify: modifyJSON, delete: deleteJSON},
+	},
+	"*http.Response": {
+		// setcookie are the cookies of the Set-Cookie headers
+		"setcookie": {get: getSetCookies, set: setSetCookies},
+		"body":      {get: getBody, set: setBodyString},
+		"json":      {get: getJSON, modify: modifyJSON, delete: deleteJSON},
+	},
+}
+
+// getVirtualField returns the virtual field of a resource with the name, if it exists
+func getVirtualField(mod interface{}, name string) (virtualField, bool) {
+	fields, ok := virtualFields[fmt.Sprintf("%T", mod)]
+	if !ok {
+		return virtualField{}, false
+	}
+	f, ok := fields[strings.ToLower(name)]
+	return f, ok
+}
+
+// load returns the value of the virtual field of a resource
+func (f virtualField) load(e *Engine, mod interface{}) (interface{}, error) {
+	if f.value != nil {
+		return f.value(e, mod)
+	}
+	return f.get(mod)
+}
+
+// getInterfaceVirtual gets the value of an interface based on tree of a virtual field
+func getInterfaceVirtual(e *Engine, mod interface{}, f virtualField, tree []string) (interface{}, error) {
+	v, err := f.load(e, mod)
+	if err != nil {
+		return "", fmt.Errorf("getInterfaceVirtual failed to get '%s': %s", tree[0], err)
+	}
+	return getInterface(e, v, tree[1:])
+}
+
+// modifyInterfaceVirtual modifies the value of a virtual field based on tree, and writes it back in to the resource
+func modifyInterfaceVirtual(mod interface{}, f virtualField, tree []string, change func(v interface{}, tree []string) error) error {
+	if f.set == nil {
+		return fmt.Errorf("modifyInterfaceVirtual '%s' is read-only", tree[0])
+	}
+	v, err := f.get(mod)
+	if err != nil {
+		return fmt.Errorf("modifyInterfaceVirtual failed to get '%s': %s", tree[0], err)
+	}
+	if err := change(v, tree[1:]); err != nil {
+		return err
+	}
+	return f.set(mod, v)
+}
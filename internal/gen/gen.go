@@ -0,0 +1,116 @@
+// Package gen compiles scripts to Go functions, that access the fields of the resources directly instead of with reflection
+// it is used by gorule gen, and keeps the loading of Go packages out of the gorule package
+package gen
+
+import (
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/importer"
+	goparser "go/parser"
+	gotoken "go/token"
+	"go/types"
+	"strings"
+
+	// gorule writes the generated function, it sets genapi.Generate when it is loaded
+	_ "github.com/rdoorn/gorule"
+	"github.com/rdoorn/gorule/internal/genapi"
+)
+
+// Options configures the Go code generated from a script
+type Options struct {
+	// Package is the package of the generated file
+	Package string
+	// Func is the name of the generated function
+	Func string
+	// Name is the name of the rule used in violations and fail errors, like the name passed to Compile
+	Name string
+	// Bindings are the resources and their Go types in the order of the arguments of the function
+	// packages are named by their full import path, also those of the standard library, like: request=*net/http.Request
+	Bindings []string
+	// Importer imports the packages of the bindings and type checks the generated code, the packages are loaded from source if it is nil
+	// so the types of the module it runs in can be bound, reuse an importer to load the packages once when generating many scripts
+	Importer types.Importer
+}
+
+// Generate compiles a script to the source of a Go function, that accesses the fields of the resources directly instead of with reflection
+// the function takes the resources and the params in the order they are declared, and returns the same result and errors as Execute
+// only a part of the language is supported, scripts using anything else return an error
+func Generate(script []byte, opts Options) ([]byte, error) {
+	if opts.Importer == nil {
+		opts.Importer = importer.ForCompiler(gotoken.NewFileSet(), "source", nil)
+	}
+	code, err := genapi.Generate(script, genapi.Options{
+		Package:  opts.Package,
+		Func:     opts.Func,
+		Name:     opts.Name,
+		Bindings: opts.Bindings,
+		Resolve: func(name string) (genapi.Type, error) {
+			typ, err := resolveType(opts.Importer, name)
+			if err != nil {
+				return nil, err
+			}
+			return &goType{typ: typ}, nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	formatted, err := format.Source(code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to format the generated code error:%s", err)
+	}
+	if err := check(formatted, opts); err != nil {
+		return nil, err
+	}
+	return formatted, nil
+}
+
+// resolveType resolves a type like *net/http.Request or string
+func resolveType(imp types.Importer, name string) (types.Type, error) {
+	pointers := 0
+	for strings.HasPrefix(name, "*") {
+		name = name[1:]
+		pointers++
+	}
+	var typ types.Type
+	dot := strings.LastIndex(name, ".")
+	if dot < 0 {
+		obj := types.Universe.Lookup(name)
+		if obj == nil {
+			return nil, fmt.Errorf("unknown type '%s'", name)
+		}
+		typ = obj.Type()
+	} else {
+		pkg, err := imp.Import(name[:dot])
+		if err != nil {
+			return nil, fmt.Errorf("unknown package '%s', use the full import path of the package error:%s", name[:dot], err)
+		}
+		obj := pkg.Scope().Lookup(name[dot+1:])
+		if obj == nil || !obj.Exported() {
+			return nil, fmt.Errorf("unknown type '%s' in package '%s'", name[dot+1:], pkg.Path())
+		}
+		if _, ok := obj.(*types.TypeName); !ok {
+			return nil, fmt.Errorf("'%s' is not a type", name)
+		}
+		typ = obj.Type()
+	}
+	for ; pointers > 0; pointers-- {
+		typ = types.NewPointer(typ)
+	}
+	return typ, nil
+}
+
+// check type checks the generated code, so mistakes are reported by Generate instead of by building the code
+func check(code []byte, opts Options) error {
+	fset := gotoken.NewFileSet()
+	file, err := goparser.ParseFile(fset, opts.Func+"_gen.go", code, 0)
+	if err != nil {
+		return fmt.Errorf("failed to parse the generated code error:%s", err)
+	}
+	conf := types.Config{Importer: opts.Importer}
+	if _, err := conf.Check(opts.Package, fset, []*ast.File{file}, nil); err != nil {
+		return fmt.Errorf("failed to type check the generated code error:%s", err)
+	}
+	return nil
+}
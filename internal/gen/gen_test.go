@@ -0,0 +1,161 @@
+package gen_test
+
+import (
+	"fmt"
+	"go/importer"
+	"go/token"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/rdoorn/gorule"
+	"github.com/rdoorn/gorule/internal/gen"
+	"github.com/stretchr/testify/assert"
+)
+
+//go:generate go run ../../cmd/gorule gen -package gen_test -func rewrite -o rewrite_gen_test.go testdata/rewrite.rule request=*net/http.Request
+
+func TestGenerate(t *testing.T) {
+	script, err := os.ReadFile("testdata/rewrite.rule")
+	assert.Nil(t, err)
+	// the packages are loaded from source once for all scripts
+	packages := importer.ForCompiler(token.NewFileSet(), "source", nil)
+
+	// the generated code in the repository is up to date
+	code, err := gen.Generate(script, gen.Options{
+		Package:  "gen_test",
+		Func:     "rewrite",
+		Name:     "rewrite",
+		Bindings: []string{"request=*net/http.Request"},
+		Importer: packages,
+	})
+	assert.Nil(t, err)
+	current, err := os.ReadFile("rewrite_gen_test.go")
+	assert.Nil(t, err)
+	assert.Equal(t, string(current), string(code), "rewrite_gen_test.go is outdated, run go generate")
+
+	// the generated function behaves like the interpreter
+	rule, err := gorule.NewEngine().Compile("rewrite", script)
+	assert.Nil(t, err)
+	request := func(host, path string, headers http.Header) *http.Request {
+		return &http.Request{Method: "GET", Host: host, URL: &url.URL{Path: path}, Header: headers.Clone()}
+	}
+	hosts := []string{"a.example.com", "b.example.com", "x.api.example.com", "static.example.com", "other.com"}
+	paths := []string{"/old/x/y", "/admin/users", "/"}
+	headers := []http.Header{
+		{},
+		{"X-Debug": {"on"}, "X-Count": {"5"}, "X-User": {"jane"}},
+		{"X-Count": {"abc"}, "X-Status": {"418"}},
+		{"X-Status": {"999"}},
+		{"X-User": {"jane", "john"}, "X-Status": {"200", "404"}},
+	}
+	modes := []string{"", "deny", "redirect", "stop", "return", "fail", "missing", "status"}
+	for _, host := range hosts {
+		for _, path := range paths {
+			for h, header := range headers {
+				for limit, mode := range modes {
+					name := fmt.Sprintf("%s%s headers:%d mode:%s", host, path, h, mode)
+					interpreted, generated := request(host, path, header), request(host, path, header)
+					expected, expectedErr := rule.Execute(map[string]interface{}{"request": interpreted}, gorule.WithParams(map[string]interface{}{"mode": mode, "limit": limit}))
+					result, err := rewrite(generated, mode, limit)
+					if expectedErr != nil {
+						assert.EqualError(t, err, expectedErr.Error(), name)
+					} else {
+						assert.Nil(t, err, name)
+					}
+					assert.Equal(t, expected, result, name)
+					assert.Equal(t, interpreted.Header, generated.Header, name)
+					assert.Equal(t, interpreted.URL.String(), generated.URL.String(), name)
+					assert.Equal(t, interpreted.ContentLength, generated.ContentLength, name)
+				}
+			}
+		}
+	}
+
+	// statements that are not supported by gen
+	unsupported := map[string]string{
+		`log "test"`: "'log' at line:2 error:it is not supported by gen",
+		"foreach k in request.header {\n stop\n}":   "'foreach' at line:2 error:it is not supported by gen",
+		`var host = "$(request.host | lower)"`:      "'request.host' at line:2 error:filters are not supported by gen",
+		`var session = "$(request.cookie.session)"`: "'request.cookie.session' at line:2 error:the field 'cookie' of '*http.Request' is not supported by gen",
+		`request.header.x-a replace_regex "a" "b"`:  "'request.header.x-a' at line:2 error:replace_regex on fields with multiple values is not supported by gen",
+		"param value any":                           "'value' at line:2 error:params of type 'any' are not supported by gen",
+		`var status = "$(response.status)"`:         "'response.status' at line:2 error:unknown variable or resource 'response'",
+	}
+	for script, expected := range unsupported {
+		_, err := gen.Generate([]byte("input request *http.Request\n"+script), gen.Options{
+			Package:  "rules",
+			Func:     "rule",
+			Name:     "rule",
+			Bindings: []string{"request=*net/http.Request"},
+			Importer: packages,
+		})
+		assert.EqualError(t, err, expected, script)
+	}
+
+	// bindings must match the inputs
+	_, err = gen.Generate([]byte("input request *http.Request\nstop"), gen.Options{
+		Package:  "rules",
+		Func:     "rule",
+		Name:     "rule",
+		Bindings: []string{"request=*net/http.Response"},
+		Importer: packages,
+	})
+	assert.EqualError(t, err, "binding 'request' is of type '*http.Response', expected '*http.Request' declared at line:1")
+
+	// types outside the standard library can be bound
+	code, err = gen.Generate([]byte("input state *gorule.Result\nif $(state.outcome.reason) == \"done\" {\n  state.stopped = true\n}"), gen.Options{
+		Package:  "rules",
+		Func:     "rule",
+		Name:     "rule",
+		Bindings: []string{"state=*github.com/rdoorn/gorule.Result"},
+		Importer: packages,
+	})
+	assert.Nil(t, err)
+	assert.Contains(t, string(code), "func rule(state *gorule.Result) (*gorule.Result, error) {")
+	assert.Contains(t, string(code), "return r.Outcome.Reason, nil")
+
+	// packages that do not exist can not be bound
+	_, err = gen.Generate([]byte("input request *http.Request\nstop"), gen.Options{
+		Package:  "rules",
+		Func:     "rule",
+		Name:     "rule",
+		Bindings: []string{"request=*github.com/rdoorn/gorule/missing.Request"},
+		Importer: packages,
+	})
+	assert.NotNil(t, err)
+
+	// packages are named by their full import path, also those of the standard library
+	_, err = gen.Generate([]byte("input request *http.Request\nstop"), gen.Options{
+		Package:  "rules",
+		Func:     "rule",
+		Name:     "rule",
+		Bindings: []string{"request=*http.Request"},
+		Importer: packages,
+	})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "invalid binding 'request=*http.Request' error:unknown package 'http', use the full import path of the package")
+	}
+}
+
+func BenchmarkGenerate(b *testing.B) {
+	script, err := os.ReadFile("testdata/rewrite.rule")
+	assert.Nil(b, err)
+	rule, err := gorule.NewEngine().Compile("rewrite", script)
+	assert.Nil(b, err)
+	request := func() *http.Request {
+		return &http.Request{Method: "GET", Host: "x.api.example.com", URL: &url.URL{Path: "/old/x"}, Header: http.Header{"X-Debug": {"on"}}}
+	}
+
+	b.Run("interpreted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			rule.Execute(map[string]interface{}{"request": request()}, gorule.WithParams(map[string]interface{}{"mode": "", "limit": 1}))
+		}
+	})
+	b.Run("generated", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			rewrite(request(), "", 1)
+		}
+	})
+}
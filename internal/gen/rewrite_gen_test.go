@@ -0,0 +1,665 @@
+// Code generated by gorule gen. DO NOT EDIT.
+
+package gen_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rdoorn/gorule"
+	"github.com/rdoorn/gorule/genrt"
+)
+
+// rewrite runs the rule 'rewrite', it accesses the fields of the resources directly instead of with reflection
+func rewrite(request *http.Request, mode string, limit int) (*gorule.Result, error) {
+	result := &gorule.Result{}
+	exports := 0
+	var vMode interface{} = mode
+	var vLimit interface{} = limit
+	var vBackend interface{}
+	var vScore interface{}
+	var vHost interface{}
+	var vPath interface{}
+	vBackend = "default"
+	exports = 1
+	vScore = "0"
+	exports = 2
+	{
+		t24, err := rewriteGet1(request)
+		if err != nil {
+			return nil, errors.New("error translating variable 'request.host of resource 'request': " + err.Error())
+		}
+		vHost = t24
+	}
+	{
+		t27, err := rewriteGet2(request)
+		if err != nil {
+			return nil, errors.New("error translating variable 'request.url.path of resource 'request': " + err.Error())
+		}
+		vPath = t27
+	}
+	{
+		t30, err := rewriteGet3(request)
+		if errors.Is(err, gorule.ErrMultipleValues) {
+			return nil, errors.New("error parsing value as 1st parameter to 'if' at line:10 error:" + "error translating variable 'request.header.x-debug of resource 'request': " + err.Error())
+		}
+		var t29 string
+		if err == nil {
+			t29 = t30
+		}
+		if err != nil || t29 == "" {
+			t29 = "off"
+		}
+		t31, err := genrt.Compare(t29, "==", "on")
+		if err != nil {
+			return nil, errors.New("failed to validate 'if' at line:10 error:" + err.Error())
+		}
+		if t31 {
+			t32 := "debug"
+			t33 := false
+			for _, t := range result.Outcome.Tags {
+				t33 = t33 || t == t32
+			}
+			if !t33 {
+				result.Outcome.Tags = append(result.Outcome.Tags, t32)
+			}
+		}
+	}
+	{
+		t35, err := rewriteGet4(request)
+		if errors.Is(err, gorule.ErrMultipleValues) {
+			return nil, errors.New("error parsing value as 1st parameter to 'if' at line:13 error:" + "error translating variable 'request.header.x-count of resource 'request': " + err.Error())
+		}
+		var t34 string
+		if err == nil {
+			t34 = t35
+		}
+		if err != nil || t34 == "" {
+			t34 = "0"
+		}
+		t36, err := genrt.Compare(t34, ">=", "3")
+		if err != nil {
+			return nil, errors.New("failed to validate 'if' at line:13 error:" + err.Error())
+		}
+		if t36 {
+			t37 := "many"
+			t38 := false
+			for _, t := range result.Outcome.Tags {
+				t38 = t38 || t == t37
+			}
+			if !t38 {
+				result.Outcome.Tags = append(result.Outcome.Tags, t37)
+			}
+		}
+	}
+	{
+		t39 := genrt.ToString(vHost)
+		t40 := false
+		t41, err := genrt.Compare(t39, "==", "a.example.com")
+		if err != nil {
+			return nil, errors.New("failed to validate 'case' at line:18 error:" + err.Error())
+		}
+		t40 = t41
+		if !t40 {
+			t42, err := genrt.Compare(t39, "==", "b.example.com")
+			if err != nil {
+				return nil, errors.New("failed to validate 'case' at line:18 error:" + err.Error())
+			}
+			t40 = t42
+		}
+		if t40 {
+			vBackend = "ab"
+		} else {
+			if rewriteMatch1(t39) {
+				vBackend = "api"
+				t43 := genrt.ToString(vMode)
+				t44 := "api-" + t43
+				if err := rewriteSet1(request, t44); err != nil {
+					return nil, errors.New("error modifing 'request.header.x-backend' to '" + t44 + "' at line:23 error:" + err.Error())
+				}
+			} else {
+				if strings.HasPrefix(t39, "static.") {
+					var vKind interface{} = "static"
+					t46 := genrt.ToString(vKind)
+					t48, err := rewriteGet5(request)
+					if err != nil {
+						return nil, errors.New("error translating variable 'request.method of resource 'request': " + err.Error())
+					}
+					vBackend = t46 + "-" + t48
+				} else {
+					vBackend = "other"
+				}
+			}
+		}
+	}
+	{
+		t49 := genrt.ToString(vPath)
+		if rewriteMatch2(t49) {
+			t50, err := rewriteGet2(request)
+			if err != nil {
+				return nil, errors.New("replace_regex get failed 'request.url.path' at line:35 error:" + err.Error())
+			}
+			t51 := rewriteRegexp3.ReplaceAllString(t50, "/new/")
+			if err := rewriteSet2(request, t51); err != nil {
+				return nil, errors.New("replace_regex modify failed 'request.url.path' to '" + t51 + "' at line:35 error:" + err.Error())
+			}
+		} else {
+			t52 := genrt.ToString(vPath)
+			if strings.Contains(t52, "/admin") {
+				t54, err := rewriteGet6(request)
+				if errors.Is(err, gorule.ErrMultipleValues) {
+					return nil, errors.New("error parsing value as 1st parameter to 'if' at line:37 error:" + "error translating variable 'request.header.x-user of resource 'request': " + err.Error())
+				}
+				var t53 string
+				if err == nil {
+					t53 = t54
+				}
+				if err != nil || t53 == "" {
+					t53 = ""
+				}
+				t55, err := genrt.Compare(t53, "!=", "")
+				if err != nil {
+					return nil, errors.New("failed to validate 'if' at line:37 error:" + err.Error())
+				}
+				if !t55 {
+					t56 := genrt.ToString(vPath)
+					result.Violations = append(result.Violations, gorule.Violation{Message: "a user is required for " + t56, Script: "rewrite", Line: 37})
+				}
+			}
+		}
+	}
+	{
+		t57 := genrt.ToString(vLimit)
+		t58, err := genrt.Calculate("*", t57, "2")
+		if err != nil {
+			return nil, errors.New("failed to calculate '*' at line:40 error:" + err.Error())
+		}
+		t59, err := genrt.Calculate("+", vScore, t58)
+		if err != nil {
+			return nil, errors.New("failed to calculate '+=' at line:40 error:" + err.Error())
+		}
+		vScore = t59
+	}
+	{
+		t60 := genrt.ToString(vScore)
+		t61, err := genrt.Compare(t60, ">", "10")
+		if err != nil {
+			return nil, errors.New("failed to validate 'if' at line:41 error:" + err.Error())
+		}
+		var t62 interface{}
+		if t61 {
+			t63 := genrt.ToString(vScore)
+			t64, err := genrt.Calculate("-", t63, "10")
+			if err != nil {
+				return nil, errors.New("failed to calculate '-' at line:41 error:" + err.Error())
+			}
+			t62 = t64
+		} else {
+			t65 := genrt.ToString(vScore)
+			t62 = t65
+		}
+		vScore = t62
+	}
+	{
+		t66 := genrt.ToString(vScore)
+		t67, err := genrt.Calculate("+", t66, "1")
+		if err != nil {
+			return nil, errors.New("failed to calculate '+' at line:42 error:" + err.Error())
+		}
+		t68 := genrt.ToString(t67)
+		if err := rewriteSet3(request, t68); err != nil {
+			return nil, errors.New("error modifing 'request.header.x-score' to '" + t68 + "' at line:42 error:" + err.Error())
+		}
+	}
+	{
+		t69 := genrt.ToString(vLimit)
+		t70 := genrt.ToString(vScore)
+		t71 := t69 + t70 + "1"
+		if err := rewriteSet4(request, t71); err != nil {
+			return nil, errors.New("error modifing 'request.header.x-limit' to '" + t71 + "' at line:43 error:" + err.Error())
+		}
+	}
+	{
+		t72 := genrt.ToString(vMode)
+		t73 := "mode=" + t72
+		if err := rewriteSet5(request, t73); err != nil {
+			return nil, errors.New("error modifing 'request.url.rawquery' to '" + t73 + "' at line:44 error:" + err.Error())
+		}
+	}
+	{
+		t74 := genrt.ToString(vLimit)
+		if err := rewriteSet6(request, t74); err != nil {
+			return nil, errors.New("error modifing 'request.contentlength' to '" + t74 + "' at line:45 error:" + err.Error())
+		}
+	}
+	{
+		t75 := genrt.ToString(vMode)
+		t76, err := genrt.Compare(t75, "==", "deny")
+		if err != nil {
+			return nil, errors.New("failed to validate 'if' at line:47 error:" + err.Error())
+		}
+		if t76 {
+			t77 := genrt.ToString(vHost)
+			result.Outcome.Action = gorule.ActionDeny
+			result.Outcome.Status = 403
+			result.Outcome.Line = 48
+			result.Outcome.Reason = "denied " + t77
+			result.Stopped = true
+			goto done
+		} else {
+			t78 := genrt.ToString(vMode)
+			t79, err := genrt.Compare(t78, "==", "redirect")
+			if err != nil {
+				return nil, errors.New("failed to validate 'if' at line:49 error:" + err.Error())
+			}
+			if t79 {
+				t80 := genrt.ToString(vHost)
+				t81 := genrt.ToString(vPath)
+				result.Outcome.Action = gorule.ActionRedirect
+				result.Outcome.Status = 302
+				result.Outcome.Line = 50
+				result.Outcome.Location = "https://" + t80 + t81
+				result.Stopped = true
+				goto done
+			} else {
+				t82 := genrt.ToString(vMode)
+				t83, err := genrt.Compare(t82, "==", "stop")
+				if err != nil {
+					return nil, errors.New("failed to validate 'if' at line:51 error:" + err.Error())
+				}
+				if t83 {
+					result.Stopped = true
+					goto done
+				} else {
+					t84 := genrt.ToString(vMode)
+					t85, err := genrt.Compare(t84, "==", "return")
+					if err != nil {
+						return nil, errors.New("failed to validate 'if' at line:53 error:" + err.Error())
+					}
+					if t85 {
+						t86 := genrt.ToString(vScore)
+						t87, err := genrt.Calculate("+", t86, "1")
+						if err != nil {
+							return nil, errors.New("error parsing value as parameter to 'return' at line:54 error:" + "failed to calculate '+' at line:54 error:" + err.Error())
+						}
+						result.Value = t87
+						result.Stopped = true
+						goto done
+					} else {
+						t88 := genrt.ToString(vMode)
+						t89, err := genrt.Compare(t88, "==", "fail")
+						if err != nil {
+							return nil, errors.New("failed to validate 'if' at line:55 error:" + err.Error())
+						}
+						if t89 {
+							t90 := genrt.ToString(vHost)
+							return nil, &gorule.FailError{Script: "rewrite", Reason: "failed for " + t90, Line: 56}
+						} else {
+							t91 := genrt.ToString(vMode)
+							t92, err := genrt.Compare(t91, "==", "missing")
+							if err != nil {
+								return nil, errors.New("failed to validate 'if' at line:57 error:" + err.Error())
+							}
+							if t92 {
+								t94, err := rewriteGet7(request)
+								if err != nil {
+									return nil, errors.New("error translating variable 'request.header.x-not-there of resource 'request': " + err.Error())
+								}
+								if err := rewriteSet7(request, t94); err != nil {
+									return nil, errors.New("error modifing 'request.header.x-missing' to '" + t94 + "' at line:58 error:" + err.Error())
+								}
+							} else {
+								t95 := genrt.ToString(vMode)
+								t96, err := genrt.Compare(t95, "==", "status")
+								if err != nil {
+									return nil, errors.New("failed to validate 'if' at line:59 error:" + err.Error())
+								}
+								if t96 {
+									t98, err := rewriteGet8(request)
+									if err != nil {
+										return nil, errors.New("error parsing status as 1st parameter to 'respond' at line:60 error:" + "error translating variable 'request.header.x-status of resource 'request': " + err.Error())
+									}
+									t99, err := strconv.Atoi(t98)
+									if err != nil || t99 < 100 || t99 > 599 {
+										return nil, errors.New("invalid status '" + t98 + "' to 'respond' at line:60")
+									}
+									result.Outcome.Action = gorule.ActionRespond
+									result.Outcome.Status = t99
+									result.Outcome.Line = 60
+									result.Outcome.Body = "body"
+									result.Stopped = true
+									goto done
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	{
+		t100 := genrt.ToString(vMode)
+		result.Violations = append(result.Violations, gorule.Violation{Message: t100 + " is not known", Script: "rewrite", Line: 62})
+	}
+done:
+	result.Outputs = map[string]interface{}{}
+	if exports > 0 {
+		result.Outputs["backend"] = vBackend
+	}
+	if exports > 1 {
+		result.Outputs["score"] = vScore
+	}
+	return result, nil
+}
+
+// rewriteGet1 reads $(request.host)
+func rewriteGet1(r *http.Request) (string, error) {
+	if r == nil {
+		return "", errors.New("getInterface resource does not exist")
+	}
+	return r.Host, nil
+}
+
+// rewriteGet2 reads $(request.url.path)
+func rewriteGet2(r *http.Request) (string, error) {
+	if r == nil {
+		return "", errors.New("getInterface resource does not exist")
+	}
+	if r.URL == nil {
+		return "", errors.New("getInterface resource does not exist")
+	}
+	return r.URL.Path, nil
+}
+
+// rewriteGet3 reads $(request.header.x-debug)
+func rewriteGet3(r *http.Request) (string, error) {
+	if r == nil {
+		return "", errors.New("getInterface resource does not exist")
+	}
+	var v1 []string
+	ok2 := false
+	for k, e := range r.Header {
+		if strings.EqualFold(string(k), "x-debug") {
+			v1, ok2 = e, true
+			break
+		}
+	}
+	if !ok2 {
+		return "", errors.New("getInterfaceMap type 'x-debug' has not been found in the resource 'string'")
+	}
+	if len(v1) > 1 {
+		return "", fmt.Errorf("getInterfaceSlice resource '[]string' has %d values, %w", len(v1), gorule.ErrMultipleValues)
+	}
+	if len(v1) <= 0 {
+		return "", errors.New("getInterfaceSlice slice '0' has not been found in the resource 'string'")
+	}
+	return v1[0], nil
+}
+
+// rewriteGet4 reads $(request.header.x-count)
+func rewriteGet4(r *http.Request) (string, error) {
+	if r == nil {
+		return "", errors.New("getInterface resource does not exist")
+	}
+	var v1 []string
+	ok2 := false
+	for k, e := range r.Header {
+		if strings.EqualFold(string(k), "x-count") {
+			v1, ok2 = e, true
+			break
+		}
+	}
+	if !ok2 {
+		return "", errors.New("getInterfaceMap type 'x-count' has not been found in the resource 'string'")
+	}
+	if len(v1) > 1 {
+		return "", fmt.Errorf("getInterfaceSlice resource '[]string' has %d values, %w", len(v1), gorule.ErrMultipleValues)
+	}
+	if len(v1) <= 0 {
+		return "", errors.New("getInterfaceSlice slice '0' has not been found in the resource 'string'")
+	}
+	return v1[0], nil
+}
+
+var rewriteMatch1 = genrt.MustMatcher("match_host", "*.api.example.com")
+
+// rewriteSet1 changes request.header.x-backend
+func rewriteSet1(r *http.Request, value string) error {
+	if r == nil {
+		return errors.New("modifyInterfaceStruct resource does not exist")
+	}
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	var k1 string
+	ok2 := false
+	for k := range r.Header {
+		if strings.EqualFold(string(k), "x-backend") {
+			k1, ok2 = k, true
+			break
+		}
+	}
+	if ok2 {
+		v3 := r.Header[k1]
+		if len(v3) <= 0 {
+			return errors.New("modifyInterfaceSlice slice '0' has not been found in the resource '[]string'")
+		}
+		v3[0] = value
+		return nil
+	}
+	r.Header["x-backend"] = []string{value}
+	return nil
+}
+
+// rewriteGet5 reads $(request.method)
+func rewriteGet5(r *http.Request) (string, error) {
+	if r == nil {
+		return "", errors.New("getInterface resource does not exist")
+	}
+	return r.Method, nil
+}
+
+var rewriteMatch2 = genrt.MustMatcher("match_glob", "/old/**")
+
+var rewriteRegexp3 = regexp.MustCompile("^/old/")
+
+// rewriteSet2 changes request.url.path
+func rewriteSet2(r *http.Request, value string) error {
+	if r == nil {
+		return errors.New("modifyInterfaceStruct resource does not exist")
+	}
+	if r.URL == nil {
+		r.URL = &url.URL{}
+	}
+	r.URL.Path = value
+	return nil
+}
+
+// rewriteGet6 reads $(request.header.x-user)
+func rewriteGet6(r *http.Request) (string, error) {
+	if r == nil {
+		return "", errors.New("getInterface resource does not exist")
+	}
+	var v1 []string
+	ok2 := false
+	for k, e := range r.Header {
+		if strings.EqualFold(string(k), "x-user") {
+			v1, ok2 = e, true
+			break
+		}
+	}
+	if !ok2 {
+		return "", errors.New("getInterfaceMap type 'x-user' has not been found in the resource 'string'")
+	}
+	if len(v1) > 1 {
+		return "", fmt.Errorf("getInterfaceSlice resource '[]string' has %d values, %w", len(v1), gorule.ErrMultipleValues)
+	}
+	if len(v1) <= 0 {
+		return "", errors.New("getInterfaceSlice slice '0' has not been found in the resource 'string'")
+	}
+	return v1[0], nil
+}
+
+// rewriteSet3 changes request.header.x-score
+func rewriteSet3(r *http.Request, value string) error {
+	if r == nil {
+		return errors.New("modifyInterfaceStruct resource does not exist")
+	}
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	var k1 string
+	ok2 := false
+	for k := range r.Header {
+		if strings.EqualFold(string(k), "x-score") {
+			k1, ok2 = k, true
+			break
+		}
+	}
+	if ok2 {
+		v3 := r.Header[k1]
+		if len(v3) <= 0 {
+			return errors.New("modifyInterfaceSlice slice '0' has not been found in the resource '[]string'")
+		}
+		v3[0] = value
+		return nil
+	}
+	r.Header["x-score"] = []string{value}
+	return nil
+}
+
+// rewriteSet4 changes request.header.x-limit
+func rewriteSet4(r *http.Request, value string) error {
+	if r == nil {
+		return errors.New("modifyInterfaceStruct resource does not exist")
+	}
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	var k1 string
+	ok2 := false
+	for k := range r.Header {
+		if strings.EqualFold(string(k), "x-limit") {
+			k1, ok2 = k, true
+			break
+		}
+	}
+	if ok2 {
+		v3 := r.Header[k1]
+		if len(v3) <= 0 {
+			return errors.New("modifyInterfaceSlice slice '0' has not been found in the resource '[]string'")
+		}
+		v3[0] = value
+		return nil
+	}
+	r.Header["x-limit"] = []string{value}
+	return nil
+}
+
+// rewriteSet5 changes request.url.rawquery
+func rewriteSet5(r *http.Request, value string) error {
+	if r == nil {
+		return errors.New("modifyInterfaceStruct resource does not exist")
+	}
+	if r.URL == nil {
+		r.URL = &url.URL{}
+	}
+	r.URL.RawQuery = value
+	return nil
+}
+
+// rewriteSet6 changes request.contentlength
+func rewriteSet6(r *http.Request, value string) error {
+	if r == nil {
+		return errors.New("modifyInterfaceStruct resource does not exist")
+	}
+	n1, err := strconv.Atoi(value)
+	if err != nil {
+		return errors.New("failed to convert '" + value + "' to int: " + err.Error())
+	}
+	r.ContentLength = int64(n1)
+	return nil
+}
+
+// rewriteGet7 reads $(request.header.x-not-there)
+func rewriteGet7(r *http.Request) (string, error) {
+	if r == nil {
+		return "", errors.New("getInterface resource does not exist")
+	}
+	var v1 []string
+	ok2 := false
+	for k, e := range r.Header {
+		if strings.EqualFold(string(k), "x-not-there") {
+			v1, ok2 = e, true
+			break
+		}
+	}
+	if !ok2 {
+		return "", errors.New("getInterfaceMap type 'x-not-there' has not been found in the resource 'string'")
+	}
+	if len(v1) > 1 {
+		return "", fmt.Errorf("getInterfaceSlice resource '[]string' has %d values, %w", len(v1), gorule.ErrMultipleValues)
+	}
+	if len(v1) <= 0 {
+		return "", errors.New("getInterfaceSlice slice '0' has not been found in the resource 'string'")
+	}
+	return v1[0], nil
+}
+
+// rewriteSet7 changes request.header.x-missing
+func rewriteSet7(r *http.Request, value string) error {
+	if r == nil {
+		return errors.New("modifyInterfaceStruct resource does not exist")
+	}
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	var k1 string
+	ok2 := false
+	for k := range r.Header {
+		if strings.EqualFold(string(k), "x-missing") {
+			k1, ok2 = k, true
+			break
+		}
+	}
+	if ok2 {
+		v3 := r.Header[k1]
+		if len(v3) <= 0 {
+			return errors.New("modifyInterfaceSlice slice '0' has not been found in the resource '[]string'")
+		}
+		v3[0] = value
+		return nil
+	}
+	r.Header["x-missing"] = []string{value}
+	return nil
+}
+
+// rewriteGet8 reads $(request.header.x-status)
+func rewriteGet8(r *http.Request) (string, error) {
+	if r == nil {
+		return "", errors.New("getInterface resource does not exist")
+	}
+	var v1 []string
+	ok2 := false
+	for k, e := range r.Header {
+		if strings.EqualFold(string(k), "x-status") {
+			v1, ok2 = e, true
+			break
+		}
+	}
+	if !ok2 {
+		return "", errors.New("getInterfaceMap type 'x-status' has not been found in the resource 'string'")
+	}
+	if len(v1) > 1 {
+		return "", fmt.Errorf("getInterfaceSlice resource '[]string' has %d values, %w", len(v1), gorule.ErrMultipleValues)
+	}
+	if len(v1) <= 0 {
+		return "", errors.New("getInterfaceSlice slice '0' has not been found in the resource 'string'")
+	}
+	return v1[0], nil
+}
@@ -0,0 +1,443 @@
+package gen
+
+import (
+	"fmt"
+	"go/types"
+	"strconv"
+	"strings"
+
+	"github.com/rdoorn/gorule/internal/genapi"
+)
+
+// goType is the Go type of a binding
+type goType struct {
+	typ types.Type
+}
+
+// Name returns the type as it is printed by %T
+func (t *goType) Name() string {
+	return typeName(t.typ)
+}
+
+// Code returns the type as Go code
+func (t *goType) Code(imports genapi.Imports) string {
+	return typeCode(t.typ, imports)
+}
+
+// Getter writes reading the field of tree from r
+func (t *goType) Getter(tree []string, imports genapi.Imports) (*genapi.Getter, error) {
+	f := &genFunc{imports: imports}
+	kind, value, err := f.get("r", t.typ, tree)
+	if err != nil {
+		return nil, err
+	}
+	body := strings.Replace(f.out.String(), "return \x01", "return "+zeroValues[kind], -1)
+	return &genapi.Getter{Body: body, Value: value, Kind: kind, Multiple: f.multiple}, nil
+}
+
+// Setter writes changing the field of tree of r to value
+func (t *goType) Setter(tree []string, imports genapi.Imports) (string, error) {
+	f := &genFunc{imports: imports}
+	p, ok := t.typ.Underlying().(*types.Pointer)
+	if !ok {
+		return "", f.errorf("only resources that are a pointer to a struct can be changed")
+	}
+	if _, ok := p.Elem().Underlying().(*types.Struct); !ok {
+		return "", f.errorf("only resources that are a pointer to a struct can be changed")
+	}
+	if err := f.setStruct("r", t.typ, tree, false); err != nil {
+		return "", err
+	}
+	return f.out.String(), nil
+}
+
+// typeName returns the type as it is printed by %T
+func typeName(t types.Type) string {
+	return types.TypeString(t, func(p *types.Package) string { return p.Name() })
+}
+
+// typeCode returns the type as Go code, and adds the packages it uses to the imports
+func typeCode(t types.Type, imports genapi.Imports) string {
+	return types.TypeString(t, func(p *types.Package) string {
+		return imports(p.Path(), p.Name())
+	})
+}
+
+// genFunc writes a helper function that gets or changes a field of a resource, like getInterface and modifyInterface do
+type genFunc struct {
+	imports  genapi.Imports
+	out      strings.Builder
+	vars     int
+	multiple bool // the function returns ErrMultipleValues
+}
+
+func (f *genFunc) linef(format string, args ...interface{}) {
+	fmt.Fprintf(&f.out, format, args...)
+	f.out.WriteString("\n")
+}
+
+// newVar returns a new variable of the helper function
+func (f *genFunc) newVar(name string) string {
+	f.vars++
+	return fmt.Sprintf("%s%d", name, f.vars)
+}
+
+// errorf returns the error for a field that can not be generated, gorule adds the path and line of the field
+func (f *genFunc) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf(format, args...)
+}
+
+// pkg returns the name of a package used by the generated code
+func (f *genFunc) pkg(path string) string {
+	return f.imports(path, path[strings.LastIndex(path, "/")+1:])
+}
+
+// typeCode returns the type as Go code
+func (f *genFunc) typeCode(t types.Type) string {
+	return typeCode(t, f.imports)
+}
+
+// fail writes the return of an error with a message that is known when generating
+func (f *genFunc) fail(zero, message string) {
+	if zero != "" {
+		zero += ", "
+	}
+	f.linef("return %s%s.New(%q)", zero, f.pkg("errors"), message)
+}
+
+// basicKinds are the Go types of the values that can be read from resources, by kind
+var basicKinds = map[types.BasicKind]string{
+	types.String:  "string",
+	types.Int:     "int",
+	types.Int64:   "int64",
+	types.Bool:    "bool",
+	types.Float64: "float64",
+}
+
+// zeroValues are the zero values of the basic kinds
+var zeroValues = map[string]string{
+	"string":  `""`,
+	"int":     "0",
+	"int64":   "0",
+	"bool":    "false",
+	"float64": "0",
+}
+
+// isByteSlice returns true for []byte, which is used as text, but not for named types like json.RawMessage
+func isByteSlice(t types.Type) bool {
+	return types.Identical(t, types.NewSlice(types.Typ[types.Uint8])) && typeName(t) == "[]uint8"
+}
+
+// convert returns the code converting expr to the Go type, if t is a named type
+func (f *genFunc) convert(expr string, t types.Type, kind string) string {
+	if typeName(t) == kind {
+		return expr
+	}
+	return f.typeCode(t) + "(" + expr + ")"
+}
+
+// virtual returns an error if the field is a virtual field, those are not supported
+func (f *genFunc) virtual(modName, field string) error {
+	if genapi.Virtual(modName, field) {
+		return f.errorf("the field '%s' of '%s' is not supported by gen", field, modName)
+	}
+	return nil
+}
+
+// get writes reading the field of tree from expr, it returns the kind and the code of the value
+// errors that happen when reading return \x01 as value, which is replaced by the zero value of the kind
+func (f *genFunc) get(expr string, t types.Type, tree []string) (string, string, error) {
+	modName := typeName(t)
+	for {
+		switch u := t.Underlying().(type) {
+		case *types.Pointer:
+			f.linef("if %s == nil {", expr)
+			f.fail("\x01", "getInterface resource does not exist")
+			f.linef("}")
+			if _, ok := u.Elem().Underlying().(*types.Struct); !ok {
+				expr = "(*" + expr + ")"
+			}
+			t = u.Elem()
+
+		case *types.Struct:
+			if len(tree) == 0 {
+				return "", "", f.errorf("'%s' needs a field to get a value", typeName(t))
+			}
+			if err := f.virtual(modName, tree[0]); err != nil {
+				return "", "", err
+			}
+			var field *types.Var
+			for i := 0; i < u.NumFields(); i++ {
+				if strings.EqualFold(u.Field(i).Name(), tree[0]) && u.Field(i).Exported() {
+					field = u.Field(i)
+					break
+				}
+			}
+			if field == nil {
+				return "", "", f.errorf("'%s' has not been found in '%s'", tree[0], typeName(t))
+			}
+			expr += "." + field.Name()
+			t, tree = field.Type(), tree[1:]
+			modName = typeName(t)
+
+		case *types.Map:
+			if k, ok := u.Key().Underlying().(*types.Basic); !ok || k.Kind() != types.String {
+				return "", "", f.errorf("the keys of '%s' are not text", typeName(t))
+			}
+			if len(tree) == 0 {
+				return "", "", f.errorf("'%s' needs a key to get a value", typeName(t))
+			}
+			v, found := f.newVar("v"), f.newVar("ok")
+			f.linef("var %s %s", v, f.typeCode(u.Elem()))
+			f.linef("%s := false", found)
+			f.linef("for k, e := range %s {", expr)
+			f.linef("if %s.EqualFold(string(k), %q) {", f.pkg("strings"), tree[0])
+			f.linef("%s, %s = e, true", v, found)
+			f.linef("break")
+			f.linef("}")
+			f.linef("}")
+			f.linef("if !%s {", found)
+			f.fail("\x01", fmt.Sprintf("getInterfaceMap type '%s' has not been found in the resource 'string'", tree[0]))
+			f.linef("}")
+			expr, t, tree = v, u.Elem(), tree[1:]
+			modName = typeName(t)
+
+		case *types.Slice:
+			if isByteSlice(t) {
+				return "string", "string(" + expr + ")", nil
+			}
+			index := "0"
+			if len(tree) > 0 {
+				index, tree = tree[0], tree[1:]
+			} else {
+				// like getInterfaceSlice, multiple values need an index
+				f.linef("if len(%s) > 1 {", expr)
+				f.linef("return \x01, %s.Errorf(%q, len(%s), %s.ErrMultipleValues)", f.pkg("fmt"), fmt.Sprintf("getInterfaceSlice resource '%s' has %%d values, %%w", typeName(t)), expr, f.pkg("github.com/rdoorn/gorule"))
+				f.multiple = true
+				f.linef("}")
+			}
+			n, err := strconv.Atoi(index)
+			if err != nil || n < 0 {
+				return "", "", f.errorf("'%s' is not an index of '%s'", index, typeName(t))
+			}
+			f.linef("if len(%s) <= %d {", expr, n)
+			f.fail("\x01", fmt.Sprintf("getInterfaceSlice slice '%s' has not been found in the resource 'string'", index))
+			f.linef("}")
+			expr, t = fmt.Sprintf("%s[%d]", expr, n), u.Elem()
+			modName = typeName(t)
+
+		case *types.Basic:
+			kind, ok := basicKinds[u.Kind()]
+			if !ok {
+				return "", "", f.errorf("values of type '%s' are not supported", typeName(t))
+			}
+			// like getInterface, the rest of the path is ignored
+			if typeName(t) != kind {
+				expr = kind + "(" + expr + ")"
+			}
+			return kind, expr, nil
+
+		default:
+			return "", "", f.errorf("values of type '%s' are not supported by gen", typeName(t))
+		}
+	}
+}
+
+// createValues are the values created for fields that are nil when they are changed, like createStruct does
+var createValues = map[string]string{
+	"http.Header":          "make(%s)",
+	"*url.URL":             "&%s{}",
+	"*tls.ConnectionState": "&%s{}",
+	"[]*x509.Certificate":  "%s{{}}",
+	"[]uint8":              "%s{}",
+}
+
+// setStruct writes changing the field of tree of a pointer to a struct, like modifyInterfaceStruct, checked is true if expr is known not to be nil
+func (f *genFunc) setStruct(expr string, t types.Type, tree []string, checked bool) error {
+	st := t.Underlying().(*types.Pointer).Elem().Underlying().(*types.Struct)
+	if len(tree) == 0 {
+		return f.errorf("'%s' needs a field to change a value", typeName(t))
+	}
+	if err := f.virtual(typeName(t), tree[0]); err != nil {
+		return err
+	}
+	if !checked {
+		f.linef("if %s == nil {", expr)
+		f.fail("", "modifyInterfaceStruct resource does not exist")
+		f.linef("}")
+	}
+	var field *types.Var
+	for i := 0; i < st.NumFields(); i++ {
+		if strings.EqualFold(st.Field(i).Name(), tree[0]) {
+			field = st.Field(i)
+			break
+		}
+	}
+	if field == nil {
+		return f.errorf("'%s' has not been found in '%s'", tree[0], typeName(t))
+	}
+	if !field.Exported() {
+		return f.errorf("'%s' of '%s' is not exported", field.Name(), typeName(t))
+	}
+	expr += "." + field.Name()
+	switch field.Type().Underlying().(type) {
+	case *types.Map, *types.Slice, *types.Pointer:
+		// fields that are nil are created, if it is known how to create them
+		f.linef("if %s == nil {", expr)
+		create, ok := createValues[typeName(field.Type())]
+		switch {
+		case !ok:
+			f.fail("", "modifyInterfaceStruct failed to create instance for empty struct: cannot create field of type: "+typeName(field.Type()))
+		case strings.HasPrefix(create, "&"):
+			f.linef("%s = "+create, expr, f.typeCode(field.Type().Underlying().(*types.Pointer).Elem()))
+		default:
+			f.linef("%s = "+create, expr, f.typeCode(field.Type()))
+		}
+		f.linef("}")
+	}
+	// the field is never nil here, it is created or the function returned
+	return f.setValue(expr, field.Type(), tree[1:], true)
+}
+
+// setValue writes changing expr, which can be assigned to, like modifyValue, checked is true if expr is known not to be nil
+func (f *genFunc) setValue(expr string, t types.Type, tree []string, checked bool) error {
+	switch u := t.Underlying().(type) {
+	case *types.Pointer:
+		if !checked {
+			f.linef("if %s == nil {", expr)
+			f.fail("", fmt.Sprintf("modifyValue type '%s' has not been found in the resource '%s'", tree, typeName(t)))
+			f.linef("}")
+		}
+		switch u.Elem().Underlying().(type) {
+		case *types.Struct:
+			return f.setStruct(expr, t, tree, true)
+		case *types.Basic:
+			return f.setBasic("*"+expr, u.Elem())
+		}
+	case *types.Basic:
+		return f.setBasic(expr, t)
+	case *types.Map:
+		return f.setMap(expr, t, tree)
+	case *types.Slice:
+		if isByteSlice(t) {
+			f.linef("%s = []byte(value)", expr)
+			f.linef("return nil")
+			return nil
+		}
+		return f.setSlice(expr, t, tree)
+	}
+	return f.errorf("values of type '%s' can not be changed by gen", typeName(t))
+}
+
+// setBasic writes changing a text, number or boolean
+func (f *genFunc) setBasic(expr string, t types.Type) error {
+	switch t.Underlying().(*types.Basic).Kind() {
+	case types.String:
+		f.linef("%s = %s", expr, f.convert("value", t, "string"))
+	case types.Int, types.Int64:
+		n := f.newVar("n")
+		f.linef("%s, err := %s.Atoi(value)", n, f.pkg("strconv"))
+		f.linef("if err != nil {")
+		f.linef("return %s.New(\"failed to convert '\" + value + \"' to int: \" + err.Error())", f.pkg("errors"))
+		f.linef("}")
+		if t.Underlying().(*types.Basic).Kind() == types.Int {
+			f.linef("%s = %s", expr, f.convert(n, t, "int"))
+		} else {
+			f.linef("%s = %s", expr, f.convert("int64("+n+")", t, "int64"))
+		}
+	case types.Bool:
+		f.linef("%s = %s", expr, f.convert(f.pkg("strings")+`.EqualFold(value, "true")`, t, "bool"))
+	default:
+		return f.errorf("values of type '%s' can not be changed by gen", typeName(t))
+	}
+	f.linef("return nil")
+	return nil
+}
+
+// setMap writes changing the value of a key of a map, or adding the key if it does not exist, like modifyInterfaceMap
+func (f *genFunc) setMap(expr string, t types.Type, tree []string) error {
+	u := t.Underlying().(*types.Map)
+	if k, ok := u.Key().Underlying().(*types.Basic); !ok || k.Kind() != types.String {
+		return f.errorf("the keys of '%s' are not text", typeName(t))
+	}
+	if len(tree) == 0 {
+		return f.errorf("'%s' needs a key to change a value", typeName(t))
+	}
+	key, found := f.newVar("k"), f.newVar("ok")
+	f.linef("var %s %s", key, f.typeCode(u.Key()))
+	f.linef("%s := false", found)
+	f.linef("for k := range %s {", expr)
+	f.linef("if %s.EqualFold(string(k), %q) {", f.pkg("strings"), tree[0])
+	f.linef("%s, %s = k, true", key, found)
+	f.linef("break")
+	f.linef("}")
+	f.linef("}")
+	f.linef("if %s {", found)
+	v := f.newVar("v")
+	f.linef("%s := %s[%s]", v, expr, key)
+	var err error
+	switch e := u.Elem().Underlying().(type) {
+	case *types.Slice:
+		if isByteSlice(u.Elem()) {
+			return f.errorf("values of '%s' can not be changed by gen", typeName(t))
+		}
+		err = f.setSlice(v, u.Elem(), tree[1:])
+	case *types.Pointer:
+		if _, ok := e.Elem().Underlying().(*types.Struct); !ok {
+			return f.errorf("values of '%s' can not be changed by gen", typeName(t))
+		}
+		err = f.setValue(v, u.Elem(), tree[1:], false)
+	default:
+		return f.errorf("values of '%s' can not be changed by gen", typeName(t))
+	}
+	if err != nil {
+		return err
+	}
+	f.linef("}")
+
+	// the key does not exist, so it is added
+	newKey := f.convert(strconv.Quote(tree[0]), u.Key(), "string")
+	switch e := u.Elem().Underlying().(type) {
+	case *types.Slice:
+		if typeName(u.Elem()) != "[]string" {
+			f.fail("", "unknown type: "+typeName(u.Elem()))
+			return nil
+		}
+		f.linef("%s[%s] = []string{value}", expr, newKey)
+		f.linef("return nil")
+		return nil
+	case *types.Pointer:
+		if len(tree) >= 2 {
+			n := f.newVar("v")
+			f.linef("%s := &%s{}", n, f.typeCode(e.Elem()))
+			f.linef("%s[%s] = %s", expr, newKey, n)
+			return f.setStruct(n, u.Elem(), tree[1:], true)
+		}
+	}
+	f.fail("", fmt.Sprintf("modifyInterfaceMap type '%s' has not been found in the resource '%s'", tree[0], typeName(t)))
+	return nil
+}
+
+// setSlice writes changing an item of a slice, like modifyInterfaceSlice
+func (f *genFunc) setSlice(expr string, t types.Type, tree []string) error {
+	u := t.Underlying().(*types.Slice)
+	index := "0"
+	if len(tree) > 0 {
+		index, tree = tree[0], tree[1:]
+	}
+	n, err := strconv.Atoi(index)
+	if err != nil || n < 0 {
+		return f.errorf("'%s' is not an index of '%s'", index, typeName(t))
+	}
+	f.linef("if len(%s) <= %d {", expr, n)
+	f.fail("", fmt.Sprintf("modifyInterfaceSlice slice '%s' has not been found in the resource '%s'", index, typeName(t)))
+	f.linef("}")
+	item := fmt.Sprintf("%s[%d]", expr, n)
+	if p, ok := u.Elem().Underlying().(*types.Pointer); ok {
+		if _, ok := p.Elem().Underlying().(*types.Struct); !ok {
+			return f.errorf("values of '%s' can not be changed by gen", typeName(t))
+		}
+		return f.setStruct(item, u.Elem(), tree, false)
+	}
+	return f.setValue(item, u.Elem(), tree, false)
+}
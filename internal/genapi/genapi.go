@@ -0,0 +1,65 @@
+// Package genapi connects the gorule package with the code generator in internal/gen
+// gorule writes the generated function from its compiled scripts, the generator adds the Go types of the bindings
+// so gorule itself does not depend on go/types and the packages it loads
+// it also gives the genrt package the functions of gorule the generated code runs with
+package genapi
+
+// Options configures the code generated from a script
+type Options struct {
+	// Package is the package of the generated file
+	Package string
+	// Func is the name of the generated function
+	Func string
+	// Name is the name of the rule used in violations and fail errors
+	Name string
+	// Bindings are the resources and their Go types in the order of the arguments of the function, like: request=*net/http.Request
+	Bindings []string
+	// Resolve returns the Go type of a binding, like: *net/http.Request
+	Resolve func(name string) (Type, error)
+}
+
+// Type is the Go type of a binding, it writes the code accessing the fields of a resource of the type
+type Type interface {
+	// Name returns the type as it is printed by %T, like: *http.Request
+	Name() string
+	// Code returns the type as Go code, and adds the packages it uses to imports
+	Code(imports Imports) string
+	// Getter writes reading the field of tree from the resource r, like getInterface
+	Getter(tree []string, imports Imports) (*Getter, error)
+	// Setter writes changing the field of tree of the resource r to value, like modifyInterface
+	// the code returns nil or an error
+	Setter(tree []string, imports Imports) (string, error)
+}
+
+// Getter is the code reading a field of a resource
+type Getter struct {
+	// Body returns the zero value of Kind and an error if the field can not be read
+	Body string
+	// Value is the expression of the value after Body
+	Value string
+	// Kind is the Go type of the value: string, int, int64, bool or float64
+	Kind string
+	// Multiple is true if Body returns gorule.ErrMultipleValues
+	Multiple bool
+}
+
+// Imports adds a package to the imports of the generated code, and returns the name to use it by
+type Imports func(path, name string) string
+
+// Generate writes the unformatted source of the Go function of a script, it is set by gorule
+var Generate func(script []byte, opts Options) ([]byte, error)
+
+// Virtual returns true if the field of the type is a virtual field of gorule, like the cookies of a request, it is set by gorule
+var Virtual func(typeName, field string) bool
+
+// the functions used by the generated code through the genrt package, so it behaves like the scripts, they are set by gorule
+var (
+	// ToString converts a value to text
+	ToString func(v interface{}) string
+	// Calculate applies the operator to 2 values
+	Calculate func(operator string, left, right interface{}) (interface{}, error)
+	// Compare validates 2 values
+	Compare func(value, validator, pattern string) (bool, error)
+	// Matcher compiles the pattern of match_regex, match_glob or match_host
+	Matcher func(validator, pattern string) (func(value string) bool, error)
+)
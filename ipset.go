@@ -0,0 +1,156 @@
+package gorule
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+)
+
+// ipTree is a binary prefix tree of networks, ipv4 addresses are stored as ipv4-mapped ipv6 addresses
+// a lookup walks at most one node per bit of the longest prefix
+type ipTree struct {
+	root ipNode
+}
+
+// ipNode is a bit of a prefix, end marks the last bit of a network
+type ipNode struct {
+	children [2]*ipNode
+	end      bool
+}
+
+// insert adds the network of ip with the prefix length of ones bits in the 16 byte form of ip
+func (t *ipTree) insert(ip net.IP, ones int) {
+	n := &t.root
+	for i := 0; i < ones; i++ {
+		if n.end {
+			// a larger network already contains this one
+			return
+		}
+		bit := ip[i/8] >> (7 - uint(i%8)) & 1
+		if n.children[bit] == nil {
+			n.children[bit] = &ipNode{}
+		}
+		n = n.children[bit]
+	}
+	n.end = true
+	n.children = [2]*ipNode{}
+}
+
+// contains returns true if ip is in one of the networks of the tree
+func (t *ipTree) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	n := &t.root
+	for i := 0; i < 128; i++ {
+		if n.end {
+			return true
+		}
+		n = n.children[ip[i/8]>>(7-uint(i%8))&1]
+		if n == nil {
+			return false
+		}
+	}
+	return n.end
+}
+
+// add adds a line of an ip set to the tree, as CIDR, single ip or range like: 10.0.0.1 - 10.0.0.20
+func (t *ipTree) add(entry string) error {
+	if from, to, ok := strings.Cut(entry, "-"); ok {
+		start, end := net.ParseIP(strings.TrimSpace(from)), net.ParseIP(strings.TrimSpace(to))
+		if start == nil || end == nil || (start.To4() == nil) != (end.To4() == nil) {
+			return fmt.Errorf("invalid range")
+		}
+		return t.addRange(start.To16(), end.To16())
+	}
+	if !strings.Contains(entry, "/") {
+		entry = addSubnet(entry)
+	}
+	_, ipnet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return err
+	}
+	ones, bits := ipnet.Mask.Size()
+	t.insert(ipnet.IP.To16(), ones+128-bits)
+	return nil
+}
+
+// addRange adds the range of addresses from start to end as the smallest list of networks
+func (t *ipTree) addRange(start, end net.IP) error {
+	from, to := new(big.Int).SetBytes(start), new(big.Int).SetBytes(end)
+	if from.Cmp(to) > 0 {
+		return fmt.Errorf("invalid range, the start is after the end")
+	}
+	one := big.NewInt(1)
+	for from.Cmp(to) <= 0 {
+		// the largest network starting at from that does not go past to
+		size := int(from.TrailingZeroBits())
+		if from.Sign() == 0 {
+			size = 128
+		}
+		for ; size > 0; size-- {
+			last := new(big.Int).Add(from, new(big.Int).Sub(new(big.Int).Lsh(one, uint(size)), one))
+			if last.Cmp(to) <= 0 {
+				break
+			}
+		}
+		ip := make(net.IP, net.IPv6len)
+		from.FillBytes(ip)
+		t.insert(ip, 128-size)
+		from.Add(from, new(big.Int).Lsh(one, uint(size)))
+	}
+	return nil
+}
+
+// LoadIPSet loads the ip set with the name, to be used as: if $(request.clientip) in_ipset "name"
+// each line is a CIDR, a single ip or a range like 10.0.0.1 - 10.0.0.20, empty lines and lines starting with # are skipped
+// loading a set with the name of an existing set replaces it, scripts running at that time use either the old or the new set
+func (e *Engine) LoadIPSet(name string, r io.Reader) error {
+	t := &ipTree{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		if err := t.add(entry); err != nil {
+			return fmt.Errorf("invalid entry '%s' at line:%d of ipset '%s' error:%s", entry, line, name, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read ipset '%s': %s", name, err)
+	}
+	e.ipsets.Store(name, t)
+	return nil
+}
+
+// LoadIPSetFile loads the ip set with the name from a file, see LoadIPSet
+func (e *Engine) LoadIPSetFile(name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read ipset '%s': %s", name, err)
+	}
+	defer f.Close()
+	return e.LoadIPSet(name, f)
+}
+
+// inIPSet returns true if ip is in the ip set with the name
+func (e *Engine) inIPSet(ip, name string) (bool, error) {
+	t, ok := e.ipsets.Load(name)
+	if !ok {
+		return false, fmt.Errorf("unknown ipset '%s'", name)
+	}
+	// an address that is not an ip is not in the set, like an unknown client ip
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false, nil
+	}
+	return t.(*ipTree).contains(parsed), nil
+}
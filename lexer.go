@@ -0,0 +1,355 @@
+package gorule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// tokenKind is the type of a token in the script
+type tokenKind int
+
+const (
+	tokenEOF     tokenKind = iota
+	tokenWord              // unquoted word: keyword, validator, number, resource or literal
+	tokenString            // quoted string
+	tokenNewline           // end of a line or ;
+	tokenLBrace            // {
+	tokenRBrace            // }
+	tokenLParen            // (
+	tokenRParen            // )
+	tokenComma             // ,
+)
+
+// token is a single item of the script
+type token struct {
+	kind   tokenKind
+	text   string
+	quoted bool // true if (part of) the word was quoted, like key="value"
+	line   int
+}
+
+// lexer is the container and keeper of script location and data
+type lexer struct {
+	input  []byte
+	offset int
+	line   int
+}
+
+// newLexer creates a new lexer for script
+func newLexer(s []byte) *lexer {
+	return &lexer{
+		input:  s,
+		offset: 0,
+		line:   1,
+	}
+}
+
+// eof returns eof when the script is finished
+func (l *lexer) eof() bool {
+	return l.offset >= len(l.input)
+}
+
+// peek returns the byte at offset n from the current position, or 0 past the eof
+func (l *lexer) peek(n int) byte {
+	if l.offset+n >= len(l.input) {
+		return 0
+	}
+	return l.input[l.offset+n]
+}
+
+// get gets the next byte and increses the offset
+func (l *lexer) get() byte {
+	out := l.input[l.offset]
+	l.offset++
+	if out == '\n' {
+		l.line++
+	}
+	return out
+}
+
+// tokens splits the whole script in to tokens
+func (l *lexer) tokens() ([]token, error) {
+	tokens := []token{}
+	for {
+		t, err := l.next()
+		if err != nil {
+			return nil, fmt.Errorf("could not parse script at line:%d error:%s", l.line, err)
+		}
+		tokens = append(tokens, t)
+		if t.kind == tokenEOF {
+			return tokens, nil
+		}
+	}
+}
+
+// next gets the next token and increses the offset
+func (l *lexer) next() (token, error) {
+	for !l.eof() {
+		g := l.peek(0)
+		switch {
+		// skip spaces
+		case g == ' ' || g == '\t' || g == '\r':
+			l.get()
+
+		// a \ at the end of a line continues the statement on the next line
+		case g == '\\' && (l.peek(1) == '\n' || (l.peek(1) == '\r' && l.peek(2) == '\n')):
+			for l.get() != '\n' {
+			}
+
+		// comments: // comments, # comments and /* com ments */
+		case g == '#' || (g == '/' && l.peek(1) == '/'):
+			for !l.eof() && l.peek(0) != '\n' {
+				l.get()
+			}
+		case g == '/' && l.peek(1) == '*':
+			line := l.line
+			l.get()
+			l.get()
+			for !(l.peek(0) == '*' && l.peek(1) == '/') {
+				if l.eof() {
+					return token{}, fmt.Errorf("comment started at line:%d is not closed", line)
+				}
+				l.get()
+			}
+			l.get()
+			l.get()
+
+		case g == '\n' || g == ';':
+			line := l.line
+			l.get()
+			return token{kind: tokenNewline, text: string(g), line: line}, nil
+		case g == '{':
+			l.get()
+			return token{kind: tokenLBrace, text: "{", line: l.line}, nil
+		case g == '}':
+			l.get()
+			return token{kind: tokenRBrace, text: "}", line: l.line}, nil
+		case g == '(':
+			l.get()
+			return token{kind: tokenLParen, text: "(", line: l.line}, nil
+		case g == ')':
+			l.get()
+			return token{kind: tokenRParen, text: ")", line: l.line}, nil
+		case g == ',':
+			l.get()
+			return token{kind: tokenComma, text: ",", line: l.line}, nil
+		case g == '"' || g == '`':
+			line := l.line
+			s, err := l.quoted()
+			if err != nil {
+				return token{}, err
+			}
+			return token{kind: tokenString, text: s, quoted: true, line: line}, nil
+		case g == '<' && l.peek(1) == '<' && isHeredocName(l.peek(2)):
+			line := l.line
+			s, err := l.heredoc()
+			if err != nil {
+				return token{}, err
+			}
+			return token{kind: tokenString, text: s, quoted: true, line: line}, nil
+		default:
+			return l.word()
+		}
+	}
+	return token{kind: tokenEOF, line: l.line}, nil
+}
+
+// quoted reads a "string" with escapes, or a `raw string` without, and returns its contents
+func (l *lexer) quoted() (string, error) {
+	line := l.line
+	quote := l.get() // opening quote
+	word := []byte{}
+	for !l.eof() {
+		// quotes within a $(variable) or ${ expression } do not end the string
+		if quote == '"' && l.peek(0) == '$' && (l.peek(1) == '(' || l.peek(1) == '{') {
+			v, err := l.variable()
+			if err != nil {
+				return "", err
+			}
+			word = append(word, v...)
+			continue
+		}
+		g := l.get()
+		switch {
+		case g == quote:
+			return string(word), nil
+		case g == '\\' && quote == '"':
+			e, err := l.escape()
+			if err != nil {
+				return "", fmt.Errorf("%s in string started at line:%d", err, line)
+			}
+			word = append(word, e...)
+			continue
+		}
+		word = append(word, g)
+	}
+	return "", fmt.Errorf("string started at line:%d is not closed", line)
+}
+
+// escape reads the escape sequence after a \ in a "string"
+// unknown sequences are kept as is, so regexes like "\.example\.com$" keep working
+func (l *lexer) escape() ([]byte, error) {
+	if l.eof() {
+		return []byte{'\\'}, nil
+	}
+	g := l.peek(0)
+	switch g {
+	case 'n':
+		l.get()
+		return []byte{'\n'}, nil
+	case 't':
+		l.get()
+		return []byte{'\t'}, nil
+	case 'r':
+		l.get()
+		return []byte{'\r'}, nil
+	case '"', '\\':
+		l.get()
+		return []byte{g}, nil
+	case 'x', 'u', 'U':
+		size := map[byte]int{'x': 2, 'u': 4, 'U': 8}[g]
+		hex := make([]byte, 0, size)
+		for i := 1; i <= size; i++ {
+			hex = append(hex, l.peek(i))
+		}
+		n, err := strconv.ParseUint(string(hex), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid escape '\\%c%s'", g, strings.TrimRight(string(hex), "\x00"))
+		}
+		for i := 0; i <= size; i++ {
+			l.get()
+		}
+		if g == 'x' {
+			return []byte{byte(n)}, nil
+		}
+		if !utf8.ValidRune(rune(n)) {
+			return nil, fmt.Errorf("invalid escape '\\%c%s'", g, hex)
+		}
+		return utf8.AppendRune(nil, rune(n)), nil
+	}
+	return []byte{'\\'}, nil
+}
+
+// isHeredocName returns true if g can be part of the name that ends a heredoc
+func isHeredocName(g byte) bool {
+	return g == '_' || (g >= 'a' && g <= 'z') || (g >= 'A' && g <= 'Z') || (g >= '0' && g <= '9')
+}
+
+// heredoc reads a multi-line string, like:
+//
+//	respond 200 <<END
+//	  <h1>maintenance</h1>
+//	  END
+//
+// the indentation of the line with the closing name is removed from every line
+func (l *lexer) heredoc() (string, error) {
+	line := l.line
+	l.get()
+	l.get()
+	name := []byte{}
+	for isHeredocName(l.peek(0)) {
+		name = append(name, l.get())
+	}
+	for l.peek(0) == ' ' || l.peek(0) == '\t' || l.peek(0) == '\r' {
+		l.get()
+	}
+	if l.eof() || l.get() != '\n' {
+		return "", fmt.Errorf("expected a new line after '<<%s' at line:%d", name, line)
+	}
+
+	lines := []string{}
+	for !l.eof() {
+		start := l.offset
+		for !l.eof() && l.peek(0) != '\n' {
+			l.get()
+		}
+		text := strings.TrimSuffix(string(l.input[start:l.offset]), "\r")
+		trimmed := strings.TrimLeft(text, " \t")
+		if trimmed == string(name) {
+			indent := text[:len(text)-len(trimmed)]
+			for i, t := range lines {
+				lines[i] = strings.TrimPrefix(t, indent)
+			}
+			return strings.Join(lines, "\n"), nil
+		}
+		lines = append(lines, text)
+		if !l.eof() {
+			l.get()
+		}
+	}
+	return "", fmt.Errorf("heredoc '<<%s' started at line:%d is not closed", name, line)
+}
+
+// word reads an unquoted word, this includes $(variables) and quoted parts like key="value"
+func (l *lexer) word() (token, error) {
+	line := l.line
+	word := []byte{}
+	quoted := false
+	for !l.eof() {
+		g := l.peek(0)
+		switch g {
+		case ' ', '\t', '\r', '\n', ';', '{', '}', '(', ')', ',':
+			return token{kind: tokenWord, text: string(word), quoted: quoted, line: line}, nil
+		case '"', '`':
+			s, err := l.quoted()
+			if err != nil {
+				return token{}, err
+			}
+			word = append(word, s...)
+			quoted = true
+			continue
+		case '$':
+			if l.peek(1) == '(' || l.peek(1) == '{' {
+				v, err := l.variable()
+				if err != nil {
+					return token{}, err
+				}
+				word = append(word, v...)
+				continue
+			}
+		}
+		word = append(word, l.get())
+	}
+	return token{kind: tokenWord, text: string(word), quoted: quoted, line: line}, nil
+}
+
+// variable reads a $(variable) or ${ expression } including any nested brackets
+func (l *lexer) variable() (string, error) {
+	line := l.line
+	word := []byte{l.get(), l.get()}
+	open, close := byte('('), byte(')')
+	if word[1] == '{' {
+		open, close = '{', '}'
+	}
+	depth := 1
+	for !l.eof() {
+		g := l.get()
+		word = append(word, g)
+		switch g {
+		case '"', '`':
+			for !l.eof() && l.peek(0) != g {
+				if g == '"' && l.peek(0) == '\\' {
+					word = append(word, l.get())
+				}
+				if !l.eof() {
+					word = append(word, l.get())
+				}
+			}
+			if !l.eof() {
+				word = append(word, l.get())
+			}
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return string(word), nil
+			}
+		case '\n':
+			return "", fmt.Errorf("variable started at line:%d is not closed", line)
+		}
+	}
+	return "", fmt.Errorf("variable started at line:%d is not closed", line)
+}
@@ -0,0 +1,68 @@
+package gorule
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LogEntry is a single entry written by the log statement of a script
+type LogEntry struct {
+	Level   slog.Level
+	Message string
+	Script  string
+	Line    int
+	Fields  []LogField
+}
+
+// LogField is a key=value pair added to a log statement
+type LogField struct {
+	Key   string
+	Value string
+}
+
+// LogSink receives the entries written by the log statements of a script
+type LogSink interface {
+	Log(entry LogEntry)
+}
+
+// WithLogger routes the log statements of scripts to a slog logger
+func WithLogger(l *slog.Logger) Option {
+	return func(e *Engine) {
+		e.sink = &slogSink{logger: l}
+	}
+}
+
+// WithLogSink routes the log statements of scripts to a custom sink
+func WithLogSink(s LogSink) Option {
+	return func(e *Engine) {
+		e.sink = s
+	}
+}
+
+// logLevels maps the log statements to their level
+var logLevels = map[string]slog.Level{
+	"log":       slog.LevelInfo,
+	"log.debug": slog.LevelDebug,
+	"log.info":  slog.LevelInfo,
+	"log.warn":  slog.LevelWarn,
+	"log.error": slog.LevelError,
+}
+
+// slogSink writes log entries to a slog logger, or the default slog logger if none is set
+type slogSink struct {
+	logger *slog.Logger
+}
+
+// Log writes the entry including the script name and line as attributes
+func (s *slogSink) Log(entry LogEntry) {
+	logger := s.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	attrs := make([]slog.Attr, 0, len(entry.Fields)+2)
+	attrs = append(attrs, slog.String("script", entry.Script), slog.Int("line", entry.Line))
+	for _, f := range entry.Fields {
+		attrs = append(attrs, slog.String(f.Key, f.Value))
+	}
+	logger.LogAttrs(context.Background(), entry.Level, entry.Message, attrs...)
+}
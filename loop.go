@@ -0,0 +1,172 @@
+package gorule
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// errBreak and errContinue are returned by break and continue to the foreach loop
+var (
+	errBreak    = errors.New("break outside of foreach")
+	errContinue = errors.New("continue outside of foreach")
+)
+
+// defaultMaxIterations is the maximum number of foreach iterations in a single execution
+const defaultMaxIterations = 10000
+
+// WithMaxIterations sets the maximum number of foreach iterations in a single execution of a script
+func WithMaxIterations(n int) Option {
+	return func(e *Engine) {
+		e.maxIterations = n
+	}
+}
+
+// foreachStatement runs the block for each item of a slice or map, like: foreach key, value in request.header { }
+type foreachStatement struct {
+	key        string
+	value      string
+	collection string
+	block      block
+	line       int
+}
+
+// foreach parses a foreach statement
+func (p *parser) foreach(line int) (statement, error) {
+	st := &foreachStatement{line: line}
+	name, err := p.name("variable as 1st parameter", "foreach")
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind == tokenComma {
+		p.next()
+		st.key = name
+		name, err = p.name("variable as 2nd parameter", "foreach")
+		if err != nil {
+			return nil, err
+		}
+	}
+	st.value = name
+	if in := p.next(); in.kind != tokenWord || in.text != "in" {
+		return nil, fmt.Errorf("expected 'in' after the variables of 'foreach' at line:%d", in.line)
+	}
+	collection, err := p.name("resource to loop over", "in")
+	if err != nil {
+		return nil, err
+	}
+	// allow both request.header and $(request.header)
+	if strings.HasPrefix(collection, "$(") && strings.HasSuffix(collection, ")") {
+		collection = collection[2 : len(collection)-1]
+	}
+	st.collection = collection
+
+	p.loops++
+	st.block, err = p.block("foreach")
+	p.loops--
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// foreachItem is a single key and value to loop over
+type foreachItem struct {
+	key   interface{}
+	value interface{}
+}
+
+// items returns a copy of the items of a slice or map, so the block can safely modify the collection
+func (st *foreachStatement) items(s *state) ([]foreachItem, error) {
+	resource := strings.Split(st.collection, ".")
+	r, ok := s.lookup(resource[0])
+	if !ok {
+		return nil, fmt.Errorf("unknown resource '%s' in 'foreach' at line:%d", st.collection, st.line)
+	}
+	c, err := resolveInterface(s.rule.engine, r, resource[1:])
+	if err != nil {
+		return nil, fmt.Errorf("error getting '%s' in 'foreach' at line:%d error:%s", st.collection, st.line, err)
+	}
+	if c == nil {
+		return nil, nil
+	}
+
+	items := []foreachItem{}
+	v := reflect.Indirect(reflect.ValueOf(c))
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, foreachItem{key: i, value: v.Index(i).Interface()})
+		}
+	case reflect.Map:
+		// sort the keys so the order is the same on every run
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		for _, k := range keys {
+			items = append(items, foreachItem{key: k.Interface(), value: v.MapIndex(k).Interface()})
+		}
+	default:
+		return nil, fmt.Errorf("cannot loop over '%s' of type '%T' in 'foreach' at line:%d", st.collection, c, st.line)
+	}
+	return items, nil
+}
+
+func (st *foreachStatement) pos() int {
+	return st.line
+}
+
+func (st *foreachStatement) exec(s *state) error {
+	items, err := st.items(s)
+	if err != nil {
+		return err
+	}
+
+	outer, onError := s.scope, s.onError
+	defer func() { s.scope, s.onError = outer, onError }()
+	for _, item := range items {
+		s.iterations++
+		if s.iterations > s.rule.engine.maxIterations {
+			return fmt.Errorf("foreach at line:%d exceeded the maximum of %d iterations", st.line, s.rule.engine.maxIterations)
+		}
+
+		// the loop variables are only visible in the block
+		s.scope, s.onError = newScope(outer), onError
+		if st.key != "" {
+			key := item.key
+			if i, ok := key.(int); ok {
+				key = strconv.Itoa(i)
+			}
+			s.scope.vars[st.key] = &variable{value: key}
+		}
+		s.scope.vars[st.value] = &variable{value: item.value}
+
+		err := st.block.run(s)
+		switch {
+		case err == nil, errors.Is(err, errContinue):
+			continue
+		case errors.Is(err, errBreak):
+			return nil
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// loopControlStatement is a break or continue
+type loopControlStatement struct {
+	err  error
+	line int
+}
+
+func (st *loopControlStatement) pos() int {
+	return st.line
+}
+
+func (st *loopControlStatement) exec(s *state) error {
+	return st.err
+}
@@ -0,0 +1,155 @@
+package gorule
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// matcher matches a value against a compiled pattern of match_regex, match_glob or match_host
+type matcher func(value string) bool
+
+// matchers compile the patterns of the validators that match against a pattern
+var matchers = map[string]func(pattern string) (matcher, error){
+	"match_regex": func(pattern string) (matcher, error) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	},
+	"match_glob": compileGlob,
+	"match_host": compileHost,
+}
+
+// compileGlob compiles a path pattern, like: /static/**/*.js
+// * matches within a path segment, ** matches any number of segments, ? matches a single character
+// and [abc], [a-z] or [!abc] match a character of the set
+func compileGlob(pattern string) (matcher, error) {
+	expr := strings.Builder{}
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				// **/ also matches no directory at all, like /static/**/*.js matches /static/app.js
+				if i+1 < len(pattern) && pattern[i+1] == '/' && (i == 1 || pattern[i-2] == '/') {
+					i++
+					expr.WriteString("(?:.*/)?")
+					continue
+				}
+				expr.WriteString(".*")
+				continue
+			}
+			expr.WriteString("[^/]*")
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			start := i + 1
+			if start < len(pattern) && pattern[start] == '!' {
+				start++
+			}
+			// a ] right after the [ or [! is part of the set
+			end := -1
+			if start < len(pattern) {
+				end = strings.IndexByte(pattern[start+1:], ']')
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("'[' at position %d is not closed", i)
+			}
+			end += start + 1
+			expr.WriteString("[")
+			if start > i+1 {
+				expr.WriteString("^/")
+			}
+			expr.WriteString(strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, "^", `\^`).Replace(pattern[start:end]))
+			expr.WriteString("]")
+			i = end
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString, nil
+}
+
+// compileHost compiles a host pattern, like: *.example.com
+// a * label matches a single label, a ** label matches one or more labels, and a * within a label matches part of a label
+// hosts are matched case insensitive, without port and trailing dot
+func compileHost(pattern string) (matcher, error) {
+	pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+	if pattern == "" {
+		return nil, fmt.Errorf("the pattern is empty")
+	}
+	labels := strings.Split(pattern, ".")
+	expr := make([]string, len(labels))
+	for i, label := range labels {
+		switch {
+		case label == "":
+			return nil, fmt.Errorf("label %d of '%s' is empty", i+1, pattern)
+		case label == "**":
+			expr[i] = `[^.]+(?:\.[^.]+)*`
+		case strings.Contains(label, "**"):
+			return nil, fmt.Errorf("'**' must be a whole label in '%s'", pattern)
+		case label == "*":
+			expr[i] = `[^.]+`
+		default:
+			parts := strings.Split(label, "*")
+			for j := range parts {
+				parts[j] = regexp.QuoteMeta(parts[j])
+			}
+			expr[i] = strings.Join(parts, `[^.]*`)
+		}
+	}
+	re, err := regexp.Compile(`^` + strings.Join(expr, `\.`) + `$`)
+	if err != nil {
+		return nil, err
+	}
+	return func(value string) bool {
+		if host, _, err := net.SplitHostPort(value); err == nil {
+			value = host
+		}
+		return re.MatchString(strings.TrimSuffix(strings.ToLower(value), "."))
+	}, nil
+}
+
+// matcher compiles the pattern of a validator when the script is compiled, if the pattern is a constant
+func (p *parser) matcher(validator string, right expression, line int) error {
+	compile, ok := matchers[validator]
+	if !ok {
+		return nil
+	}
+	o, ok := right.(operand)
+	if !ok || o.call != nil || strings.Contains(o.text, "$") {
+		return nil
+	}
+	key := validator + " " + o.text
+	if _, ok := p.matchers[key]; ok {
+		return nil
+	}
+	m, err := compile(o.text)
+	if err != nil {
+		return fmt.Errorf("invalid pattern '%s' to '%s' at line:%d error:%s", o.text, validator, line, err)
+	}
+	p.matchers[key] = m
+	return nil
+}
+
+// match matches value against the pattern of a validator, patterns that are not compiled with the script are compiled now
+func (s *state) match(value, validator, pattern string) (bool, error) {
+	m, ok := s.rule.program.matchers[validator+" "+pattern]
+	if !ok {
+		var err error
+		m, err = matchers[validator](pattern)
+		if err != nil {
+			return false, err
+		}
+	}
+	return m(value), nil
+}
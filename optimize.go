@@ -0,0 +1,494 @@
+package gorule
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// WithoutOptimization disables folding constants and removing branches that never run when compiling scripts
+func WithoutOptimization() Option {
+	return func(e *Engine) {
+		e.noOptimization = true
+	}
+}
+
+// Dump returns what was folded and removed when the script was compiled, one line per change
+func (r *Rule) Dump() string {
+	return strings.Join(r.program.optimizations, "\n")
+}
+
+// constant is a value computed when compiling the script
+type constant struct {
+	result interface{}
+	quoted bool // the constant is a quoted string, which is text in expressions
+}
+
+func (c *constant) value(s *state) (interface{}, error) {
+	return c.result, nil
+}
+
+// optimizer folds constant expressions and removes the branches that never run
+// variables are constants if they are declared once at the top of the script, and are a const or never changed
+type optimizer struct {
+	prog     *program
+	state    *state          // holds the constants seen so far, to compute values when compiling
+	declared map[string]int  // number of declarations of each variable, including parameters and loop variables
+	changed  map[string]bool // variables that are changed after their declaration
+	dynamic  bool            // a variable is changed with a $(variable) in its path, so any variable may change
+	report   []string
+}
+
+// optimize folds constant expressions and removes the branches that never run of the program
+func (prog *program) optimize() {
+	o := &optimizer{
+		prog:     prog,
+		state:    newState(&Rule{engine: defaultEngine, program: prog}, map[string]interface{}{}),
+		declared: map[string]int{},
+		changed:  map[string]bool{},
+	}
+	for _, d := range prog.inputs {
+		o.declared[d.name]++
+	}
+	for _, d := range prog.params {
+		o.declared[d.name]++
+	}
+	o.scan(prog.body)
+	for _, f := range prog.funcs {
+		for _, param := range f.params {
+			o.declared[param]++
+		}
+		o.scan(f.body)
+	}
+
+	// ${ expressions } in strings are shared by the whole script, so only those without variables are computed
+	for _, t := range prog.templates {
+		for i, part := range t {
+			if part.expression == nil || !constantExpression(part.expression) {
+				continue
+			}
+			if v, err := part.expression.value(o.state); err == nil {
+				t[i] = templatePart{text: toString(v)}
+			}
+		}
+	}
+
+	prog.body = o.block(prog.body, true)
+	// functions can be called before the constants are declared, so they are optimized without them
+	o.state.root.vars = map[string]*variable{}
+	for _, f := range prog.funcs {
+		f.body = o.block(f.body, false)
+	}
+	sort.SliceStable(o.report, func(i, j int) bool {
+		return reportLine(o.report[i]) < reportLine(o.report[j])
+	})
+	prog.optimizations = o.report
+}
+
+// reportLine returns the line of a line of the report
+func reportLine(r string) int {
+	line, _ := strconv.Atoi(strings.TrimPrefix(strings.SplitN(r, " ", 2)[0], "line:"))
+	return line
+}
+
+func (o *optimizer) reportf(line int, format string, args ...interface{}) {
+	o.report = append(o.report, fmt.Sprintf("line:%d ", line)+fmt.Sprintf(format, args...))
+}
+
+// scan counts the declarations and finds the changes of variables in a block
+func (o *optimizer) scan(b block) {
+	changes := func(path string) {
+		root := strings.Split(path, ".")[0]
+		if strings.Contains(root, "$") {
+			o.dynamic = true
+		}
+		o.changed[root] = true
+	}
+	for _, st := range b {
+		switch st := st.(type) {
+		case *declareStatement:
+			o.declared[st.name]++
+		case *assignStatement:
+			changes(st.path)
+		case *unsetStatement:
+			changes(st.path)
+		case *valuesStatement:
+			changes(st.path)
+		case *replaceRegexStatement:
+			changes(st.path)
+		case *ifStatement:
+			for _, br := range st.branches {
+				o.scan(br.block)
+			}
+			o.scan(st.otherwise)
+		case *switchStatement:
+			for _, c := range st.cases {
+				o.scan(c.block)
+			}
+			o.scan(st.otherwise)
+		case *foreachStatement:
+			o.declared[st.key]++
+			o.declared[st.value]++
+			o.scan(st.block)
+		case *tryStatement:
+			o.declared[st.name]++
+			o.scan(st.body)
+			o.scan(st.handler)
+		case *includeStatement:
+			o.scan(st.body)
+		case *onErrorStatement:
+			if st.statement != nil {
+				o.scan(block{st.statement})
+			}
+		}
+	}
+}
+
+// block optimizes the statements of a block, top is true for the statements of the script itself
+func (o *optimizer) block(b block, top bool) block {
+	if b == nil {
+		return nil
+	}
+	out := block{}
+	for i, st := range b {
+		st = o.statement(st, top)
+		if st == nil {
+			continue
+		}
+		out = append(out, st)
+		if ends(st) && i < len(b)-1 {
+			o.reportf(b[i+1].pos(), "removed %d statements that never run after line:%d", len(b)-i-1, st.pos())
+			break
+		}
+	}
+	return out
+}
+
+// ends returns true if the statement always ends the block
+func ends(st statement) bool {
+	switch st := st.(type) {
+	case *stopStatement, *loopControlStatement:
+		return true
+	case *returnStatement:
+		return st.value == nil
+	}
+	return false
+}
+
+// statement optimizes a statement, nil is returned if it never does anything
+func (o *optimizer) statement(st statement, top bool) statement {
+	switch st := st.(type) {
+	case *declareStatement:
+		st.value = o.expression(st.value)
+		if v, ok := constantValue(st.value); ok && top && o.declared[st.name] == 1 && (st.kind == "const" || (!o.changed[st.name] && !o.dynamic)) {
+			o.state.root.vars[st.name] = &variable{value: v, constant: true}
+		}
+	case *assignStatement:
+		st.path = o.text(st.path, st.line)
+		st.value = o.expression(st.value)
+	case *unsetStatement:
+		st.path = o.text(st.path, st.line)
+	case *valuesStatement:
+		st.path = o.text(st.path, st.line)
+		st.value = o.expression(st.value)
+	case *replaceRegexStatement:
+		st.path = o.text(st.path, st.line)
+		o.operand(&st.match)
+		o.operand(&st.replace)
+	case *logStatement:
+		o.operand(&st.message)
+		for i := range st.fields {
+			o.operand(&st.fields[i].value)
+		}
+	case *actionStatement:
+		o.operand(st.status)
+		o.operand(st.value)
+	case *tagStatement:
+		o.operand(&st.tag)
+	case *failStatement:
+		o.operand(&st.reason)
+	case *returnStatement:
+		if st.value != nil {
+			st.value = o.expression(st.value)
+		}
+	case *callStatement:
+		o.call(st.call)
+	case *requireStatement:
+		o.operand(&st.message)
+		if known, result := o.condition(st.condition); known && result {
+			o.reportf(st.line, "removed 'require', the condition is always true")
+			return nil
+		}
+	case *violationStatement:
+		o.operand(&st.message)
+	case *ifStatement:
+		return o.ifStatement(st)
+	case *switchStatement:
+		return o.switchStatement(st)
+	case *foreachStatement:
+		st.collection = o.text(st.collection, st.line)
+		st.block = o.block(st.block, false)
+	case *tryStatement:
+		st.body = o.block(st.body, false)
+		st.handler = o.block(st.handler, false)
+	case *includeStatement:
+		st.body = o.block(st.body, false)
+	case *onErrorStatement:
+		if st.statement != nil {
+			st.statement = o.statement(st.statement, top)
+			if st.statement == nil {
+				return nil
+			}
+		}
+	}
+	return st
+}
+
+// ifStatement removes the branches that never run, a branch that always runs replaces the else block
+func (o *optimizer) ifStatement(st *ifStatement) statement {
+	branches := []ifBranch{}
+	for i, b := range st.branches {
+		word := "elseif"
+		if i == 0 {
+			word = "if"
+		}
+		known, result := o.condition(b.condition)
+		if known && !result {
+			o.reportf(predicateLine(b.condition, st.line), "removed '%s', the condition is never true", word)
+			continue
+		}
+		// the block is optimized once it is known to stay, so removed code is not reported
+		b.block = o.block(b.block, false)
+		if known && result {
+			if i < len(st.branches)-1 || st.otherwise != nil {
+				o.reportf(predicateLine(b.condition, st.line), "removed the branches after '%s', the condition is always true", word)
+			} else {
+				o.reportf(predicateLine(b.condition, st.line), "removed the condition of '%s', it is always true", word)
+			}
+			st.branches, st.otherwise = branches, b.block
+			st.optimize()
+			return st
+		}
+		branches = append(branches, b)
+	}
+	st.branches = branches
+	st.otherwise = o.block(st.otherwise, false)
+	if len(st.branches) == 0 && st.otherwise == nil {
+		return nil
+	}
+	st.optimize()
+	return st
+}
+
+// switchStatement picks the case that runs if the subject and values are constants
+func (o *optimizer) switchStatement(st *switchStatement) statement {
+	o.operand(&st.subject)
+	for _, c := range st.cases {
+		for i := range c.values {
+			o.operand(&c.values[i])
+		}
+	}
+	// only the block that runs is optimized, so removed code is not reported
+	if known, b := o.switchCase(st); known {
+		if b == nil {
+			return nil
+		}
+		return &ifStatement{otherwise: o.block(b, false), line: st.line}
+	}
+	for _, c := range st.cases {
+		c.block = o.block(c.block, false)
+	}
+	st.otherwise = o.block(st.otherwise, false)
+	st.optimize()
+	return st
+}
+
+// switchCase returns the block that runs, known is false if that depends on values that are not constants
+func (o *optimizer) switchCase(st *switchStatement) (known bool, b block) {
+	subject, ok := constantValue(st.subject)
+	if !ok {
+		return false, nil
+	}
+	for _, c := range st.cases {
+		if c.validator == "in_ipset" || c.validator == "in_table" {
+			return false, nil
+		}
+		for _, v := range c.values {
+			value, ok := constantValue(v)
+			if !ok {
+				return false, nil
+			}
+			result, err := eval(toString(subject), c.validator, toString(value))
+			if err != nil {
+				return false, nil
+			}
+			if result {
+				o.reportf(st.line, "removed 'switch', the case at line:%d always runs", c.line)
+				return true, c.block
+			}
+		}
+	}
+	o.reportf(st.line, "removed 'switch', no case matches")
+	return true, st.otherwise
+}
+
+// predicateLine returns the line of a condition
+func predicateLine(p predicate, line int) int {
+	switch c := p.(type) {
+	case *condition:
+		return c.line
+	case *quantifiedCondition:
+		return c.line
+	}
+	return line
+}
+
+// condition folds the values of a condition, known is true if the result is the same every time
+func (o *optimizer) condition(p predicate) (known, result bool) {
+	switch c := p.(type) {
+	case *condition:
+		if k, ok := o.expression(c).(*constant); ok {
+			result, known = k.result.(bool)
+		}
+	case *quantifiedCondition:
+		c.path = o.text(c.path, c.line)
+		c.right = o.expression(c.right)
+	}
+	return known, result
+}
+
+// expression folds the parts of an expression that are constants
+func (o *optimizer) expression(e expression) expression {
+	switch x := e.(type) {
+	case operand:
+		if x.call != nil {
+			o.call(x.call)
+			return x
+		}
+		if text := o.text(x.text, x.line); text != x.text {
+			return &constant{result: text, quoted: x.quoted}
+		}
+		return x
+	case *binaryExpression:
+		x.left, x.right = o.expression(x.left), o.expression(x.right)
+	case *condition:
+		x.left, x.right = o.expression(x.left), o.expression(x.right)
+	case *ternaryExpression:
+		x.condition = o.expression(x.condition)
+		if v, ok := constantValue(x.condition); ok {
+			if result, err := strconv.ParseBool(toString(v)); err == nil {
+				o.reportf(x.line, "removed a value of '?', the condition is always %t", result)
+				if result {
+					return o.expression(x.yes)
+				}
+				return o.expression(x.no)
+			}
+		}
+		x.yes, x.no = o.expression(x.yes), o.expression(x.no)
+	}
+	if _, ok := e.(operand); ok || !constantExpression(e) {
+		return e
+	}
+	v, err := e.value(o.state)
+	if err != nil {
+		// the error is reported when the script runs
+		return e
+	}
+	return &constant{result: v, quoted: quoted(e)}
+}
+
+// call folds the arguments of a function call
+// the arguments of builtins are kept as they are, as they may be the name of a resource, like: count(request.header.accept)
+func (o *optimizer) call(c *call) {
+	for i, a := range c.args {
+		if _, ok := a.(operand); ok {
+			if _, builtin := builtins[c.name]; builtin {
+				continue
+			}
+		}
+		c.args[i] = o.expression(a)
+	}
+}
+
+// operand interpolates the constants in a word or string
+func (o *optimizer) operand(op *operand) {
+	if op == nil {
+		return
+	}
+	if op.call != nil {
+		o.call(op.call)
+		return
+	}
+	// a value with a $ would be interpolated again
+	if text := o.text(op.text, op.line); !strings.Contains(text, "$") {
+		op.text = text
+	}
+}
+
+// text interpolates text if all its $(variables) are constants, otherwise text is returned as is
+func (o *optimizer) text(text string, line int) string {
+	if !strings.Contains(text, "$") {
+		return text
+	}
+	t, ok := o.prog.templates[text]
+	if !ok || !o.constantTemplate(t) {
+		return text
+	}
+	rendered, err := t.render(o.state)
+	if err != nil {
+		return text
+	}
+	o.reportf(line, "interpolated '%s' to '%s'", text, rendered)
+	return rendered
+}
+
+// constantTemplate returns true if all variables of a template are constants
+func (o *optimizer) constantTemplate(t template) bool {
+	for _, part := range t {
+		switch {
+		case part.expression != nil:
+			if !constantExpression(part.expression) {
+				return false
+			}
+		case part.name != "":
+			v, ok := o.state.root.vars[strings.Split(part.name, ".")[0]]
+			if !ok {
+				return false
+			}
+			if part.hasFallback && toString(v.value) == "" && !o.constantTemplate(part.fallback) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// constantExpression returns true if the value of an expression is the same every time
+func constantExpression(e expression) bool {
+	switch e := e.(type) {
+	case operand:
+		return e.call == nil && !strings.Contains(e.text, "$")
+	case *constant:
+		return true
+	case *binaryExpression:
+		return constantExpression(e.left) && constantExpression(e.right)
+	case *ternaryExpression:
+		return constantExpression(e.condition) && constantExpression(e.yes) && constantExpression(e.no)
+	case *condition:
+		// ip sets and tables can be replaced while the script runs
+		return e.validator != "in_ipset" && e.validator != "in_table" && constantExpression(e.left) && constantExpression(e.right)
+	}
+	return false
+}
+
+// constantValue returns the value of a constant expression or operand
+func constantValue(e expression) (interface{}, bool) {
+	switch e := e.(type) {
+	case operand:
+		return e.text, e.call == nil && !strings.Contains(e.text, "$")
+	case *constant:
+		return e.result, true
+	}
+	return nil, false
+}
@@ -0,0 +1,184 @@
+package gorule
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// inputDeclaration is a resource the script expects, like: input request *http.Request
+type inputDeclaration struct {
+	name     string
+	typeName string
+	line     int
+}
+
+// paramDeclaration is a parameter the script expects, like: param tenant string = "default"
+type paramDeclaration struct {
+	name         string
+	typeName     string
+	defaultValue interface{}
+	hasDefault   bool
+	line         int
+}
+
+// ExecuteOption configures a single execution of a rule
+type ExecuteOption func(*execution)
+
+// execution holds the options of a single execution of a rule
+type execution struct {
+	params map[string]interface{}
+}
+
+// WithParams passes the parameters declared with param in the script
+func WithParams(params map[string]interface{}) ExecuteOption {
+	return func(e *execution) {
+		for k, v := range params {
+			e.params[k] = v
+		}
+	}
+}
+
+// paramTypes are the types a param can be declared with
+var paramTypes = map[string]bool{
+	"string": true,
+	"int":    true,
+	"float":  true,
+	"bool":   true,
+	"any":    true,
+}
+
+// input parses an input declaration
+func (p *parser) input(line int) (*inputDeclaration, error) {
+	name, err := p.name("resource name as 1st parameter", "input")
+	if err != nil {
+		return nil, err
+	}
+	typeName, err := p.name("type as 2nd parameter", "input")
+	if err != nil {
+		return nil, err
+	}
+	return &inputDeclaration{name: name, typeName: typeName, line: line}, nil
+}
+
+// param parses a param declaration
+func (p *parser) param(line int) (*paramDeclaration, error) {
+	name, err := p.name("parameter name as 1st parameter", "param")
+	if err != nil {
+		return nil, err
+	}
+	typeName, err := p.name("type as 2nd parameter", "param")
+	if err != nil {
+		return nil, err
+	}
+	if !paramTypes[typeName] {
+		return nil, fmt.Errorf("unknown type '%s' for param '%s' at line:%d", typeName, name, line)
+	}
+	d := &paramDeclaration{name: name, typeName: typeName, line: line}
+	if t := p.peek(); t.kind == tokenWord && t.text == "=" {
+		p.next()
+		value, err := p.operand("default value", "param")
+		if err != nil {
+			return nil, err
+		}
+		d.defaultValue, err = convertParam(typeName, value.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid default value for param '%s' at line:%d error:%s", name, line, err)
+		}
+		d.hasDefault = true
+	}
+	return d, nil
+}
+
+// convertParam converts a default value in the script to the type of the param
+func convertParam(typeName, value string) (interface{}, error) {
+	switch typeName {
+	case "int":
+		return strconv.Atoi(value)
+	case "float":
+		return strconv.ParseFloat(value, 64)
+	case "bool":
+		return strconv.ParseBool(value)
+	}
+	return value, nil
+}
+
+// validate checks if the resource passed by the caller matches the declaration
+func (d *inputDeclaration) validate(resources map[string]interface{}) error {
+	r, ok := resources[d.name]
+	if !ok || r == nil {
+		return fmt.Errorf("missing input '%s' of type '%s' declared at line:%d", d.name, d.typeName, d.line)
+	}
+	if d.typeName != "any" && fmt.Sprintf("%T", r) != d.typeName {
+		return fmt.Errorf("input '%s' is of type '%T', expected '%s' declared at line:%d", d.name, r, d.typeName, d.line)
+	}
+	return nil
+}
+
+// value returns the value passed by the caller, or the default if none was passed
+func (d *paramDeclaration) value(params map[string]interface{}) (interface{}, error) {
+	v, ok := params[d.name]
+	if !ok {
+		if !d.hasDefault {
+			return nil, fmt.Errorf("missing param '%s' of type '%s' declared at line:%d", d.name, d.typeName, d.line)
+		}
+		return d.defaultValue, nil
+	}
+	if !isParamType(d.typeName, v) {
+		return nil, fmt.Errorf("param '%s' is of type '%T', expected '%s' declared at line:%d", d.name, v, d.typeName, d.line)
+	}
+	// numbers are converted so the script only sees int and float64
+	switch d.typeName {
+	case "int":
+		return int(reflect.ValueOf(v).Convert(reflect.TypeOf(0)).Int()), nil
+	case "float":
+		return reflect.ValueOf(v).Convert(reflect.TypeOf(0.0)).Float(), nil
+	}
+	return v, nil
+}
+
+// isParamType returns true if the value matches the type of a param
+func isParamType(typeName string, v interface{}) bool {
+	if v == nil {
+		return typeName == "any"
+	}
+	switch reflect.TypeOf(v).Kind() {
+	case reflect.String:
+		return typeName == "string" || typeName == "any"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return typeName == "int" || typeName == "float" || typeName == "any"
+	case reflect.Float32, reflect.Float64:
+		return typeName == "float" || typeName == "any"
+	case reflect.Bool:
+		return typeName == "bool" || typeName == "any"
+	}
+	return typeName == "any"
+}
+
+// declare validates the resources and parameters passed by the caller, and declares the parameters as constants
+func (p *program) declare(s *state, params map[string]interface{}) error {
+	for _, d := range p.inputs {
+		if err := d.validate(s.resources); err != nil {
+			return err
+		}
+	}
+	declared := map[string]bool{}
+	for _, d := range p.params {
+		v, err := d.value(params)
+		if err != nil {
+			return err
+		}
+		if _, ok := s.resources[d.name]; ok {
+			return fmt.Errorf("param with the name '%s' already exists as resource declared at line:%d", d.name, d.line)
+		}
+		s.root.vars[d.name] = &variable{value: v, constant: true}
+		declared[d.name] = true
+	}
+	for name := range params {
+		if !declared[name] {
+			return fmt.Errorf("unknown param '%s', it is not declared by the script", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,511 @@
+package gorule
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// parser turns the tokens of a script in to statements
+type parser struct {
+	tokens []token
+	pos    int
+	loops  int // depth of foreach loops, to validate break and continue
+	depth  int // depth of blocks, functions can only be defined outside of blocks
+	funcs  map[string]*function
+	calls  []*call
+
+	templates map[string]template // parsed $(variables) of the strings in the script
+	matchers  map[string]matcher  // compiled patterns of match_regex, match_glob and match_host
+
+	fs       fs.FS           // filesystem for include and import
+	file     string          // name of the included file, empty for the script itself
+	stack    []string        // files being included, to detect cycles
+	imported map[string]bool // files already imported
+}
+
+// program is a compiled script
+type program struct {
+	inputs    []*inputDeclaration
+	params    []*paramDeclaration
+	funcs     map[string]*function
+	templates map[string]template
+	matchers  map[string]matcher
+	body      block
+	// optimizations are the constants folded and branches removed when compiling, see Rule.Dump
+	optimizations []string
+}
+
+// compile parses the script in to a program
+func compile(script []byte, fsys fs.FS) (*program, error) {
+	tokens, err := newLexer(script).tokens()
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{
+		tokens:    tokens,
+		funcs:     map[string]*function{},
+		templates: map[string]template{},
+		matchers:  map[string]matcher{},
+		fs:        fsys,
+		imported:  map[string]bool{},
+	}
+	prog := &program{funcs: p.funcs, templates: p.templates, matchers: p.matchers}
+
+	// the input and param declarations are only allowed at the start of the script
+	for {
+		p.skipNewlines()
+		t := p.peek()
+		if t.kind != tokenWord || (t.text != "input" && t.text != "param") {
+			break
+		}
+		p.next()
+		if t.text == "input" {
+			d, err := p.input(t.line)
+			if err != nil {
+				return nil, err
+			}
+			prog.inputs = append(prog.inputs, d)
+		} else {
+			d, err := p.param(t.line)
+			if err != nil {
+				return nil, err
+			}
+			prog.params = append(prog.params, d)
+		}
+		if !p.endOfStatement() {
+			t := p.peek()
+			return nil, fmt.Errorf("unexpected item in script logic. '%s' does not make sense at line:%d", t.text, t.line)
+		}
+	}
+
+	prog.body, err = p.statements(tokenEOF)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.validateCalls(); err != nil {
+		return nil, err
+	}
+	return prog, nil
+}
+
+// peek returns the next token without moving on
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+// next returns the next token and moves on
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// skipNewlines moves past any empty lines
+func (p *parser) skipNewlines() {
+	for p.peek().kind == tokenNewline {
+		p.next()
+	}
+}
+
+// endOfStatement returns true if the next token ends the statement
+func (p *parser) endOfStatement() bool {
+	switch p.peek().kind {
+	case tokenNewline, tokenRBrace, tokenEOF:
+		return true
+	}
+	return false
+}
+
+// statements parses statements till the end token is found, the end token is not consumed
+func (p *parser) statements(end tokenKind) (block, error) {
+	statements := block{}
+	for {
+		p.skipNewlines()
+		t := p.peek()
+		if t.kind == end {
+			return statements, nil
+		}
+		if t.kind == tokenEOF {
+			return nil, fmt.Errorf("expected '}' before the end of the script at line:%d", t.line)
+		}
+		// functions are defined for the whole script, and are not a statement themselves
+		if t.kind == tokenWord && t.text == "func" {
+			p.next()
+			if err := p.function(t.line); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		// imports only define functions
+		if s == nil {
+			continue
+		}
+		// a statement can have its own on_error policy at the end of the line
+		if t := p.peek(); t.kind == tokenWord && t.text == "on_error" {
+			p.next()
+			policy, err := p.onError(t.line)
+			if err != nil {
+				return nil, err
+			}
+			s = &onErrorStatement{policy: policy, statement: s, line: s.pos()}
+		}
+		statements = append(statements, s)
+		if !p.endOfStatement() {
+			t := p.peek()
+			return nil, fmt.Errorf("unexpected item in script logic. '%s' does not make sense at line:%d", t.text, t.line)
+		}
+	}
+}
+
+// block parses a { block } of statements
+func (p *parser) block(word string) (block, error) {
+	t := p.next()
+	if t.kind != tokenLBrace {
+		return nil, fmt.Errorf("expected '{' after '%s' at line:%d", word, t.line)
+	}
+	p.depth++
+	statements, err := p.statements(tokenRBrace)
+	p.depth--
+	if err != nil {
+		return nil, err
+	}
+	p.next()
+	return statements, nil
+}
+
+// operand parses a word or string used as value
+func (p *parser) operand(description, word string) (operand, error) {
+	t := p.next()
+	if t.kind != tokenWord && t.kind != tokenString {
+		return operand{}, fmt.Errorf("expected %s to '%s' at line:%d", description, word, t.line)
+	}
+	// a name directly followed by ( is a function call
+	if t.kind == tokenWord && p.peek().kind == tokenLParen && functionName.MatchString(t.text) {
+		c, err := p.call(t.text, t.line)
+		if err != nil {
+			return operand{}, err
+		}
+		return operand{text: t.text, call: c, line: t.line}, nil
+	}
+	if err := p.interpolated(t.text, t.line); err != nil {
+		return operand{}, err
+	}
+	return operand{text: t.text, quoted: t.quoted, line: t.line}, nil
+}
+
+// name parses a word used as name of a variable
+func (p *parser) name(description, word string) (string, error) {
+	t := p.next()
+	if t.kind != tokenWord || t.text == "" {
+		return "", fmt.Errorf("expected %s after '%s' at line:%d", description, word, t.line)
+	}
+	return t.text, nil
+}
+
+// statement parses a single statement
+func (p *parser) statement() (statement, error) {
+	t := p.next()
+	if t.kind != tokenWord {
+		return nil, fmt.Errorf("unexpected item in script logic. '%s' does not make sense at line:%d", t.text, t.line)
+	}
+	word := t.text
+	switch word {
+	// if and elseif means we validate the 3 words after that
+	case "if":
+		return p.ifStatement(t)
+
+	case "elseif", "else":
+		return nil, fmt.Errorf("'%s' without 'if' at line:%d", word, t.line)
+
+	case "input", "param":
+		return nil, fmt.Errorf("'%s' must be declared before any other statement at line:%d", word, t.line)
+
+	// log sends the next word (or string) and any key=value fields on the same line to the log sink
+	case "log", "log.debug", "log.info", "log.warn", "log.error":
+		message, err := p.operand("string as 1st parameter", word)
+		if err != nil {
+			return nil, err
+		}
+		s := &logStatement{level: logLevels[word], message: message, line: t.line}
+		for !p.endOfStatement() && p.peek().text != "on_error" {
+			f := p.next()
+			kv := strings.SplitN(f.text, "=", 2)
+			if f.kind != tokenWord || len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("expected key=value fields after '%s' at line:%d", word, f.line)
+			}
+			if err := p.interpolated(kv[1], f.line); err != nil {
+				return nil, err
+			}
+			s.fields = append(s.fields, logField{key: kv[0], value: operand{text: kv[1], quoted: f.quoted, line: f.line}})
+		}
+		return s, nil
+
+	// export declares a variable that can be read back by the caller after execution
+	case "export":
+		kind, err := p.name("'var' or 'const'", word)
+		if err != nil {
+			return nil, err
+		}
+		if kind != "var" && kind != "const" {
+			return nil, fmt.Errorf("expected 'var' or 'const' after '%s' at line:%d", word, t.line)
+		}
+		s, err := p.declare(kind, t.line)
+		if err != nil {
+			return nil, err
+		}
+		s.exported = true
+		return s, nil
+
+	case "var", "let", "const":
+		return p.declare(word, t.line)
+
+	// stop, return and fail end the script at any depth
+	case "stop":
+		return &stopStatement{line: t.line}, nil
+
+	case "return":
+		s := &returnStatement{line: t.line}
+		if !p.endOfStatement() {
+			value, err := p.expression("value as 1st parameter", word)
+			if err != nil {
+				return nil, err
+			}
+			s.value = value
+		}
+		return s, nil
+
+	case "fail":
+		reason, err := p.operand("reason as 1st parameter", word)
+		if err != nil {
+			return nil, err
+		}
+		return &failStatement{reason: reason, line: t.line}, nil
+
+	// deny, redirect and respond decide what the caller should do, and end the script
+	case "deny", "redirect", "respond":
+		return p.action(word, t.line)
+
+	case "tag":
+		tag, err := p.operand("string as 1st parameter", word)
+		if err != nil {
+			return nil, err
+		}
+		return &tagStatement{tag: tag, line: t.line}, nil
+
+	// require and violation collect violations when evaluating a script as policy
+	case "require":
+		c, err := p.condition(word)
+		if err != nil {
+			return nil, err
+		}
+		message, err := p.operand("message as 4th parameter", word)
+		if err != nil {
+			return nil, err
+		}
+		return &requireStatement{condition: c, message: message, line: t.line}, nil
+
+	case "violation":
+		message, err := p.operand("message as 1st parameter", word)
+		if err != nil {
+			return nil, err
+		}
+		return &violationStatement{message: message, line: t.line}, nil
+
+	case "foreach":
+		return p.foreach(t.line)
+
+	case "break", "continue":
+		if p.loops == 0 {
+			return nil, fmt.Errorf("'%s' outside of 'foreach' at line:%d", word, t.line)
+		}
+		if word == "break" {
+			return &loopControlStatement{err: errBreak, line: t.line}, nil
+		}
+		return &loopControlStatement{err: errContinue, line: t.line}, nil
+
+	case "include", "import":
+		return p.include(word, t.line)
+
+	case "try":
+		return p.try(t.line)
+
+	case "on_error":
+		policy, err := p.onError(t.line)
+		if err != nil {
+			return nil, err
+		}
+		return &onErrorStatement{policy: policy, line: t.line}, nil
+
+	case "switch":
+		return p.switchStatement(t.line)
+
+	case "unset":
+		path, err := p.name("resource variable as 1st parameter", word)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.interpolated(path, t.line); err != nil {
+			return nil, err
+		}
+		return &unsetStatement{path: path, line: t.line}, nil
+	}
+
+	// a name directly followed by ( is a function call
+	if p.peek().kind == tokenLParen && functionName.MatchString(word) {
+		c, err := p.call(word, t.line)
+		if err != nil {
+			return nil, err
+		}
+		return &callStatement{call: c}, nil
+	}
+
+	// any other word should be a variable or resource we want to set based on the next parameter
+	if err := p.interpolated(word, t.line); err != nil {
+		return nil, err
+	}
+
+	// add and set change all values of a field, unless they are used as variable name
+	if next := p.peek(); (word == "add" || word == "set") && next.kind == tokenWord && !assignOperators[next.text] {
+		path, err := p.name("resource variable as 1st parameter", word)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.interpolated(path, t.line); err != nil {
+			return nil, err
+		}
+		value, err := p.expression("value as 2nd parameter", word)
+		if err != nil {
+			return nil, err
+		}
+		return &valuesStatement{add: word == "add", path: path, value: value, line: t.line}, nil
+	}
+
+	validator := p.next()
+	switch validator.text {
+	case "=", "+=", "-=":
+		value, err := p.expression("variable as 2nd parameter after variable", word)
+		if err != nil {
+			return nil, err
+		}
+		return &assignStatement{path: word, operator: validator.text, value: value, line: t.line}, nil
+	case "replace_regex":
+		match, err := p.operand("variable as 2nd parameter after variable", word)
+		if err != nil {
+			return nil, err
+		}
+		replace, err := p.operand("variable as 3nd parameter after 'replace_regex' variable", word)
+		if err != nil {
+			return nil, err
+		}
+		return &replaceRegexStatement{path: word, match: match, replace: replace, line: t.line}, nil
+	}
+	// something did not make sense :-(
+	return nil, fmt.Errorf("unexpected item in script logic. '%s' does not make sense at line:%d", word, t.line)
+}
+
+// assignOperators are the operators that can follow the name of a variable or resource
+var assignOperators = map[string]bool{
+	"=":             true,
+	"+=":            true,
+	"-=":            true,
+	"replace_regex": true,
+}
+
+// ifStatement parses the if, elseif and else branches
+func (p *parser) ifStatement(t token) (statement, error) {
+	s := &ifStatement{line: t.line}
+	word := t.text
+	for {
+		c, err := p.condition(word)
+		if err != nil {
+			return nil, err
+		}
+		b, err := p.block(word)
+		if err != nil {
+			return nil, err
+		}
+		s.branches = append(s.branches, ifBranch{condition: c, block: b})
+
+		// elseif and else may start on the next line
+		pos := p.pos
+		p.skipNewlines()
+		next := p.peek()
+		if next.kind != tokenWord {
+			p.pos = pos
+			s.optimize()
+			return s, nil
+		}
+		switch next.text {
+		case "elseif":
+			p.next()
+			word = next.text
+		case "else":
+			p.next()
+			s.otherwise, err = p.block(next.text)
+			if err != nil {
+				return nil, err
+			}
+			s.optimize()
+			return s, nil
+		default:
+			p.pos = pos
+			s.optimize()
+			return s, nil
+		}
+	}
+}
+
+// condition parses the value validator value of an if statement, or a condition on all values after any or all
+func (p *parser) condition(word string) (predicate, error) {
+	line := p.peek().line
+	if t := p.peek(); t.kind == tokenWord && (t.text == "any" || t.text == "all") && !validators[p.tokens[p.pos+1].text] {
+		p.next()
+		return p.quantified(t.text, line)
+	}
+	left, err := p.binary(0, "value as 1st parameter", word)
+	if err != nil {
+		return nil, err
+	}
+	validator, err := p.name("validator as 2nd parameter", word)
+	if err != nil {
+		return nil, err
+	}
+	if !validators[validator] {
+		return nil, fmt.Errorf("unknown validator '%s' to '%s' at line:%d", validator, word, line)
+	}
+	right, err := p.binary(0, "value as 3st parameter", word)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.matcher(validator, right, line); err != nil {
+		return nil, err
+	}
+	return &condition{left: left, validator: validator, right: right, line: line}, nil
+}
+
+// declare parses a var, let or const statement
+func (p *parser) declare(kind string, line int) (*declareStatement, error) {
+	name, err := p.name("variable as 1st parameter", kind)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(name, ".") {
+		return nil, fmt.Errorf("variable name '%s' may not contain a '.' at line:%d", name, line)
+	}
+	// the = between name and value is optional
+	if t := p.peek(); t.kind == tokenWord && t.text == "=" {
+		p.next()
+	}
+	value, err := p.expression("value as 2st parameter", kind)
+	if err != nil {
+		return nil, err
+	}
+	return &declareStatement{kind: kind, name: name, value: value, line: line}, nil
+}
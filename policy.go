@@ -0,0 +1,79 @@
+package gorule
+
+import (
+	"fmt"
+)
+
+// Violation is a failed require or a violation statement of a script
+type Violation struct {
+	Message string
+	Script  string
+	Line    int
+}
+
+// Decision is the result of evaluating a script as policy
+type Decision struct {
+	// Allowed is true if there were no violations and the script did not deny
+	Allowed    bool
+	Violations []Violation
+	Result     *Result
+}
+
+// Evaluate runs the rule as policy, and collects all violations instead of stopping at the first one
+func (r *Rule) Evaluate(i map[string]interface{}, opts ...ExecuteOption) (*Decision, error) {
+	result, err := r.Execute(i, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Decision{
+		Allowed:    len(result.Violations) == 0 && result.Outcome.Action != ActionDeny,
+		Violations: result.Violations,
+		Result:     result,
+	}, nil
+}
+
+// requireStatement adds a violation if the condition does not match, like: require $(x) == 1 "x must be 1"
+type requireStatement struct {
+	condition predicate
+	message   operand
+	line      int
+}
+
+func (st *requireStatement) pos() int {
+	return st.line
+}
+
+func (st *requireStatement) exec(s *state) error {
+	result, err := st.condition.eval(s)
+	if err != nil {
+		return err
+	}
+	if result {
+		return nil
+	}
+	return s.violation(st.message, st.line)
+}
+
+// violationStatement adds a violation, like: violation "x must be 1"
+type violationStatement struct {
+	message operand
+	line    int
+}
+
+func (st *violationStatement) pos() int {
+	return st.line
+}
+
+func (st *violationStatement) exec(s *state) error {
+	return s.violation(st.message, st.line)
+}
+
+// violation adds the message as violation to the result
+func (s *state) violation(message operand, line int) error {
+	m, err := s.text(message)
+	if err != nil {
+		return fmt.Errorf("error parsing message of violation at line:%d error:%s", line, err)
+	}
+	s.violations = append(s.violations, Violation{Message: m, Script: s.rule.name, Line: line})
+	return nil
+}
@@ -0,0 +1,135 @@
+package gorule
+
+import (
+	"fmt"
+)
+
+// switchCase is a case of a switch statement, it matches if any of the values validates against the subject
+type switchCase struct {
+	validator string
+	values    []operand
+	block     block
+	line      int
+}
+
+// switchStatement runs the first case that matches the subject, or the default if none did
+type switchStatement struct {
+	subject   operand
+	cases     []*switchCase
+	otherwise block
+	dispatch  map[int]*dispatch // dispatches of runs of cases, by their first case
+	line      int
+}
+
+// switchStatement parses a switch statement, like:
+// switch $(request.host) { case "a.com", "b.com" { } case match_regex "^api\." { } default { } }
+func (p *parser) switchStatement(line int) (statement, error) {
+	subject, err := p.operand("value as 1st parameter", "switch")
+	if err != nil {
+		return nil, err
+	}
+	st := &switchStatement{subject: subject, line: line}
+	if t := p.next(); t.kind != tokenLBrace {
+		return nil, fmt.Errorf("expected '{' after 'switch' at line:%d", t.line)
+	}
+	for {
+		p.skipNewlines()
+		t := p.next()
+		switch {
+		case t.kind == tokenRBrace:
+			st.optimize()
+			return st, nil
+
+		case t.kind == tokenWord && t.text == "case":
+			c, err := p.switchCase(t.line)
+			if err != nil {
+				return nil, err
+			}
+			st.cases = append(st.cases, c)
+
+		case t.kind == tokenWord && t.text == "default":
+			if st.otherwise != nil {
+				return nil, fmt.Errorf("multiple 'default' in 'switch' at line:%d", t.line)
+			}
+			st.otherwise, err = p.block("default")
+			if err != nil {
+				return nil, err
+			}
+
+		default:
+			return nil, fmt.Errorf("expected 'case' or 'default' in 'switch' at line:%d", t.line)
+		}
+	}
+}
+
+// switchCase parses the values and block of a case
+func (p *parser) switchCase(line int) (*switchCase, error) {
+	c := &switchCase{validator: "==", line: line}
+	// a validator followed by a value changes how the values are compared
+	if t := p.peek(); t.kind == tokenWord && validators[t.text] {
+		if n := p.tokens[p.pos+1]; n.kind == tokenWord || n.kind == tokenString {
+			c.validator = t.text
+			p.next()
+		}
+	}
+	for {
+		value, err := p.operand("value", "case")
+		if err != nil {
+			return nil, err
+		}
+		if err := p.matcher(c.validator, value, line); err != nil {
+			return nil, err
+		}
+		c.values = append(c.values, value)
+		if p.peek().kind != tokenComma {
+			break
+		}
+		p.next()
+	}
+	var err error
+	c.block, err = p.block("case")
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (st *switchStatement) pos() int {
+	return st.line
+}
+
+func (st *switchStatement) exec(s *state) error {
+	// the subject is only evaluated once
+	subject, err := s.text(st.subject)
+	if err != nil {
+		return fmt.Errorf("error parsing value as 1st parameter to 'switch' at line:%d error:%s", st.line, err)
+	}
+	for i := 0; i < len(st.cases); i++ {
+		if d, ok := st.dispatch[i]; ok {
+			if index, ok := d.find(subject); ok && index >= 0 {
+				return st.cases[index].block.exec(s)
+			} else if ok {
+				i = d.last
+				continue
+			}
+		}
+		c := st.cases[i]
+		for _, v := range c.values {
+			value, err := s.text(v)
+			if err != nil {
+				return fmt.Errorf("error parsing value to 'case' at line:%d error:%s", c.line, err)
+			}
+			result, err := s.eval(subject, c.validator, value)
+			if err != nil {
+				return fmt.Errorf("failed to validate 'case' at line:%d error:%s", c.line, err)
+			}
+			if result {
+				return c.block.exec(s)
+			}
+		}
+	}
+	if st.otherwise != nil {
+		return st.otherwise.exec(s)
+	}
+	return nil
+}
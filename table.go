@@ -0,0 +1,173 @@
+package gorule
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TableMode is the way the keys of a lookup table are matched
+type TableMode int
+
+const (
+	// TableExact matches the key that is equal to the value
+	TableExact TableMode = iota
+	// TablePrefix matches the longest key the value starts with, like /api/ for /api/users
+	TablePrefix
+	// TableWildcard matches the key that is equal to the value, or else the most specific wildcard key
+	// like *.example.com for www.example.com
+	TableWildcard
+)
+
+// table is a lookup table, it is replaced as a whole when it is loaded again
+type table struct {
+	mode    TableMode
+	entries map[string]string
+}
+
+// find returns the value of the key matching value
+func (t *table) find(value string) (string, bool) {
+	if v, ok := t.entries[value]; ok {
+		return v, true
+	}
+	switch t.mode {
+	case TablePrefix:
+		for i := len(value) - 1; i >= 0; i-- {
+			if v, ok := t.entries[value[:i]]; ok {
+				return v, true
+			}
+		}
+	case TableWildcard:
+		for i := strings.Index(value, "."); i >= 0; i = strings.Index(value, ".") {
+			if v, ok := t.entries["*"+value[i:]]; ok {
+				return v, true
+			}
+			value = value[i+1:]
+		}
+		if v, ok := t.entries["*"]; ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// LoadTable loads the lookup table with the name, to be used as: lookup("name", $(request.host), "default")
+// or: if $(request.host) in_table "name"
+// loading a table with the name of an existing table replaces it, scripts running at that time use either the old or the new table
+func (e *Engine) LoadTable(name string, mode TableMode, entries map[string]string) {
+	t := &table{mode: mode, entries: make(map[string]string, len(entries))}
+	for k, v := range entries {
+		t.entries[k] = v
+	}
+	e.tables.Store(name, t)
+}
+
+// LoadTableCSV loads the lookup table with the name from csv, each record is a key and an optional value
+// lines starting with # are skipped
+func (e *Engine) LoadTableCSV(name string, mode TableMode, r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	entries := map[string]string{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read table '%s': %s", name, err)
+		}
+		line, _ := reader.FieldPos(0)
+		switch len(record) {
+		case 1:
+			entries[record[0]] = ""
+		case 2:
+			entries[record[0]] = record[1]
+		default:
+			return fmt.Errorf("invalid record at line:%d of table '%s', expected a key and a value but got %d fields", line, name, len(record))
+		}
+	}
+	e.LoadTable(name, mode, entries)
+	return nil
+}
+
+// LoadTableJSON loads the lookup table with the name from a json object, the values are strings, numbers or booleans
+func (e *Engine) LoadTableJSON(name string, mode TableMode, r io.Reader) error {
+	var object map[string]interface{}
+	d := json.NewDecoder(r)
+	d.UseNumber()
+	if err := d.Decode(&object); err != nil {
+		return fmt.Errorf("failed to read table '%s': %s", name, err)
+	}
+	entries := make(map[string]string, len(object))
+	for k, v := range object {
+		switch v.(type) {
+		case string, json.Number, bool:
+			entries[k] = toString(v)
+		default:
+			return fmt.Errorf("invalid value of key '%s' of table '%s', expected a string, number or boolean but got a json %s", k, name, jsonType(v))
+		}
+	}
+	e.LoadTable(name, mode, entries)
+	return nil
+}
+
+// LoadTableFile loads the lookup table with the name from a .csv or .json file
+func (e *Engine) LoadTableFile(name string, mode TableMode, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read table '%s': %s", name, err)
+	}
+	defer f.Close()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return e.LoadTableCSV(name, mode, f)
+	case ".json":
+		return e.LoadTableJSON(name, mode, f)
+	}
+	return fmt.Errorf("failed to read table '%s': unknown format of '%s', expected .csv or .json", name, path)
+}
+
+// table returns the lookup table with the name
+func (e *Engine) table(name string) (*table, error) {
+	t, ok := e.tables.Load(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown table '%s'", name)
+	}
+	return t.(*table), nil
+}
+
+// inTable returns true if value matches a key of the lookup table with the name
+func (e *Engine) inTable(value, name string) (bool, error) {
+	t, err := e.table(name)
+	if err != nil {
+		return false, err
+	}
+	_, ok := t.find(value)
+	return ok, nil
+}
+
+// lookupTable returns the value of the key matching value in a lookup table, like: lookup("tenants", $(request.host), "default")
+func lookupTable(s *state, c *call) (interface{}, error) {
+	args := make([]string, len(c.args))
+	for i, a := range c.args {
+		v, err := a.value(s)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing argument %d to '%s' at line:%d error:%s", i+1, c.name, c.line, err)
+		}
+		args[i] = toString(v)
+	}
+	t, err := s.rule.engine.table(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("error calling '%s' at line:%d error:%s", c.name, c.line, err)
+	}
+	if v, ok := t.find(args[1]); ok {
+		return v, nil
+	}
+	return args[2], nil
+}
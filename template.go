@@ -0,0 +1,374 @@
+package gorule
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// template is a string with $(variables) and ${ expressions } to interpolate
+type template []templatePart
+
+// templatePart is a literal text, a $(variable) or a ${ expression } of a template
+type templatePart struct {
+	text        string
+	name        string
+	fallback    template // value of $(name:-fallback) if the variable is missing or empty
+	hasFallback bool
+	filters     []filterCall
+	expression  expression
+}
+
+// filterCall is a filter applied to the value of a variable, like: $(request.host | lower)
+type filterCall struct {
+	name string
+	args []string
+}
+
+// filter changes the value of a variable, args is the number of arguments it expects
+// apply is used on each value of a variable, list on all values at once, like all values of a header
+type filter struct {
+	args  int
+	apply func(v string, args []string) (interface{}, error)
+	list  func(v []string, args []string) (interface{}, error)
+}
+
+// filters are the filters that can be used in $(variable | filter)
+var filters = map[string]filter{
+	"lower": {apply: func(v string, args []string) (interface{}, error) {
+		return strings.ToLower(v), nil
+	}},
+	"upper": {apply: func(v string, args []string) (interface{}, error) {
+		return strings.ToUpper(v), nil
+	}},
+	"trim": {apply: func(v string, args []string) (interface{}, error) {
+		return strings.TrimSpace(v), nil
+	}},
+	"trimprefix": {args: 1, apply: func(v string, args []string) (interface{}, error) {
+		return strings.TrimPrefix(v, args[0]), nil
+	}},
+	"trimsuffix": {args: 1, apply: func(v string, args []string) (interface{}, error) {
+		return strings.TrimSuffix(v, args[0]), nil
+	}},
+	"urlencode": {apply: func(v string, args []string) (interface{}, error) {
+		return url.QueryEscape(v), nil
+	}},
+	"urldecode": {apply: func(v string, args []string) (interface{}, error) {
+		return url.QueryUnescape(v)
+	}},
+	"base64": {apply: func(v string, args []string) (interface{}, error) {
+		return base64.StdEncoding.EncodeToString([]byte(v)), nil
+	}},
+	"base64decode": {apply: func(v string, args []string) (interface{}, error) {
+		b, err := base64.StdEncoding.DecodeString(v)
+		return string(b), err
+	}},
+	"length": {apply: func(v string, args []string) (interface{}, error) {
+		return len(v), nil
+	}},
+	"join": {args: 1, list: func(v []string, args []string) (interface{}, error) {
+		return strings.Join(v, args[0]), nil
+	}},
+	"count": {list: func(v []string, args []string) (interface{}, error) {
+		return len(v), nil
+	}},
+	"first": {list: func(v []string, args []string) (interface{}, error) {
+		if len(v) == 0 {
+			return "", nil
+		}
+		return v[0], nil
+	}},
+	"last": {list: func(v []string, args []string) (interface{}, error) {
+		if len(v) == 0 {
+			return "", nil
+		}
+		return v[len(v)-1], nil
+	}},
+}
+
+// variableName is the format of the name in a $(variable)
+var variableName = regexp.MustCompile(`^[^\s$(){}|:"]+$`)
+
+// interpolated parses the $(variables) and ${ expressions } in text, so they are checked when compiling
+func (p *parser) interpolated(text string, line int) error {
+	if !strings.Contains(text, "$") {
+		return nil
+	}
+	if _, ok := p.templates[text]; ok {
+		return nil
+	}
+	t, err := p.template(text, line)
+	if err != nil {
+		return fmt.Errorf("invalid template '%s' at line:%d error:%s", text, line, err)
+	}
+	p.templates[text] = t
+	return nil
+}
+
+// template splits text in to literal text, $(variables) and ${ expressions }, $$( and $${ are a literal $( and ${
+func (p *parser) template(text string, line int) (template, error) {
+	t := template{}
+	literal := []byte{}
+	for i := 0; i < len(text); i++ {
+		if text[i] != '$' || i+1 == len(text) {
+			literal = append(literal, text[i])
+			continue
+		}
+		next := text[i+1]
+		if next == '$' && i+2 < len(text) && (text[i+2] == '(' || text[i+2] == '{') {
+			literal = append(literal, '$', text[i+2])
+			i += 2
+			continue
+		}
+		if next != '(' && next != '{' {
+			literal = append(literal, '$')
+			continue
+		}
+		end := closing(text, i+1)
+		if end < 0 {
+			return nil, fmt.Errorf("'$%c' is not closed", next)
+		}
+		if len(literal) > 0 {
+			t = append(t, templatePart{text: string(literal)})
+			literal = literal[:0]
+		}
+		var part templatePart
+		var err error
+		if next == '(' {
+			part, err = p.variable(text[i+2:end], line)
+		} else {
+			part, err = p.nestedExpression(text[i+2:end], line)
+		}
+		if err != nil {
+			return nil, err
+		}
+		t = append(t, part)
+		i = end
+	}
+	if len(literal) > 0 {
+		t = append(t, templatePart{text: string(literal)})
+	}
+	return t, nil
+}
+
+// closing returns the position of the bracket closing the one at start, skipping quoted strings
+func closing(text string, start int) int {
+	open := text[start]
+	close := byte(')')
+	if open == '{' {
+		close = '}'
+	}
+	depth := 0
+	for i := start; i < len(text); i++ {
+		switch text[i] {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		case '"', '`':
+			quote := text[i]
+			for i++; i < len(text) && text[i] != quote; i++ {
+				if text[i] == '\\' && quote == '"' {
+					i++
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// split splits text on sep, except within brackets or quoted strings
+func split(text string, sep byte) []string {
+	parts := []string{}
+	start, depth := 0, 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '(', '{':
+			depth++
+		case ')', '}':
+			depth--
+		case '"', '`':
+			quote := text[i]
+			for i++; i < len(text) && text[i] != quote; i++ {
+				if text[i] == '\\' && quote == '"' {
+					i++
+				}
+			}
+		case sep:
+			if depth == 0 {
+				parts = append(parts, text[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, text[start:])
+}
+
+// variable parses the inside of $(name:-fallback | filter arg)
+func (p *parser) variable(text string, line int) (templatePart, error) {
+	segments := split(text, '|')
+	part := templatePart{name: strings.TrimSpace(segments[0])}
+	if i := strings.Index(segments[0], ":-"); i >= 0 {
+		part.name = strings.TrimSpace(segments[0][:i])
+		fallback := strings.TrimSpace(segments[0][i+2:])
+		if unquoted, err := strconv.Unquote(fallback); err == nil {
+			fallback = unquoted
+		}
+		f, err := p.template(fallback, line)
+		if err != nil {
+			return part, err
+		}
+		part.fallback, part.hasFallback = f, true
+	}
+	if !variableName.MatchString(part.name) {
+		return part, fmt.Errorf("invalid variable name '%s' in '$(%s)'", part.name, text)
+	}
+
+	for _, segment := range segments[1:] {
+		tokens, err := newLexer([]byte(segment)).tokens()
+		if err != nil {
+			return part, err
+		}
+		if tokens[0].kind != tokenWord {
+			return part, fmt.Errorf("expected a filter after '|' in '$(%s)'", text)
+		}
+		call := filterCall{name: tokens[0].text}
+		for _, a := range tokens[1 : len(tokens)-1] {
+			call.args = append(call.args, a.text)
+		}
+		f, ok := filters[call.name]
+		if !ok {
+			return part, fmt.Errorf("unknown filter '%s' in '$(%s)'", call.name, text)
+		}
+		if len(call.args) != f.args {
+			return part, fmt.Errorf("filter '%s' expects %d arguments, got %d in '$(%s)'", call.name, f.args, len(call.args), text)
+		}
+		part.filters = append(part.filters, call)
+	}
+	return part, nil
+}
+
+// nestedExpression parses the inside of ${ expression }, function calls are checked with the rest of the script
+func (p *parser) nestedExpression(text string, line int) (templatePart, error) {
+	l := newLexer([]byte(text))
+	l.line = line
+	tokens, err := l.tokens()
+	if err != nil {
+		return templatePart{}, err
+	}
+	sub := &parser{
+		tokens:    tokens,
+		funcs:     p.funcs,
+		fs:        p.fs,
+		file:      p.file,
+		templates: p.templates,
+		matchers:  p.matchers,
+	}
+	e, err := sub.expression("expression", "${")
+	if err != nil {
+		return templatePart{}, err
+	}
+	if t := sub.peek(); t.kind != tokenEOF {
+		return templatePart{}, fmt.Errorf("unexpected '%s' in '${%s}'", t.text, text)
+	}
+	p.calls = append(p.calls, sub.calls...)
+	return templatePart{expression: e}, nil
+}
+
+// render interpolates the template
+func (t template) render(s *state) (string, error) {
+	out := strings.Builder{}
+	for _, part := range t {
+		switch {
+		case part.expression != nil:
+			v, err := part.expression.value(s)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(toString(v))
+		case part.name != "":
+			v, err := part.value(s)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(toString(v))
+		default:
+			out.WriteString(part.text)
+		}
+	}
+	return out.String(), nil
+}
+
+// value returns the value of a $(variable) after the fallback and filters
+// without filters a field must have a single value, filters see all values but must leave a single value
+// a missing value is an error unless there is a fallback, with or without filters
+func (part templatePart) value(s *state) (interface{}, error) {
+	if len(part.filters) == 0 {
+		v, err := s.translateVariable(part.name)
+		if part.hasFallback && ((err != nil && !errors.Is(err, ErrMultipleValues)) || (err == nil && toString(v) == "")) {
+			return part.fallback.render(s)
+		}
+		return v, err
+	}
+
+	var list []string
+	v, err := s.resolve(part.name)
+	if err == nil {
+		list = values(v)
+	}
+	if err == nil && len(list) == 0 && !part.hasFallback {
+		// the value is missing, which is reported the same as without filters
+		if _, terr := s.translateVariable(part.name); terr != nil {
+			return nil, terr
+		}
+	}
+	if part.hasFallback && (err != nil || len(list) == 0 || (len(list) == 1 && list[0] == "")) {
+		f, ferr := part.fallback.render(s)
+		list, err = []string{f}, ferr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error translating variable '%s': %s", part.name, err)
+	}
+
+	var result interface{} = list
+	for _, c := range part.filters {
+		f := filters[c.name]
+		if f.list != nil {
+			result, err = f.list(values(result), c.args)
+		} else {
+			var mapped []string
+			for _, item := range values(result) {
+				r, ferr := f.apply(item, c.args)
+				if ferr != nil {
+					err = ferr
+					break
+				}
+				mapped = append(mapped, toString(r))
+			}
+			result = mapped
+			if len(mapped) == 1 {
+				result = mapped[0]
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("filter '%s' of '%s' failed: %s", c.name, part.name, err)
+		}
+	}
+	if list, ok := result.([]string); ok {
+		switch len(list) {
+		case 0:
+			return "", nil
+		case 1:
+			return list[0], nil
+		}
+		return nil, fmt.Errorf("error translating variable '%s': the filters leave %d values, %w", part.name, len(list), ErrMultipleValues)
+	}
+	return result, nil
+}
@@ -0,0 +1,165 @@
+package gorule
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// onErrorPolicy decides what happens when a statement fails
+type onErrorPolicy string
+
+const (
+	// onErrorAbort ends the script with the error, this is the default
+	onErrorAbort onErrorPolicy = "abort"
+	// onErrorContinue ignores the error, and continues with the next statement
+	onErrorContinue onErrorPolicy = "continue"
+	// onErrorSkipBlock ignores the error, and continues after the current block
+	onErrorSkipBlock onErrorPolicy = "skip_block"
+)
+
+// onErrorPolicies are the policies known by on_error
+var onErrorPolicies = map[string]onErrorPolicy{
+	"abort":      onErrorAbort,
+	"continue":   onErrorContinue,
+	"skip_block": onErrorSkipBlock,
+}
+
+// lineError is the error of a statement, with the line of the statement that failed
+type lineError struct {
+	line int
+	err  error
+}
+
+func (e *lineError) Error() string {
+	return e.err.Error()
+}
+
+func (e *lineError) Unwrap() error {
+	return e.err
+}
+
+// withLine adds the line of the statement to the error, unless a nested statement already did
+func withLine(st statement, err error) error {
+	var le *lineError
+	if errors.As(err, &le) {
+		return err
+	}
+	return &lineError{line: st.pos(), err: err}
+}
+
+// isFail returns true if the script ended with fail, this can not be caught
+func isFail(err error) bool {
+	var f *FailError
+	return errors.As(err, &f)
+}
+
+// onErrorStatement sets the policy for the rest of the block, like: on_error continue
+// or for a single statement, like: request.url.path replace_regex "(" "" on_error continue
+type onErrorStatement struct {
+	policy    onErrorPolicy
+	statement statement
+	line      int
+}
+
+// onError parses the policy of an on_error statement
+func (p *parser) onError(line int) (onErrorPolicy, error) {
+	name, err := p.name("'abort', 'continue' or 'skip_block'", "on_error")
+	if err != nil {
+		return "", err
+	}
+	policy, ok := onErrorPolicies[name]
+	if !ok {
+		return "", fmt.Errorf("unknown policy '%s' to 'on_error' at line:%d", name, line)
+	}
+	return policy, nil
+}
+
+func (st *onErrorStatement) pos() int {
+	return st.line
+}
+
+func (st *onErrorStatement) exec(s *state) error {
+	if st.statement != nil {
+		return st.statement.exec(s)
+	}
+	s.onError = st.policy
+	return nil
+}
+
+// policy returns the policy for a failed statement
+func (s *state) policy(st statement) onErrorPolicy {
+	if o, ok := st.(*onErrorStatement); ok && o.statement != nil {
+		return o.policy
+	}
+	return s.onError
+}
+
+// ignored logs an error that was ignored by the on_error policy
+func (s *state) ignored(st statement, err error) {
+	s.rule.engine.sink.Log(LogEntry{
+		Level:   slog.LevelWarn,
+		Message: "error ignored by on_error",
+		Script:  s.rule.name,
+		Line:    st.pos(),
+		Fields:  []LogField{LogField{Key: "error", Value: err.Error()}},
+	})
+}
+
+// tryStatement runs the catch block if the try block fails, like: try { } catch err { log $(err.message) }
+type tryStatement struct {
+	body    block
+	name    string
+	handler block
+	line    int
+}
+
+// try parses a try and catch block
+func (p *parser) try(line int) (statement, error) {
+	st := &tryStatement{line: line}
+	var err error
+	st.body, err = p.block("try")
+	if err != nil {
+		return nil, err
+	}
+	p.skipNewlines()
+	if t := p.next(); t.kind != tokenWord || t.text != "catch" {
+		return nil, fmt.Errorf("expected 'catch' after 'try' block at line:%d", t.line)
+	}
+	if t := p.peek(); t.kind == tokenWord {
+		st.name = p.next().text
+	}
+	st.handler, err = p.block("catch")
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (st *tryStatement) pos() int {
+	return st.line
+}
+
+func (st *tryStatement) exec(s *state) error {
+	err := st.body.exec(s)
+	if err == nil || isControl(err) || isFail(err) || s.exceeded {
+		return err
+	}
+
+	// the error is available in the catch block as $(name.message) and $(name.line)
+	line := st.line
+	var le *lineError
+	if errors.As(err, &le) {
+		line = le.line
+	}
+	outer := s.scope
+	s.scope = newScope(outer)
+	defer func() { s.scope = outer }()
+	if st.name != "" {
+		s.scope.vars[st.name] = &variable{value: map[string]interface{}{
+			"message": err.Error(),
+			"line":    line,
+		}}
+	}
+	return st.handler.run(s)
+}
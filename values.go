@@ -0,0 +1,229 @@
+package gorule
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// values returns all values of a resource field, like all values of a header
+func values(v interface{}) []string {
+	if v == nil {
+		return nil
+	}
+	switch v.(type) {
+	case string, []byte:
+		return []string{toString(v)}
+	}
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return nil
+	case reflect.String:
+		return []string{rv.String()}
+	case reflect.Slice, reflect.Array:
+		out := make([]string, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			out = append(out, toString(rv.Index(i).Interface()))
+		}
+		return out
+	}
+	return []string{toString(v)}
+}
+
+// pathOf returns the path of a resource field, written either as request.header.x or $(request.header.x)
+func pathOf(text string) string {
+	if strings.HasPrefix(text, "$(") && strings.HasSuffix(text, ")") {
+		return text[2 : len(text)-1]
+	}
+	return text
+}
+
+// resolve returns the value of a variable or resource field, without picking the first of multiple values
+func (s *state) resolve(path string) (interface{}, error) {
+	resource := strings.Split(path, ".")
+	r, ok := s.lookup(resource[0])
+	if !ok {
+		return nil, fmt.Errorf("unknown resource '%s'", resource[0])
+	}
+	return resolveInterface(s.rule.engine, r, resource[1:])
+}
+
+// quantifiedCondition validates all values of a resource field, like: any request.header.x-forwarded-for match_net "10.0.0.0/8"
+// any matches if one of the values matches, all matches if there are values and all of them match
+type quantifiedCondition struct {
+	quantifier string
+	path       string
+	validator  string
+	right      expression
+	line       int
+}
+
+func (c *quantifiedCondition) eval(s *state) (bool, error) {
+	path, err := s.parseVariableStrings(c.path)
+	if err != nil {
+		return false, fmt.Errorf("error parsing '%s' at line:%d error:%s", c.path, c.line, err)
+	}
+	v, err := s.resolve(path)
+	if err != nil {
+		return false, fmt.Errorf("error getting '%s' for '%s' at line:%d error:%s", path, c.quantifier, c.line, err)
+	}
+	right, err := c.right.value(s)
+	if err != nil {
+		return false, fmt.Errorf("error parsing value as 3rd parameter to '%s' at line:%d error:%s", c.quantifier, c.line, err)
+	}
+	all := values(v)
+	for _, value := range all {
+		result, err := s.eval(value, c.validator, toString(right))
+		if err != nil {
+			return false, fmt.Errorf("failed to validate '%s' at line:%d error:%s", c.quantifier, c.line, err)
+		}
+		if result && c.quantifier == "any" {
+			return true, nil
+		}
+		if !result && c.quantifier == "all" {
+			return false, nil
+		}
+	}
+	return c.quantifier == "all" && len(all) > 0, nil
+}
+
+func (c *quantifiedCondition) value(s *state) (interface{}, error) {
+	return c.eval(s)
+}
+
+// quantified parses the path validator value after any or all
+func (p *parser) quantified(quantifier string, line int) (*quantifiedCondition, error) {
+	path, err := p.name("resource as 1st parameter", quantifier)
+	if err != nil {
+		return nil, err
+	}
+	c := &quantifiedCondition{quantifier: quantifier, path: pathOf(path), line: line}
+	if err := p.interpolated(c.path, line); err != nil {
+		return nil, err
+	}
+	c.validator, err = p.name("validator as 2nd parameter", quantifier)
+	if err != nil {
+		return nil, err
+	}
+	if !validators[c.validator] {
+		return nil, fmt.Errorf("unknown validator '%s' to '%s' at line:%d", c.validator, quantifier, line)
+	}
+	c.right, err = p.binary(0, "value as 3rd parameter", quantifier)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.matcher(c.validator, c.right, line); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// valuesStatement adds a value to the values of a resource field, or replaces all its values, like: add request.header.via "proxy"
+type valuesStatement struct {
+	add   bool
+	path  string
+	value expression
+	line  int
+}
+
+func (st *valuesStatement) pos() int {
+	return st.line
+}
+
+func (st *valuesStatement) exec(s *state) error {
+	path, err := s.parseVariableStrings(st.path)
+	if err != nil {
+		return fmt.Errorf("error parsing '%s' at line:%d error:%s", st.path, st.line, err)
+	}
+	value, err := st.value.value(s)
+	if err != nil {
+		return err
+	}
+	resource := strings.Split(path, ".")
+	if v, _ := s.scope.lookup(resource[0]); v != nil && !st.add {
+		err = s.set(path, value)
+	} else if v != nil {
+		err = fmt.Errorf("variable '%s' has no values to add to", resource[0])
+	} else if r, ok := s.resources[resource[0]]; !ok {
+		err = fmt.Errorf("unknown resource '%s'", resource[0])
+	} else if len(resource) == 1 {
+		err = fmt.Errorf("resource '%s' is read-only", resource[0])
+	} else {
+		err = modifyInterfaceValues(s.rule.engine, r, resource[1:], toString(value), st.add)
+	}
+	if err != nil && st.add {
+		return fmt.Errorf("error adding '%s' to '%s' at line:%d error:%s", toString(value), path, st.line, err)
+	}
+	if err != nil {
+		return fmt.Errorf("error modifing '%s' to '%s' at line:%d error:%s", path, toString(value), st.line, err)
+	}
+	return nil
+}
+
+// modifyInterfaceValues appends a value to a slice based on tree, or replaces the slice with only the value
+func modifyInterfaceValues(e *Engine, mod interface{}, tree []string, value string, add bool) error {
+	// virtual fields are changed on a copy that is written back in to the resource
+	for i := range tree {
+		owner, err := resolveInterface(e, mod, tree[:i])
+		if err != nil {
+			return err
+		}
+		if f, ok := getVirtualField(owner, tree[i]); ok && f.modify != nil {
+			if add {
+				return fmt.Errorf("cannot add a value to '%s'", strings.Join(tree[i:], "."))
+			}
+			return f.modify(owner, tree[i:], value)
+		} else if ok {
+			return modifyInterfaceVirtual(owner, f, tree[i:], func(v interface{}, tree []string) error {
+				return modifyInterfaceValues(e, v, tree, value, add)
+			})
+		}
+	}
+
+	current, err := resolveInterface(e, mod, tree)
+	if err != nil {
+		return err
+	}
+	// fields that do not exist yet are created with a single value
+	if current == nil {
+		return modifyInterface(mod, tree, value)
+	}
+	c := reflect.ValueOf(current)
+	if c.Kind() != reflect.Slice || c.Type().Elem().Kind() != reflect.String {
+		if add {
+			return fmt.Errorf("cannot add a value to '%s' of type '%T'", tree[len(tree)-1], current)
+		}
+		return modifyInterface(mod, tree, value)
+	}
+
+	n := reflect.MakeSlice(c.Type(), 0, c.Len()+1)
+	if add {
+		n = reflect.AppendSlice(n, c)
+	}
+	n = reflect.Append(n, reflect.ValueOf(value).Convert(c.Type().Elem()))
+
+	parent, err := resolveInterface(e, mod, tree[:len(tree)-1])
+	if err != nil {
+		return err
+	}
+	key := tree[len(tree)-1]
+	p := reflect.Indirect(reflect.ValueOf(parent))
+	switch p.Kind() {
+	case reflect.Map:
+		for _, k := range p.MapKeys() {
+			if strings.EqualFold(k.String(), key) {
+				p.SetMapIndex(k, n)
+				return nil
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < p.NumField(); i++ {
+			if strings.EqualFold(p.Type().Field(i).Name, key) && p.Field(i).CanSet() {
+				p.Field(i).Set(n)
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("modifyInterfaceValues type '%s' has not been found in the resource '%T'", key, parent)
+}